@@ -87,89 +87,5491 @@ For the sake of simplicity, I will use a single, local Bacalhau server, so that
 
 The data processing job is quite simple: Read all files in a given directory and count the words. Return the per-file results in an output file, and send the total count of all files to `stdout`. 
 
-The Go code is unspectacular. It does not need to know anything about Bacalhau. There are no packages to import. Bacalhau provides the job transparently with input and output directories and also collects everything the job writes to `stdout` and `stderr`. 
+The Go code is unspectacular. It does not need to know anything about Bacalhau. There are no third-party packages to import. Bacalhau provides the job transparently with input and output directories and also collects everything the job writes to `stdout` and `stderr`. 
 
 Here is the full code in all its boringness.
 
 */
 
 // ## Imports and globals
-func main() {
-    // Bacalhau can map data sources to a "virtual" input directory. The path is arbitrary; we use `/inputs` here.
-	inputDir := "/inputs"
+package main
 
-    // Output can go to a dedicated output directory, to `stdout`, and to `stderr`. 
-	outputDir := "/outputs"
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/heap"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"io"
+	"io/fs"
+	"log"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
 
-	dir, err := os.Open(inputDir)
-	if err != nil {
-        // Here, we make use of the fact that Bacalhau collects `stderr` output as well.
+// Bacalhau can map data sources to a "virtual" input directory. The path is arbitrary; we use `/inputs` here.
+var inputDir = "/inputs"
+
+// Output can go to a dedicated output directory, to `stdout`, and to `stderr`.
+var outputDir = "/outputs"
+
+func main() {
+    // The job is configured through environment variables, which can be passed to a WASM job with `bacalhau wasm run --env`. Alternatively, options can be passed as arguments after `--`, as in `bacalhau wasm run ... -- --top-n 10 --ascii-chart`: The option name in lowercase, with dashes for underscores, and the value. A flag without a value is `true`. Arguments take precedence over environment variables. `--help` lists all options.
+	switch err := parseArgs(os.Args[1:]); {
+	case errors.Is(err, errHelp):
+		printOptions(os.Stdout)
+		return
+	case err != nil:
 		log.Fatal(err)
 	}
-	defer dir.Close()
+
+    // To tie results to a build, `VERSION_INFO=true`, or `--version`, prints the version of the binary and the defaults of the tokenizer, and exits. The version is also part of "count.json". It is set at build time with `-ldflags "-X main.version=..."`.
+	if envBool("VERSION_INFO") {
+		printVersion(os.Stdout)
+		return
+	}
+
+	opts := &options{
+		alphaOnly:  envBool("ALPHA_ONLY"),
+		alphaInner: envString("ALPHA_INNER"),
+
+        // For prose, numbers shouldn't inflate the word count. With `TOTAL_EXCLUDE_NUMBERS=true`, numeric tokens are counted separately.
+		excludeNumbers: envBool("TOTAL_EXCLUDE_NUMBERS"),
+
+        // OCR and export artifacts like byte order marks and stray control characters end up in words. `STRIP_CONTROL=true` removes them before tokenizing.
+		stripControl: envBool("STRIP_CONTROL"),
+
+        // `INVALID_UTF8` decides what happens to bytes that are not valid UTF-8: `replace` treats them as U+FFFD (the default), `skip` drops them before tokenizing, and `error` skips the whole file as unreadable.
+		invalidUTF8: envString("INVALID_UTF8"),
+
+        // Files from Windows have CRLF line endings, and some tokenizers leave the CR attached to the last word of a line. `NORMALIZE_NEWLINES=true` converts all line endings to LF before tokenizing.
+		normalizeNewlines: envBool("NORMALIZE_NEWLINES"),
+
+        // Some characters are noise in some domains. All characters in `STRIP_CHARS` are removed from each token before anything else looks at it, so with `STRIP_CHARS=_`, "foo_bar" counts as "foobar". A token that consists of these characters only is not counted.
+		stripChars: envString("STRIP_CHARS"),
+
+        // Structured text wraps words in markers, like "__init__" or "label:". `TRIM_PREFIX` and `TRIM_SUFFIX` list strings, separated by commas, that are removed from the start and the end of each token, as often as they occur, so that "label:" and "label" count as the same word. With `TRIM_SUFFIX=:`, "label::" becomes "label", too. A token that consists of these strings only is not counted.
+		trimPrefixes: splitList(envString("TRIM_PREFIX")),
+		trimSuffixes: splitList(envString("TRIM_SUFFIX")),
+
+        // `ALL_METRICS=true` also counts lines, runes, and user-perceived characters (grapheme clusters) of each file, in the same pass that counts the words.
+		allMetrics: envBool("ALL_METRICS"),
+
+        // To find minified or corrupted lines, `LONGEST_LINE=true` reports the longest line of each file by runes, its line number, and a preview of up to `LONGEST_LINE_PREVIEW` runes (80 by default, 0 for none). Line numbers need the whole file, so files are not split in this mode.
+		longestLine: envBool("LONGEST_LINE"),
+		linePreview: envInt("LONGEST_LINE_PREVIEW", 80),
+
+        // For data quality checks, `BLANK_LINES` counts the blank lines of each file and their share of all lines; many blank lines often point to a broken export. With `BLANK_LINES=empty`, only lines without any characters are blank, and with `BLANK_LINES=whitespace`, lines of spaces and tabs are, too. Files with CRLF line endings need `NORMALIZE_NEWLINES=true` for `empty`. Like `LONGEST_LINE`, this rules out splitting files.
+		blankLines: envString("BLANK_LINES"),
+
+        // For systems that can't handle anything but ASCII, `TRANSLITERATE=true` folds accented letters to their base letters before tokenizing, so that "café" and "cafe" count as the same word. A few letters without a decomposition, like "ø" or "ł", are mapped to their closest ASCII letter. Other non-ASCII characters remain. This needs a build with `-tags xtext`.
+		transliterate: envBool("TRANSLITERATE"),
+
+        // For log template mining, `FOLD_DIGITS=true` replaces each run of digits by "<NUM>" in the word frequencies, so that "req123" and "req456" both count as "req<NUM>". The word counts stay the same.
+		foldDigits: envBool("FOLD_DIGITS"),
+
+        // The `lowercase` step of `PIPELINE` folds case for everything that looks at the words. `FREQ_CASE_INSENSITIVE=true` folds case in the word frequencies only, so that "The" and "the" add up in the top words and word clouds, while term counts and the vocabulary still tell them apart. The word counts never depend on case.
+		freqFoldCase: envBool("FREQ_CASE_INSENSITIVE"),
+
+        // Independently, `TOTAL_CASE_SENSITIVE=false` folds case in the total number of unique words, as in "vocab_growth.json". It is `true` by default, so that "The" and "the" count as two words of the vocabulary whatever the frequencies do.
+		totalFoldCase: !envBoolDefault("TOTAL_CASE_SENSITIVE", true),
+	}
+
+    // Words with the same frequency are listed in alphabetical order, which by default is the byte order of their UTF-8 encoding: "Zebra" comes before "apple", and "été" after "zoo". `FREQ_SORT=unicode` sorts them by the language-neutral Unicode collation instead, and `FREQ_SORT=locale` by the rules of the language in `LOCALE`, such as "de" or "sv". The order of equal frequencies only matters where a list is cut off, as with `TOP_N`. Collation needs a build with `-tags xtext`.
+	switch mode := envString("FREQ_SORT"); mode {
+	case "", "byte":
+	case "unicode", "locale":
+		if newCollator == nil {
+			log.Fatalf("FREQ_SORT: %s needs a build with -tags xtext", mode)
+		}
+		var locale string
+		if mode == "locale" {
+			if locale = envString("LOCALE"); locale == "" {
+				log.Fatal("FREQ_SORT=locale needs a LOCALE")
+			}
+		}
+		less, err := newCollator(locale)
+		if err != nil {
+			log.Fatalf("LOCALE: %s", err)
+		}
+		wordLess = less
+	default:
+		log.Fatalf("FREQ_SORT: unknown mode %q", mode)
+	}
+
+    // To debug the tokenizer settings, `DUMP_TOKENS=true` writes the counted tokens of each file, in order and one per line, to "tokens/<file>.txt". Only the first `MAX_DUMP_TOKENS` tokens are written.
+	if envBool("DUMP_TOKENS") {
+		opts.dumpTokens = max(envInt("MAX_DUMP_TOKENS", 10000), 1)
+	}
+	switch opts.invalidUTF8 {
+	case "":
+		opts.invalidUTF8 = "replace"
+		recordOption("INVALID_UTF8", opts.invalidUTF8)
+	case "replace", "skip", "error":
+	default:
+		log.Fatalf("INVALID_UTF8: unknown mode %q", opts.invalidUTF8)
+	}
+	if opts.transliterate && transliterate == nil {
+		log.Fatal("TRANSLITERATE needs a build with -tags xtext")
+	}
+	switch opts.blankLines {
+	case "", "empty", "whitespace":
+	default:
+		log.Fatalf("BLANK_LINES: unknown mode %q", opts.blankLines)
+	}
+
+    // With `COUNT_SENTENCES=true`, the results also include the number of sentences per file and the average number of words per sentence. A period after one of the `ABBREVIATIONS` does not end a sentence.
+	if envBool("COUNT_SENTENCES") {
+		opts.abbreviations = map[string]bool{}
+		abbrevs := defaultAbbreviations
+		if list, ok := lookupOption("ABBREVIATIONS"); ok {
+			abbrevs = list
+		}
+		recordOption("ABBREVIATIONS", abbrevs)
+		for _, a := range strings.Split(abbrevs, ",") {
+			if a = strings.ToLower(strings.TrimSpace(a)); a != "" {
+				opts.abbreviations[a] = true
+			}
+		}
+        // `SENTENCE_PUNCT` replaces the characters that end a sentence. The default covers Latin, Chinese and Japanese, Armenian, Arabic, Urdu, Devanagari, and Ethiopic text. As scripts like Chinese don't put spaces between sentences, the characters other than ASCII also end a sentence within a word.
+		opts.sentencePunct = defaultSentencePunct
+		if punct, ok := lookupOption("SENTENCE_PUNCT"); ok {
+			opts.sentencePunct = punct
+		}
+		recordOption("SENTENCE_PUNCT", opts.sentencePunct)
+	}
+
+    // Optionally, only lines that match the regular expression in `FILTER_LINES` contribute to the count, like `grep ... | wc -w` would do. This way, we can count the words in, say, ERROR-level log lines only. The line metrics, such as `LONGEST_LINE` and `BLANK_LINES`, cover the matching lines only, too, while line numbers still count all lines of the file.
+	if expr := envString("FILTER_LINES"); expr != "" {
+		var err error
+		opts.filter, err = regexp.Compile(expr)
+		if err != nil {
+			log.Fatalf("FILTER_LINES: %s", err)
+		}
+	}
+
+    // Power users can define what a word is with `WORD_REGEX`, like `[A-Za-z']+`. Every match counts as a word, whatever is in between. A pattern that matches the empty string would find a "word" at every position, so it is rejected.
+	if expr := envString("WORD_REGEX"); expr != "" {
+		var err error
+		opts.wordRegex, err = regexp.Compile(expr)
+		if err != nil {
+			log.Fatalf("WORD_REGEX: %s", err)
+		}
+		if opts.wordRegex.MatchString("") {
+			log.Fatalf("WORD_REGEX: %q matches the empty string", expr)
+		}
+	}
+
+    // For dialogue or annotations, `WITHIN_DELIMITERS` counts only the words between a pair of delimiters, given as the opening and the closing character, like `""` for quoted speech or `[]` for brackets. Different delimiters may be nested. A segment that is still open at the end of the file counts up to there; a closing delimiter without an opening one is ignored. As segments may span lines, files are not split in this mode.
+	if d := envString("WITHIN_DELIMITERS"); d != "" {
+		runes := []rune(d)
+		if len(runes) != 2 {
+			log.Fatalf("WITHIN_DELIMITERS: %q is not a pair of characters", d)
+		}
+		opts.within = &delimiters{open: runes[0], close: runes[1]}
+	}
+
+    // If an upstream step has tokenized the text already, `PRE_TOKENIZED=true` takes each non-empty line as exactly one token, even if it contains spaces.
+	opts.preTokenized = envBool("PRE_TOKENIZED")
+	if opts.preTokenized && opts.wordRegex != nil {
+		log.Fatal("PRE_TOKENIZED and WORD_REGEX exclude each other")
+	}
+
+    // For semi-structured data like logs, `GROUP_FIELD_REGEX` extracts a key from each line through its first capture group, like `^(\w+),` for the first CSV column. The words of each line are added up per key in "by_key.json". Lines without a match go to the key "other".
+	if expr := envString("GROUP_FIELD_REGEX"); expr != "" {
+		var err error
+		opts.groupField, err = regexp.Compile(expr)
+		if err != nil {
+			log.Fatalf("GROUP_FIELD_REGEX: %s", err)
+		}
+		if opts.groupField.NumSubexp() < 1 {
+			log.Fatalf("GROUP_FIELD_REGEX: %q has no capture group", expr)
+		}
+	}
+
+    // To monitor several keywords in one pass, `MATCH_TERMS` lists terms separated by commas, and `MATCH_TERMS_FILE` names a file with one term per line. "term_counts.json" then lists how often each term occurs in each file.
+	terms := envString("MATCH_TERMS")
+	if file := envString("MATCH_TERMS_FILE"); file != "" {
+		recordInput(file)
+		list, err := os.ReadFile(file)
+		if err != nil {
+			log.Fatalf("MATCH_TERMS_FILE: %s", err)
+		}
+		terms += "\n" + string(list)
+	}
+	for _, t := range strings.FieldsFunc(terms, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if t = strings.TrimSpace(t); t != "" {
+			if opts.terms == nil {
+				opts.terms = map[string]bool{}
+			}
+			opts.terms[t] = true
+		}
+	}
+    // `COUNT_LINES_MATCHING=true` counts the lines that contain each term instead of its occurrences, like `grep -c` would do. A line with the term twice counts once.
+	opts.termLines = opts.terms != nil && envBool("COUNT_LINES_MATCHING")
+
+    // For content policy checks, `DENY_LIST` and `ALLOW_LIST` name files in `/inputs` with banned and required words, separated by white space. "compliance.json" then lists for each file how often each banned word occurs and which required words are missing. A file passes if it has no banned words and all required ones. Words are matched like the `MATCH_TERMS`, but ignoring case.
+	var err error
+	if opts.denyWords, err = readWordList(envString("DENY_LIST"), inputDir); err != nil {
+		log.Fatalf("DENY_LIST: %s", err)
+	}
+	if opts.allowWords, err = readWordList(envString("ALLOW_LIST"), inputDir); err != nil {
+		log.Fatalf("ALLOW_LIST: %s", err)
+	}
+	compliance := opts.denyWords != nil || opts.allowWords != nil
+
+    // To keep a running frequency table across many jobs, `FREQ_STORE` names the "freq_store.json" of a previous job, relative to `/inputs`. The job adds the frequencies of its own files and writes the result to a new "freq_store.json", which the next job takes as its input. As adding up counts is associative, it does not matter how the files are split into batches. If the store does not exist yet, the job starts a new one. The store is held in memory.
+	freqStore := envString("FREQ_STORE")
+	if freqStore != "" {
+		if !filepath.IsAbs(freqStore) {
+			freqStore = filepath.Join(inputDir, freqStore)
+		}
+		recordInput(freqStore)
+	}
+
+    // `PIPELINE` applies preprocessing steps to every word, in the given order, such as `lowercase,strip-punct,stopwords,stem`. See `preprocessors` for the available steps. `STOPWORDS_FILE` replaces the built-in English stop words by a list with one word per line.
+	if spec := envString("PIPELINE"); spec != "" {
+		stopwords := defaultStopwords
+		if file := envString("STOPWORDS_FILE"); file != "" {
+			recordInput(file)
+			list, err := os.ReadFile(file)
+			if err != nil {
+				log.Fatalf("STOPWORDS_FILE: %s", err)
+			}
+			stopwords = string(list)
+		}
+		var err error
+		opts.pipeline, err = parsePipeline(spec, wordSet(stopwords))
+		if err != nil {
+			log.Fatalf("PIPELINE: %s", err)
+		}
+	}
+
+    // For log files, `TIMESTAMP_REGEX` extracts a timestamp from each line through its first capture group, like `^(\S+)`. The results then include the earliest and the latest timestamp of each file. `TIMESTAMP_LAYOUT` sets the format in Go's reference time notation; by default, a few common formats are tried. Lines without a parseable timestamp are ignored.
+	if expr := envString("TIMESTAMP_REGEX"); expr != "" {
+		var err error
+		opts.timestamp, err = regexp.Compile(expr)
+		if err != nil {
+			log.Fatalf("TIMESTAMP_REGEX: %s", err)
+		}
+		if opts.timestamp.NumSubexp() < 1 {
+			log.Fatalf("TIMESTAMP_REGEX: %q has no capture group", expr)
+		}
+		opts.timeLayouts = defaultTimeLayouts
+		if layout := envString("TIMESTAMP_LAYOUT"); layout != "" {
+			opts.timeLayouts = []string{layout}
+		}
+	}
+
+    // For documentation, `EXCLUDE_CODE_BLOCKS=true` makes the "markdown" handler remove fenced and indented code blocks, so that only the prose counts. `INLINE_CODE` decides about code spans within the text: `keep` them as they are (the default), `unwrap` them from their backticks, or `strip` them entirely. Files ending in ".md" or ".markdown" that `FILE_HANDLERS` does not map have their code removed, too, but keep their other Markdown syntax.
+	excludeCode := envBool("EXCLUDE_CODE_BLOCKS")
+	var inline string
+	if excludeCode {
+		inline = envString("INLINE_CODE")
+		switch inline {
+		case "", "keep", "unwrap", "strip":
+		default:
+			log.Fatalf("INLINE_CODE: unknown mode %q", inline)
+		}
+		fileHandlers["markdown"] = func(data []byte) ([]byte, error) {
+			return stripMarkdown(stripCode(data, inline))
+		}
+	}
+
+    // Mixed directories need different preprocessing per file type. `FILE_HANDLERS` maps file extensions to handlers, like `.md=markdown,.htm=html`. The entry `defaults` adds the built-in mapping. Files with other extensions are counted as plain text.
+	if spec := envString("FILE_HANDLERS"); spec != "" {
+		var err error
+		opts.handlers, err = parseHandlers(spec)
+		if err != nil {
+			log.Fatalf("FILE_HANDLERS: %s", err)
+		}
+	}
+	if excludeCode {
+		for _, ext := range []string{".md", ".markdown"} {
+			if _, ok := opts.handlers[ext]; ok {
+				continue
+			}
+			if opts.handlers == nil {
+				opts.handlers = map[string]fileHandler{}
+			}
+			opts.handlers[ext] = func(data []byte) ([]byte, error) {
+				return stripCode(data, inline), nil
+			}
+		}
+	}
+
+    // For growing files like logs, `DIFF_MODE=true` counts only what is new: The input directory then has the subdirectories "old" and "new" with two versions of the same files, and only the words in lines that were added or changed in the new version count. Files are listed from "new"; a file without an old version is new altogether.
+	var oldDir string
+	if envBool("DIFF_MODE") {
+		oldDir = filepath.Join(inputDir, "old")
+		inputDir = filepath.Join(inputDir, "new")
+	}
+
+    // To chain jobs without intermediate files, as in `map-job | reduce-job`, `REDUCE_STDIN=true` reads the per-file results of other jobs from `stdin` instead of counting files. Each line is a JSON object like those that `STDOUT_FORMAT=ndjson` prints or that "count.ndjson.gz" contains. The job adds them up and prints the totals to `stdout` as a single line of JSON, like `STDOUT_FORMAT=json` does. Only the totals are kept in memory, so there may be any number of records.
+	if envBool("REDUCE_STDIN") {
+		summary, err := reduceStream(os.Stdin)
+		if err != nil {
+			log.Fatalf("REDUCE_STDIN: %s", err)
+		}
+		summary.Prefix = envString("STDOUT_PREFIX")
+		data, err := json.Marshal(summary)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s\n", data)
+		return
+	}
 
     // Get all files in `/inputs`. For simplicity, let's assume all of them are plain text files.
-	entries, err := dir.Readdirnames(-1)
-	if err != nil {
-		log.Fatal(err)
+    // Alternatively, `FILE_LIST` names a file (produced by an upstream job, for example) that lists the paths to process, one per line and relative to `/inputs`. Then exactly these files are counted, in this order.
+    // For quick tests without mounted data, `URL_LIST` names a file with one URL per line. Each document is downloaded and counted like a file, under its URL. Documents that fail to download within `URL_TIMEOUT` seconds or that don't return "200 OK" are skipped, with the HTTP status or the kind of error, but never the URL, as the reason. The job needs network access for this.
+    // Or, `MANIFEST` names a CSV file with one row per file. Column `MANIFEST_PATH_COLUMN` holds the path and column `MANIFEST_LABEL_COLUMN` a group label (counting from 0). The word counts are added up per label in "by_label.json". `MANIFEST_HEADER=true` skips the first row.
+	var entries, labels []string
+	var fetcher *urlFetcher
+	dirs := map[string]bool{}
+	if list := envString("FILE_LIST"); list != "" {
+		if !filepath.IsAbs(list) {
+			list = filepath.Join(inputDir, list)
+		}
+		recordInput(list)
+		var err error
+		entries, err = readFileList(list)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if envBool("PATHS_FROM_STDIN") {
+        // `PATHS_FROM_STDIN=true` reads the list from `stdin` instead, as in `find /inputs -name '*.txt' | ...`. Absolute paths are taken relative to `/inputs`.
+		var err error
+		entries, err = readPaths(os.Stdin)
+		if err != nil {
+			log.Fatalf("PATHS_FROM_STDIN: %s", err)
+		}
+		for i, p := range entries {
+			if filepath.IsAbs(p) {
+				if rel, err := filepath.Rel(inputDir, p); err == nil {
+					entries[i] = rel
+				}
+			}
+		}
+	} else if list := envString("URL_LIST"); list != "" {
+		if !filepath.IsAbs(list) {
+			list = filepath.Join(inputDir, list)
+		}
+		var err error
+		entries, err = readURLList(list)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fetcher, err = newURLFetcher(time.Duration(envInt("URL_TIMEOUT", 30)) * time.Second)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if manifest := envString("MANIFEST"); manifest != "" {
+		if !filepath.IsAbs(manifest) {
+			manifest = filepath.Join(inputDir, manifest)
+		}
+		recordInput(manifest)
+		var err error
+		entries, labels, err = readManifest(manifest, envInt("MANIFEST_PATH_COLUMN", 0), envInt("MANIFEST_LABEL_COLUMN", 1), envBool("MANIFEST_HEADER"))
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+        // `os.ReadDir` sorts the entries by name, which makes the results reproducible.
+		list, err := os.ReadDir(inputDir)
+		if err != nil {
+            // Here, we make use of the fact that Bacalhau collects `stderr` output as well.
+			log.Fatal(err)
+		}
+		for _, e := range list {
+			entries = append(entries, e.Name())
+			dirs[e.Name()] = e.IsDir()
+		}
+	}
+    // A `.wordcountignore` file in `/inputs` excludes files like a `.gitignore` file does, which is handy for mounted repositories. Each line is a pattern with `*`, `?`, `[...]`, and `**` for any number of directories. A pattern with a slash is relative to `/inputs`, otherwise it matches a name at any level. A trailing slash matches directories only, and a leading `!` includes files again, unless a parent directory is excluded. Blank lines and lines starting with `#` are ignored. The ignore file itself is never counted, and neither are the other files that configure the job, like word lists or the `FREQ_STORE`, if they are in `/inputs`.
+	if fetcher == nil {
+		ignore, err := readIgnoreFile(filepath.Join(inputDir, ignoreFileName))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if ignore != nil || len(auxiliaryInputs) > 0 {
+			kept := entries[:0]
+			var keptLabels []string
+			for i, e := range entries {
+				if e == ignoreFileName || ignore.ignored(filepath.ToSlash(e), dirs[e]) || auxiliaryInputs[filepath.Join(inputDir, e)] {
+					continue
+				}
+				kept = append(kept, e)
+				if labels != nil {
+					keptLabels = append(keptLabels, labels[i])
+				}
+			}
+			entries, labels = kept, keptLabels
+		}
 	}
-	if len(entries) == 0 {
+
+    // No files at all is usually a mistake in the job spec. Where it is not, `ALLOW_EMPTY=true` writes the usual outputs with zero counts instead, so that collectors still find well-formed files.
+	if len(entries) == 0 && !envBool("ALLOW_EMPTY") {
 		log.Fatal("No files found")
 	}
 
-    // Write the results to "count.txt".
-	out, err := os.Create(filepath.Join(outputDir, "count.txt"))
+    // `PROCESS_ORDER` sets the order in which the files are counted, and thus listed in the results: by "name", "size", or modification time ("mtime"). `PROCESS_ORDER_DESC=true` reverses it. Ties are ordered by name, so that the order is deterministic. Without `PROCESS_ORDER`, the files are counted by name, or in the order of the file list.
+	order := envString("PROCESS_ORDER")
+	if order != "" {
+		switch order {
+		case "name", "size", "mtime":
+		default:
+			log.Fatalf("PROCESS_ORDER: unknown key %q", order)
+		}
+		if fetcher != nil {
+			log.Fatal("PROCESS_ORDER does not work with URL_LIST")
+		}
+		var err error
+		entries, labels, err = orderEntries(inputDir, entries, labels, order, envBool("PROCESS_ORDER_DESC"))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+    // All output files are created through `outputs`, except for the files that are read while the job is still running, like the stream of `STREAM_NDJSON` and the progress of `PROGRESS`. With `BUNDLE_OUTPUT=true`, they end up in a single `results.tar.gz` rather than as loose files, which makes collecting them with `bacalhau get` simpler.
+	outputs := &outputFiles{dir: outputDir, bundle: envBool("BUNDLE_OUTPUT")}
+
+    // `OUTPUT_LAYOUT` selects where the files go within the output directory. `flat`, the default, puts them all at the top. `details` puts them into a "details" subdirectory, and adds the summary line as "SUMMARY" at the top, for collection scripts that expect this structure.
+	switch layout := envString("OUTPUT_LAYOUT"); layout {
+	case "", "flat":
+	case "details":
+		outputs.details = true
+	default:
+		log.Fatalf("OUTPUT_LAYOUT: unknown layout %q", layout)
+	}
+
+    // By default, the per-file results are listed in the order of processing, which is by name. `SORT_BY=words` sorts them by word count instead, and `SORT_BY=name` by name even if `FILE_LIST` says otherwise. `SORT_DESC=true` reverses the sort order. Ties are sorted by name, so that the output stays deterministic.
+    // `PROMETHEUS_METRICS=true` also writes the counts in the Prometheus exposition format to "metrics.prom", to be scraped or pushed to a gateway.
+    // For huge numbers of files, `OUTPUT_SHARDS=N` spreads the per-file results over "count-0.json" to "count-<N-1>.json" instead of a single "count.json", so that they can be consumed in parallel.
+	counts := &countOutputs{
+		sortBy:     envString("SORT_BY"),
+		sortDesc:   envBool("SORT_DESC"),
+		prometheus: envBool("PROMETHEUS_METRICS"),
+		shards:     envInt("OUTPUT_SHARDS", 1),
+
+        // For fan-out to further jobs, `SPLIT_OUTPUT=true` writes the result of each file to its own JSON file instead of "count.json": The result for "dir/file.txt" goes to "counts/dir/file.txt.json".
+		perFile: envBool("SPLIT_OUTPUT"),
+
+        // For strict pipelines, `VALIDATE_OUTPUT=true` checks the structure of "count.json" before writing it, and fails the job rather than breaking consumers.
+		validate: envBool("VALIDATE_OUTPUT"),
+	}
+	if counts.sortBy != "" && counts.sortBy != "name" && counts.sortBy != "words" {
+		log.Fatalf("SORT_BY: unknown key %q", counts.sortBy)
+	}
+	if counts.perFile && counts.shards > 1 {
+		log.Fatal("SPLIT_OUTPUT and OUTPUT_SHARDS exclude each other")
+	}
+    // `FLAG_OUTLIERS=true` lists files with unusual word counts in "outliers.json", for review. With `OUTLIER_METHOD=stddev` (the default), these are the files more than `OUTLIER_STDDEVS` standard deviations (3 by default) away from the mean. With `OUTLIER_METHOD=percentile`, they are the files outside the `OUTLIER_PERCENTILES` range (`5,95` by default).
+	if envBool("FLAG_OUTLIERS") {
+		counts.outliers = &outlierRule{method: envString("OUTLIER_METHOD"), stddevs: envFloat("OUTLIER_STDDEVS", 3), low: 5, high: 95}
+		switch counts.outliers.method {
+		case "":
+			counts.outliers.method = "stddev"
+		case "stddev", "percentile":
+		default:
+			log.Fatalf("OUTLIER_METHOD: unknown method %q", counts.outliers.method)
+		}
+		if p := envString("OUTLIER_PERCENTILES"); p != "" {
+			_, err := fmt.Sscanf(p, "%g,%g", &counts.outliers.low, &counts.outliers.high)
+			if err != nil || counts.outliers.low < 0 || counts.outliers.low > counts.outliers.high || counts.outliers.high > 100 {
+				log.Fatalf("OUTLIER_PERCENTILES: %q is not a range like 5,95", p)
+			}
+		}
+	}
+    // `OUTPUT_FORMAT` is a comma-separated list of extra formats for the counts, for loading them directly into analytics tools. Some formats are only available in builds with the respective tag.
+	for _, format := range strings.Split(envString("OUTPUT_FORMAT"), ",") {
+		format = strings.TrimSpace(format)
+		if format == "" {
+			continue
+		}
+		if countWriters[format] == nil {
+			log.Fatalf("OUTPUT_FORMAT: unknown format %q (build with -tags %[1]s?)", format)
+		}
+		counts.formats = append(counts.formats, format)
+	}
+
+    // When the `stdout` of many jobs is concatenated, `STDOUT_PREFIX` tells which line came from which job. `STDOUT_NUMERIC_ONLY=true` prints the bare number, for easy parsing. `STDOUT_TEMPLATE` sets any other text, as a Go template with the fields `.Total`, `.Files`, `.Bytes`, and `.Skipped`; the default is `Total word count:  {{.Total}}`. For callers that parse `stdout`, `STDOUT_FORMAT=json` prints a single line of JSON with the total, the number of files, the bytes, and the number of skipped files instead, and the prefix, if any, as "prefix". To feed a streaming reduce (see `REDUCE_STDIN`), `STDOUT_FORMAT=ndjson` prints the result of each file as one line of JSON, like in "count.ndjson.gz", and no total.
+	stdoutFormat := envString("STDOUT_FORMAT")
+	stdoutTemplate := envString("STDOUT_TEMPLATE")
+	numericOnly := envBool("STDOUT_NUMERIC_ONLY")
+	switch stdoutFormat {
+	case "", "text":
+	case "json", "ndjson":
+		if numericOnly || stdoutTemplate != "" {
+			log.Fatalf("STDOUT_FORMAT=%s does not work with STDOUT_NUMERIC_ONLY or STDOUT_TEMPLATE", stdoutFormat)
+		}
+	default:
+		log.Fatalf("STDOUT_FORMAT: unknown format %q", stdoutFormat)
+	}
+	switch {
+	case numericOnly && stdoutTemplate != "":
+		log.Fatal("STDOUT_NUMERIC_ONLY does not work with STDOUT_TEMPLATE")
+	case numericOnly:
+		stdoutTemplate = "{{.Total}}"
+	case stdoutTemplate == "":
+		stdoutTemplate = "Total word count:  {{.Total}}"
+	}
+	printTotal, err := totalPrinter(envString("STDOUT_PREFIX"), stdoutFormat, stdoutTemplate)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("STDOUT_TEMPLATE: %s", err)
 	}
-	defer out.Close()
 
-    // Besides the word count of each file, we also want to know the overall count. This value is sent to `stdout`. 
-	total := 0
+    // To help tuning the job, `REPORT_MEMORY=true` samples the memory usage every `REPORT_MEMORY_INTERVAL` milliseconds and adds the peak values to the summary. On WASM, some of the values may be zero.
+	var memory *memorySampler
+	if envBool("REPORT_MEMORY") {
+		memory = startMemorySampler(time.Duration(envInt("REPORT_MEMORY_INTERVAL", 100)) * time.Millisecond)
+	}
 
-    // Iterate over all files in `/inputs` and count the words in each file.
-	for _, entry := range entries {
-		f, err := os.Open(filepath.Join(inputDir, entry))
+    // For caching, `FINGERPRINT=true` adds a SHA-256 hash of the effective configuration and the contents of all input files to "count.json" and "summary.txt". Two runs with the same fingerprint count the same, so a cached result can be reused. The fingerprint also covers the version of the job, the modification times of the files where they matter, that is with `INCLUDE_MTIME=true` or `PROCESS_ORDER=mtime`, and the other files that the job reads, like word lists, the old versions of `DIFF_MODE`, or the `FREQ_STORE`, but not the options that only say where to put files, like `CHECKPOINT_FILE`. The files are read once more for this.
+	withFingerprint := envBool("FINGERPRINT")
+
+    // `MIN_FREQUENCY` leaves the words that occur less often out of "frequencies.json". In a large corpus, this drops the long tail of words that occur only once or twice.
+    // `MAX_VOCAB` keeps only this many of the most frequent words in "frequencies.json" and adds up the counts of the rest in a final "<OTHER>" entry, so that the table stays small but still covers all counted words. This includes the words below `MIN_FREQUENCY`. Zero means no limit.
+    // To protect collectors from huge files, `MAX_FREQ_BYTES` limits the size of "frequencies.json". The words that don't fit anymore are added up in a final "<TRUNCATED>" entry, which marks the table as incomplete. The limit must leave room for this entry, which takes about 70 bytes, and smaller limits are an error.
+	freqLimits := tableLimits{
+		minCount: envInt("MIN_FREQUENCY", 1),
+		maxWords: envInt("MAX_VOCAB", 0),
+		maxBytes: envInt64("MAX_FREQ_BYTES", 0),
+	}
+	if least := 1 + truncationReserve(); freqLimits.maxBytes > 0 && freqLimits.maxBytes < least {
+		log.Fatalf("MAX_FREQ_BYTES: %d is too small, the table needs at least %d bytes", freqLimits.maxBytes, least)
+	}
+
+    // When the job runs on many nodes, each node returns its own "count.json". In reduce mode (`REDUCE=true`), the input files are such "count.json" files, and the job merges them into one result. Input files that hold a JSON array are frequency tables, like the "frequencies.json" of `MERGE_FREQUENCIES`; their counts are added up and written to a new "frequencies.json", within the limits above. The files are split among up to `REDUCE_WORKERS` workers, which read and merge them concurrently. The result is the same for any number of workers.
+	if envBool("REDUCE") {
+		merged, freq, err := reduceReports(inputDir, entries, envInt("REDUCE_WORKERS", runtime.NumCPU()))
 		if err != nil {
 			log.Fatal(err)
 		}
-		r := bufio.NewReader(f)
+		if freq != nil {
+            // An in-memory table needs no spill.
+			if err := (*freqSpill)(nil).writeTable(outputs, "frequencies.json", freq, freqLimits); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if withFingerprint {
+			if merged.Fingerprint, err = fingerprint(inputDir, entries, false); err != nil {
+				log.Fatal(err)
+			}
+		}
+		merged.Memory = memory.stop()
+		if err := counts.write(outputs, merged); err != nil {
+			log.Fatal(err)
+		}
+		if err := writeJSON(outputs, "config_effective.json", effectiveConfig); err != nil {
+			log.Fatal(err)
+		}
+		if err := outputs.close(); err != nil {
+			log.Fatal(err)
+		}
+		printTotal(merged)
+		return
+	}
 
-		words, err := countWords(r)
-		f.Close()
+    // Besides the word count of each file, we also want to know the overall count. This value is sent to `stdout`. 
+    // Empty lists are written as `[]` rather than `null`, so that readers get a valid document even if no file was counted.
+	results := &report{SchemaVersion: reportSchemaVersion, Version: version, Files: []fileCount{}}
+
+    // For a quick visual in the collected `stdout`, `ASCII_CHART=true` adds a bar chart of the `TOP_N` most frequent words. This requires tracking the frequency of every word.
+	chart := envBool("ASCII_CHART")
+	topN := envInt("TOP_N", 10)
+	if chart && (stdoutFormat == "json" || stdoutFormat == "ndjson") {
+		log.Fatalf("ASCII_CHART does not work with STDOUT_FORMAT=%s", stdoutFormat)
+	}
+	var freq map[string]int
+	if chart {
+		freq = map[string]int{}
+	}
+
+    // To feed a word cloud renderer, `WORDCLOUD=global` or `WORDCLOUD=file` writes the `WORDCLOUD_SIZE` most frequent words of all files, or of each file, to "wordcloud.json". Each word has a weight between 0 and 1, relative to the most frequent word.
+	cloudMode := envString("WORDCLOUD")
+	cloudSize := envInt("WORDCLOUD_SIZE", 50)
+	cloud := &wordCloud{}
+	switch cloudMode {
+	case "":
+	case "global":
+		if freq == nil {
+			freq = map[string]int{}
+		}
+	case "file":
+		cloud.Files = []fileCloud{}
+	default:
+		log.Fatalf("WORDCLOUD: unknown mode %q", cloudMode)
+	}
+
+    // The vocabulary of a huge corpus may not fit into memory. With `FREQ_MEMORY_LIMIT`, the frequencies of all files are written to temporary files in `FREQ_SPILL_DIR` whenever there are more than this many different words after a file, and merged at the end. This is slower but bounds the memory.
+	var spill *freqSpill
+	if limit := envInt("FREQ_MEMORY_LIMIT", 0); limit > 0 {
+		spill = &freqSpill{limit: limit, dir: envString("FREQ_SPILL_DIR")}
+	}
+
+    // For corpus-level analysis, `MERGE_FREQUENCIES=true` writes the frequency of every word across all files to "frequencies.json", most frequent first. File boundaries don't matter here, so no per-file frequencies are kept, which rules out `WORDCLOUD=file`.
+	mergeFreq := envBool("MERGE_FREQUENCIES")
+	if mergeFreq {
+		if cloudMode == "file" {
+			log.Fatal("MERGE_FREQUENCIES does not work with WORDCLOUD=file")
+		}
+		if freq == nil {
+			freq = map[string]int{}
+		}
+	}
+    // The `FREQ_STORE` needs all frequencies.
+	if freqStore != "" && freq == nil {
+		freq = map[string]int{}
+	}
+
+    // The counts of the `MATCH_TERMS` are collected per file.
+	termCounts := []fileTerms{}
+
+    // For social media posts, `COUNT_SOCIAL=true` counts the hashtags ("#topic") and mentions ("@name") in each file and writes them to "social.json". Tags consist of letters of any script, digits, and underscores, with at least one letter. They are found in the words as they appear in the text, before any filters. `SOCIAL_LIST=true` also lists each tag with its count.
+	countSocial := envBool("COUNT_SOCIAL")
+
+    // For a quick profile of the text structure, `TOKEN_SHAPES=true` adds the number of tokens of each shape to the results of each file. See `tokenShape` for the shapes. Like hashtags, shapes are taken from the words as they appear in the text.
+	tokenShapes := envBool("TOKEN_SHAPES")
+
+    // To find unexpected scripts or characters that a font must cover, `COUNT_ALPHABET=true` adds the number of distinct characters of each file and of all files together to the results. Whitespace does not count, and bytes that are not valid UTF-8 count as U+FFFD. `ALPHABET_LIST=N` also lists up to N of the characters, in the order of their code points.
+	var alphabet map[rune]bool
+	if envBool("COUNT_ALPHABET") {
+		alphabet = map[rune]bool{}
+	}
+	alphabetList := envInt("ALPHABET_LIST", 0)
+	socialList := envBool("SOCIAL_LIST")
+	social := []fileSocial{}
+
+	complianceResults := []fileCompliance{}
+
+    // For freshness tracking, `INCLUDE_MTIME=true` adds the modification time of each file to the results. File systems that don't keep one report the zero time, which is left out.
+	includeMtime := envBool("INCLUDE_MTIME")
+
+    // To compare the density of files of different sizes, `WORDS_PER_KB=true` adds the number of words per kilobyte (1024 bytes) of each file to the results. Empty files have no density and leave it out.
+	wordsPerKB := envBool("WORDS_PER_KB")
+
+    // `TOP_WORD=true` adds the most frequent word of each file, and its count, to the results, as a quick hint at the topic. Ties go to the word that comes first alphabetically. The word is counted after all filters and transformations, such as `PIPELINE`.
+	topWord := envBool("TOP_WORD")
+
+    // As a compact measure of vocabulary diversity, `COMPUTE_ENTROPY=true` adds the Shannon entropy of the word frequencies, in bits, for each file and for all files together.
+	computeEntropy := envBool("COMPUTE_ENTROPY")
+	perFileFreq := cloudMode == "file" || topWord || computeEntropy
+	if computeEntropy && freq == nil {
+		freq = map[string]int{}
+	}
+
+    // The group totals of `GROUP_FIELD_REGEX` are collected across all files.
+	var byKey map[string]int
+	if opts.groupField != nil {
+		byKey = map[string]int{}
+	}
+    // `GROUP_TOP_WORDS=true` also lists the `TOP_N` most frequent words of each group in "by_key_top_words.json", as a summary of what each group is about.
+	var byKeyFreq map[string]map[string]int
+	if opts.groupField != nil && envBool("GROUP_TOP_WORDS") {
+		byKeyFreq = map[string]map[string]int{}
+	}
+
+    // For a quick breakdown by file type, `BY_EXTENSION=true` adds up the words per lowercase file extension in "by_extension.json". Files without an extension go to "(none)".
+	var byExt map[string]int
+	if envBool("BY_EXTENSION") {
+		byExt = map[string]int{}
+	}
+
+    // `DETECT_LANGUAGE=true` tags each file with its most likely language in "languages.json". Files where no language scores at least `LANGUAGE_THRESHOLD` are tagged "unknown".
+	detectLang := envBool("DETECT_LANGUAGE")
+	langThreshold := envFloat("LANGUAGE_THRESHOLD", 0.15)
+	var profiles map[string]map[string]int
+	languages := []fileLanguage{}
+	if detectLang {
+		profiles = languageProfiles()
+	}
+
+    // For log pipelines, `STREAM_NDJSON=true` writes each per-file result as soon as it is known, as one line of JSON, to the gzip-compressed "count.ndjson.gz" in the output directory. The stream is flushed at most every `STREAM_FLUSH_INTERVAL` milliseconds, so that a consumer following the file can decompress all results up to the last flush while the job is still running. For this reason, the stream can't wait for the bundle: It follows `OUTPUT_LAYOUT`, but stays a plain file with `BUNDLE_OUTPUT`.
+	var stream *recordStream
+	if envBool("STREAM_NDJSON") {
+		path, err := outputs.filePath("count.ndjson.gz")
+		if err == nil {
+			stream, err = newRecordStream(path, time.Duration(envInt("STREAM_FLUSH_INTERVAL", 1000))*time.Millisecond)
+		}
 		if err != nil {
 			log.Fatal(err)
 		}
-		total += words
+	}
+
+    // Skipped files are recorded along with the reason. With `INCLUDE_ZERO=true`, they also appear in the per-file results, with zero words and marked as skipped, so that downstream joins don't lose any rows.
+	includeZero := envBool("INCLUDE_ZERO")
+	skip := func(name, reason string) {
+		warn(name, "skipped: %s", reason)
+		results.Skipped = append(results.Skipped, skippedFile{Name: name, Reason: reason})
+		if includeZero {
+			results.Files = append(results.Files, fileCount{Name: name, Skipped: true})
+			if err := stream.write(results.Files[len(results.Files)-1]); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
 
-        // File-specific counts go to counts.txt
-		fmt.Fprintf(out, "%s has %d words\n", entry, words)
+    // `EMPTY_FILE` decides about files of zero bytes, which otherwise look like files without any words: `include` lists them like any other file (the default), `flag` marks them as empty in the results, and `skip` skips them.
+	emptyFile := envString("EMPTY_FILE")
+	switch emptyFile {
+	case "", "include", "flag", "skip":
+	default:
+		log.Fatalf("EMPTY_FILE: unknown mode %q", emptyFile)
 	}
 
-    // The total count goes to `stdout`.
-	fmt.Println("Total word count: ", total)
+    // For encoded payloads, `DECODE=base64` or `DECODE=hex` decodes the content of each file before counting. White space between the encoded characters is ignored, and base64 may use the standard or the URL alphabet, with or without padding. `DECODE_ERRORS` decides about files that fail to decode: `raw` counts them as they are, with a warning (the default), and `skip` skips them.
+	decoding := envString("DECODE")
+	decodeErrors := ""
+	switch decoding {
+	case "":
+	case "base64", "hex":
+		decodeErrors = envString("DECODE_ERRORS")
+		switch decodeErrors {
+		case "":
+			decodeErrors = "raw"
+			recordOption("DECODE_ERRORS", decodeErrors)
+		case "raw", "skip":
+		default:
+			log.Fatalf("DECODE_ERRORS: unknown policy %q", decodeErrors)
+		}
+	default:
+		log.Fatalf("DECODE: unknown encoding %q", decoding)
+	}
 
-// `countWords` scans words from an input stream and counts them. The algorithm is simple and counts everything, including comment symbols, markdown heading markers, etc.
-func countWords(r *bufio.Reader) (int, error) {
-	scanner := bufio.NewScanner(r)
-	scanner.Split(bufio.ScanWords)
+    // `MIN_FILE_BYTES` and `MAX_FILE_BYTES` skip files outside a size range, to avoid wasting time on huge files or to target only large ones. Zero means no limit.
+	minBytes := envInt64("MIN_FILE_BYTES", 0)
+	maxBytes := envInt64("MAX_FILE_BYTES", 0)
 
-	wordCount := 0
-	for scanner.Scan() {
-		wordCount++
+    // To share a single huge file among several jobs, `RANGE_START` and `RANGE_END` have each job count only the bytes from one offset up to, but not including, another. Zero for `RANGE_END` means the end of the file. Like the chunks of `SPLIT_LARGE_FILES`, a range is extended to whole lines: It counts the lines that start within the range, including the rest of its last line, and no line that started before. So, adjacent ranges like `0`–`1000000` and `1000000`–`0` add up to the count of the whole file, with no word counted twice. The results list the bytes of the lines counted. The range applies to each input file. It does not work with `FILE_HANDLERS`, `DIFF_MODE`, or `DECODE`, which need whole files.
+	rangeStart := envInt64("RANGE_START", 0)
+	rangeEnd := envInt64("RANGE_END", 0)
+	ranged := rangeStart != 0 || rangeEnd != 0
+	switch {
+	case rangeStart < 0 || rangeEnd < 0 || rangeEnd != 0 && rangeEnd <= rangeStart:
+		log.Fatalf("RANGE_START, RANGE_END: %d–%d is not a byte range", rangeStart, rangeEnd)
+	case ranged && (opts.handlers != nil || oldDir != "" || decoding != ""):
+		log.Fatal("RANGE_START and RANGE_END do not work with FILE_HANDLERS, DIFF_MODE, or DECODE")
 	}
 
-	if err := scanner.Err(); err != nil {
-        // EOF is expected in this context. 
-		if err == io.EOF {
-			return wordCount, nil
+    // A single huge file would keep one worker busy while all others are done. With `SPLIT_LARGE_FILES=true`, files of at least `SPLIT_MIN_BYTES` are split into chunks that are counted in parallel by `SPLIT_WORKERS` goroutines.
+    // Sentences may span chunk boundaries, so counting sentences rules out splitting, and so do `LONGEST_LINE`, `BLANK_LINES`, `DIFF_MODE`, `DECODE`, and byte ranges.
+	split := envBool("SPLIT_LARGE_FILES") && opts.abbreviations == nil && !opts.longestLine && opts.blankLines == "" && opts.within == nil && oldDir == "" && decoding == "" && !ranged
+	splitMin := envInt64("SPLIT_MIN_BYTES", 64<<20)
+	splitWorkers := envInt("SPLIT_WORKERS", runtime.NumCPU())
+
+    // To spot incident spikes in logs, `BURST_WINDOW` (a duration like `5m`) finds the time window of this length with the most words, across all files, and writes it to "burst.json". This needs `TIMESTAMP_REGEX`. The lines need not be in time order, as they are sorted by time first.
+	var burstWindow time.Duration
+	var timeline []timedWords
+	if w := envString("BURST_WINDOW"); w != "" {
+		var err error
+		burstWindow, err = time.ParseDuration(w)
+		if err != nil || burstWindow <= 0 {
+			log.Fatalf("BURST_WINDOW: %q is not a positive duration", w)
 		}
-        // Else return an error.
-		return wordCount, fmt.Errorf("countWords: %w", err)
+		if opts.timestamp == nil {
+			log.Fatal("BURST_WINDOW needs TIMESTAMP_REGEX")
+		}
+		timeline = []timedWords{}
 	}
 
-	return wordCount, nil
-}
+    // `JSON_RECORDS=true` additionally counts the elements of the top-level array in each ".json" file as records. The file is streamed token by token, so even huge arrays need not fit into memory.
+	jsonRecords := envBool("JSON_RECORDS")
+
+    // `READ_STRATEGY` tunes how files are read, as storage backends differ. "scanner", the default, streams each file through a small buffer. "buffered" uses a large buffer, which suits storage with a high latency per read. "mmap" maps the file into memory where the platform supports it, and falls back to "buffered" elsewhere. Split files are always read in chunks.
+	readStrategy := envString("READ_STRATEGY")
+	switch readStrategy {
+	case "", "scanner", "buffered":
+	case "mmap":
+		if mmapFile == nil {
+			warn("", "READ_STRATEGY: mmap is not supported on this platform, using buffered reads")
+			readStrategy = "buffered"
+			recordOption("READ_STRATEGY", readStrategy)
+		}
+	default:
+		log.Fatalf("READ_STRATEGY: unknown strategy %q", readStrategy)
+	}
+
+    // `VOCAB_GROWTH=true` records how the number of unique words grows as more and more words are read, sampled every `VOCAB_GROWTH_INTERVAL` words. The curve goes to "vocab_growth.json". Because the words must be seen in order, large files are not split in this mode.
+	var growth *vocabGrowth
+	if envBool("VOCAB_GROWTH") {
+		growth = &vocabGrowth{
+			interval: max(envInt("VOCAB_GROWTH_INTERVAL", 1000), 1),
+			seen:     map[string]struct{}{},
+		}
+		split = false
+	}
+
+    // In delimited data, often only some columns contain prose. `TEXT_COLUMNS` lists the indices of these columns, counting from 0, and only their fields are counted. `TEXT_DELIMITER` is the field delimiter, a comma by default; use `tab` for TSV. `TEXT_HEADER=true` skips the first row. Quoted fields may contain line breaks, so files are not split in this mode.
+	var columns *columnSpec
+	if list := envString("TEXT_COLUMNS"); list != "" {
+		var err error
+		columns, err = parseColumnSpec(list, envString("TEXT_DELIMITER"), envBool("TEXT_HEADER"))
+		if err != nil {
+			log.Fatalf("TEXT_COLUMNS: %s", err)
+		}
+		split = false
+	}
+
+    // For privacy-sensitive data, `HASH_FILENAMES=true` replaces file names in all outputs by their SHA-256 hash, optionally salted with `HASH_SALT`. If `HASH_MAPPING` names a file outside the output directory, the mapping from hashes to names is written there, for local use only. A mapping within the output directory would reveal the names, so this is an error.
+	names := &nameHasher{
+		enabled: envBool("HASH_FILENAMES"),
+		salt:    envString("HASH_SALT"),
+		mapping: map[string]string{},
+	}
+	hashMapping := envString("HASH_MAPPING")
+	if hashMapping != "" && names.enabled && isWithin(outputDir, hashMapping) {
+		log.Fatalf("HASH_MAPPING: %s is in the output directory %s, where it would reveal the file names", hashMapping, outputDir)
+	}
+
+    // For very large jobs, `CHECKPOINT=true` writes the results of all completed files to `CHECKPOINT_FILE` after every `CHECKPOINT_EVERY` files. By default, this is "checkpoint.json" in the output directory. If the job gets interrupted, a new run with `RESUME=true` and the checkpoint as `CHECKPOINT_FILE` takes over the results from the checkpoint and counts only the remaining files. As each Bacalhau job gets a new output directory, the checkpoint of the interrupted job must be passed in as an input, like `CHECKPOINT_FILE=/inputs/checkpoint.json`. If there is no checkpoint, the job counts all files.
+    // The checkpoint holds the per-file results of "count.json" only, so the result of a resumed job is the same as that of an uninterrupted one only for these. Options that collect data across files, like the word frequencies, or that write other per-file outputs thus rule out resuming.
+	var checkpoint *checkpointer
+	if envBool("CHECKPOINT") {
+		checkpoint = &checkpointer{every: max(envInt("CHECKPOINT_EVERY", 100), 1)}
+	}
+	checkpointFile := envString("CHECKPOINT_FILE")
+	if checkpointFile == "" {
+		checkpointFile = filepath.Join(outputDir, "checkpoint.json")
+		recordOption("CHECKPOINT_FILE", checkpointFile)
+	}
+	done := map[string]fileCount{}
+	if envBool("RESUME") {
+		for _, c := range []struct {
+			on     bool
+			option string
+		}{
+			{freq != nil, "options that need all word frequencies, like MERGE_FREQUENCIES, WORDCLOUD, ASCII_CHART, or FREQ_STORE"},
+			{cloudMode == "file", "WORDCLOUD=file"},
+			{growth != nil, "VOCAB_GROWTH"},
+			{byKey != nil, "GROUP_FIELD_REGEX"},
+			{timeline != nil, "BURST_WINDOW"},
+			{detectLang, "DETECT_LANGUAGE"},
+			{opts.terms != nil, "MATCH_TERMS"},
+			{compliance, "DENY_LIST or ALLOW_LIST"},
+			{countSocial, "COUNT_SOCIAL"},
+			{alphabet != nil, "COUNT_ALPHABET"},
+			{opts.dumpTokens > 0, "DUMP_TOKENS"},
+		} {
+			if c.on {
+				log.Fatalf("RESUME does not work with %s", c.option)
+			}
+		}
+		prev, err := readReport(checkpointFile)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			log.Printf("No checkpoint at %s, counting all files", checkpointFile)
+		case err != nil:
+			log.Fatal(err)
+		default:
+			for _, f := range prev.Files {
+				if !f.Skipped {
+					done[f.Name] = f
+				}
+			}
+			log.Printf("Resuming: %d files already counted", len(done))
+		}
+	}
+
+    // For live monitoring, `PROGRESS=true` rewrites "progress.json" in the output directory at most every `PROGRESS_INTERVAL` milliseconds, with the number of processed files, the total number of files, the percentage, and the elapsed seconds. A watcher can poll this file at any time, as it is replaced atomically. Like the stream of `STREAM_NDJSON`, it follows `OUTPUT_LAYOUT`, but stays a plain file with `BUNDLE_OUTPUT`, so that it can be polled.
+	var progress *progressFile
+	if envBool("PROGRESS") {
+		path, err := outputs.filePath("progress.json")
+		if err != nil {
+			log.Fatal(err)
+		}
+		progress = &progressFile{
+			path:     path,
+			interval: time.Duration(envInt("PROGRESS_INTERVAL", 1000)) * time.Millisecond,
+			start:    time.Now(),
+		}
+	}
+
+    // For a quick smoke test against a huge input, `MAX_FILES` stops after counting that many files. Skipped files don't count towards the limit.
+	maxFiles := envInt("MAX_FILES", 0)
+	counted := 0
+	processed := 0
+
+    // Iterate over all files in `/inputs` and count the words in each file.
+	for i, entry := range entries {
+		processed = i
+		if err := progress.update(processed, len(entries)); err != nil {
+			log.Fatal(err)
+		}
+		if maxFiles > 0 && counted >= maxFiles {
+			warn("", "MAX_FILES limit of %d reached, not processing the remaining files", maxFiles)
+			results.LimitReached = true
+			break
+		}
+		name := names.hash(entry)
+
+		if f, ok := done[name]; ok {
+			results.Total += f.Words
+			results.Numbers += f.Numbers
+			results.Bytes += f.Bytes
+			results.Records += f.Records
+			results.Files = append(results.Files, f)
+			if err := stream.write(f); err != nil {
+				log.Fatal(err)
+			}
+			counted++
+			if byExt != nil {
+				byExt[extensionKey(entry)] += f.Words
+			}
+			continue
+		}
+
+        // Listed files may be missing or point outside of `/inputs`. These are reported and skipped.
+		path := filepath.Join(inputDir, entry)
+		if fetcher != nil {
+			var err error
+			if path, err = fetcher.fetch(entry); err != nil {
+				skip(name, err.Error())
+				continue
+			}
+		} else if !filepath.IsLocal(entry) {
+			skip(name, "outside the input directory")
+			continue
+		}
+		fi, err := os.Stat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			skip(name, "file not found")
+			continue
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if reason := sizeOutOfRange(fi.Size(), minBytes, maxBytes); reason != "" {
+			skip(name, reason)
+			continue
+		}
+		if emptyFile == "skip" && fi.Size() == 0 {
+			skip(name, "empty file")
+			continue
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+        // In strict mode, the file is checked before counting, so that no metric includes a part of an invalid file.
+		if opts.invalidUTF8 == "error" {
+			valid, err := isValidUTF8(f)
+			if err == nil {
+				_, err = f.Seek(0, io.SeekStart)
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+			if !valid {
+				f.Close()
+				skip(name, "invalid UTF-8")
+				continue
+			}
+		}
+
+		records := 0
+		if jsonRecords && strings.EqualFold(filepath.Ext(entry), ".json") {
+			records, err = countRecords(bufio.NewReader(f))
+			if err != nil {
+				log.Fatalf("%s: %v", name, err)
+			}
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		stats := &fileStats{freq: freq, growth: growth, byKey: byKey, keyFreq: byKeyFreq}
+		if opts.terms != nil {
+			stats.terms = map[string]int{}
+			for t := range opts.terms {
+				stats.terms[t] = 0
+			}
+		}
+		if countSocial {
+			stats.hashtags, stats.mentions = map[string]int{}, map[string]int{}
+		}
+		if tokenShapes {
+			stats.shapes = map[string]int{}
+		}
+		if alphabet != nil {
+			stats.alphabet = map[rune]bool{}
+		}
+		if compliance {
+			stats.banned, stats.required = map[string]int{}, map[string]bool{}
+		}
+		if perFileFreq {
+			stats.freq = map[string]int{}
+		}
+		if detectLang {
+			stats.trigrams = map[string]int{}
+		}
+		if timeline != nil {
+			stats.timeline = []timedWords{}
+		}
+		if opts.dumpTokens > 0 {
+			stats.tokens = []string{}
+		}
+		var words int
+		size := fi.Size()
+        // Files that need a handler are transformed as a whole and cannot be split.
+		if split && size >= splitMin && opts.handlers[strings.ToLower(filepath.Ext(entry))] == nil {
+			words, err = countSplit(f, size, splitWorkers, opts, stats)
+		} else {
+			var in io.Reader
+			var release func() error
+			if ranged {
+				in, size, err = fileRange(f, size, rangeStart, rangeEnd)
+			} else {
+				in, release, err = fileReader(f, name, size, readStrategy)
+			}
+			if err == nil && decoding != "" {
+				in, err = decodeContent(in, decoding)
+				if errors.Is(err, errNotEncoded) && decodeErrors == "raw" {
+					warn(name, "%v, counting the raw content", err)
+					err = nil
+				}
+			}
+			if err == nil && oldDir != "" {
+				recordInput(filepath.Join(oldDir, entry))
+				in, err = changedLines(filepath.Join(oldDir, entry), in)
+			}
+			if err == nil && columns != nil {
+				in = columns.text(in)
+			}
+			if err == nil {
+				in, err = preprocess(entry, name, in, opts)
+			}
+			if err == nil {
+				words, err = countWords(bufio.NewReader(in), opts, stats)
+			}
+			if release != nil {
+				if rerr := release(); err == nil {
+					err = rerr
+				}
+			}
+		}
+		f.Close()
+		if errors.Is(err, errNotEncoded) {
+			skip(name, err.Error())
+			continue
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if fetcher != nil {
+			os.Remove(path)
+		}
+		results.Total += words
+		results.Numbers += stats.numbers
+		results.Bytes += size
+		results.Records += records
+		fc := fileCount{Name: name, Words: words, Numbers: stats.numbers, Bytes: size, Records: records}
+		fc.Empty = emptyFile == "flag" && fi.Size() == 0
+		fc.Shapes = stats.shapes
+		if alphabet != nil {
+			for r := range stats.alphabet {
+				alphabet[r] = true
+			}
+			fc.AlphabetSize, fc.Alphabet = len(stats.alphabet), listAlphabet(stats.alphabet, alphabetList)
+		}
+		if wordsPerKB && size > 0 {
+			fc.WordsPerKB = math.Round(float64(words)/float64(size)*1024*100) / 100
+		}
+		if stats.sentences > 0 {
+			fc.Sentences = stats.sentences
+			fc.WordsPerSentence = math.Round(float64(words)/float64(stats.sentences)*100) / 100
+		}
+		if mt := fi.ModTime(); includeMtime && !mt.IsZero() && mt.Unix() != 0 {
+			fc.ModTime = mt.UTC().Format(time.RFC3339)
+		}
+		if computeEntropy {
+			var e entropySum
+			for _, c := range stats.freq {
+				e.add(c)
+			}
+			fc.Entropy = e.bits()
+		}
+		if topWord {
+			if top := topWords(stats.freq, 1); len(top) > 0 {
+				fc.TopWord, fc.TopWordCount = top[0].Word, top[0].Count
+			}
+		}
+		if opts.allMetrics {
+			fc.Lines, fc.Runes, fc.Graphemes = stats.lines, stats.runes, stats.graphemes
+		}
+		if opts.longestLine && stats.longest.number > 0 {
+			fc.LongestLine, fc.LongestLineNumber, fc.LongestLinePreview = stats.longest.runes, stats.longest.number, stats.longest.preview
+		}
+		if opts.blankLines != "" {
+			fc.Lines, fc.BlankLines = stats.lines, stats.blank
+			if stats.lines > 0 {
+				fc.BlankRatio = math.Round(float64(stats.blank)/float64(stats.lines)*10000) / 10000
+			}
+		}
+		if !stats.firstTime.IsZero() {
+			fc.FirstTimestamp = stats.firstTime.Format(time.RFC3339Nano)
+			fc.LastTimestamp = stats.lastTime.Format(time.RFC3339Nano)
+		}
+		if labels != nil {
+			fc.Label = labels[i]
+		}
+		results.Files = append(results.Files, fc)
+		if err := stream.write(fc); err != nil {
+			log.Fatal(err)
+		}
+		counted++
+		if checkpoint != nil {
+			if err := checkpoint.update(checkpointFile, results); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if byExt != nil {
+			byExt[extensionKey(entry)] += words
+		}
+		if timeline != nil {
+			timeline = append(timeline, stats.timeline...)
+		}
+		if stats.tokens != nil {
+			if words > opts.dumpTokens {
+				warn(name, "DUMP_TOKENS: only the first %d of %d tokens are written", opts.dumpTokens, words)
+			}
+            // Split files collect up to the limit per chunk.
+			if err := writeTokens(outputs, name, stats.tokens[:min(len(stats.tokens), opts.dumpTokens)]); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if detectLang {
+			languages = append(languages, detectLanguage(name, stats.trigrams, profiles, langThreshold))
+		}
+		if opts.terms != nil {
+			termCounts = append(termCounts, fileTerms{Name: name, Terms: stats.terms})
+		}
+		if compliance {
+			complianceResults = append(complianceResults, checkCompliance(name, stats, opts.allowWords))
+		}
+		if countSocial {
+			tags := fileSocial{Name: name}
+			for _, c := range stats.hashtags {
+				tags.Hashtags += c
+			}
+			for _, c := range stats.mentions {
+				tags.Mentions += c
+			}
+			if socialList {
+				tags.HashtagList, tags.MentionList = stats.hashtags, stats.mentions
+			}
+			social = append(social, tags)
+		}
+		if cloudMode == "file" {
+			cloud.Files = append(cloud.Files, fileCloud{Name: name, Words: cloudWeights(topWords(stats.freq, cloudSize))})
+		}
+		if perFileFreq && freq != nil {
+			for w, c := range stats.freq {
+				freq[w] += c
+			}
+		}
+		if err := spill.check(freq); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if checkpoint != nil {
+		if err := checkpoint.write(checkpointFile, results); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if !results.LimitReached {
+		processed = len(entries)
+	}
+	if err := progress.write(processed, len(entries)); err != nil {
+		log.Fatal(err)
+	}
+	if err := stream.close(); err != nil {
+		log.Fatal(err)
+	}
+
+	if hashMapping != "" && names.enabled {
+		if err := names.writeMapping(hashMapping); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if computeEntropy {
+		var e entropySum
+		if err := spill.each(freq, func(wc wordCount) error { e.add(wc.Count); return nil }); err != nil {
+			log.Fatal(err)
+		}
+		results.Entropy = e.bits()
+	}
+	if alphabet != nil {
+		results.AlphabetSize, results.Alphabet = len(alphabet), listAlphabet(alphabet, alphabetList)
+	}
+
+    // Warnings go to `stderr` as they occur. With `WARNINGS_IN_OUTPUT=true`, they are also listed in "count.json", so that the results document their own caveats.
+	if envBool("WARNINGS_IN_OUTPUT") {
+		results.Warnings = warnings
+	}
+
+    // The options must all be looked up before the fingerprint is taken, including those that are only needed later.
+	baseline := envString("BASELINE")
+	if baseline != "" {
+		recordInput(baseline)
+	}
+	if withFingerprint {
+		if fetcher != nil {
+			log.Fatal("FINGERPRINT does not work with URL_LIST")
+		}
+		var err error
+		if results.Fingerprint, err = fingerprint(inputDir, entries, includeMtime || order == "mtime"); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	results.Memory = memory.stop()
+	if err := counts.write(outputs, results); err != nil {
+		log.Fatal(err)
+	}
+
+	if cloudMode != "" {
+		if cloudMode == "global" {
+			top, err := spill.top(freq, cloudSize)
+			if err != nil {
+				log.Fatal(err)
+			}
+			cloud.Words = cloudWeights(top)
+		}
+		if err := writeJSON(outputs, "wordcloud.json", cloud); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if opts.terms != nil {
+		if err := writeJSON(outputs, "term_counts.json", termCounts); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if countSocial {
+		if err := writeJSON(outputs, "social.json", social); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if compliance {
+		if err := writeJSON(outputs, "compliance.json", complianceResults); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if byKey != nil {
+		if err := writeJSON(outputs, "by_key.json", byKey); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if byKeyFreq != nil {
+		top := map[string][]wordCount{}
+		for k, f := range byKeyFreq {
+			top[k] = topWords(f, topN)
+		}
+		if err := writeJSON(outputs, "by_key_top_words.json", top); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if byExt != nil {
+		if err := writeJSON(outputs, "by_extension.json", byExt); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if labels != nil {
+		byLabel := map[string]int{}
+		for _, f := range results.Files {
+			if !f.Skipped {
+				byLabel[f.Label] += f.Words
+			}
+		}
+		if err := writeJSON(outputs, "by_label.json", byLabel); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if growth != nil {
+		if err := writeJSON(outputs, "vocab_growth.json", growth.curve()); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if mergeFreq {
+		if err := spill.writeTable(outputs, "frequencies.json", freq, freqLimits); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if freqStore != "" {
+		store, err := readFreqTable(freqStore)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := spill.each(freq, func(wc wordCount) error { store[wc.Word] += wc.Count; return nil }); err != nil {
+			log.Fatal(err)
+		}
+		if err := writeJSON(outputs, "freq_store.json", topWords(store, -1)); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if timeline != nil {
+		if err := writeJSON(outputs, "burst.json", findBurst(timeline, burstWindow)); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if detectLang {
+		if err := writeJSON(outputs, "languages.json", languages); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+    // If `BASELINE` points to the "count.json" of a previous run, "diff.json" reports which files were added, removed, or changed since then. This helps to spot unexpected data drift.
+	if baseline != "" {
+		prev, err := readReport(baseline)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := writeJSON(outputs, "diff.json", diffReports(prev, results)); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+    // For reproducibility, "config_effective.json" documents the options that produced these results.
+	if err := writeJSON(outputs, "config_effective.json", effectiveConfig); err != nil {
+		log.Fatal(err)
+	}
+
+    // Write the bundle, if any. Only now all outputs are complete.
+	if err := outputs.close(); err != nil {
+		log.Fatal(err)
+	}
+
+    // The total count goes to `stdout`.
+	printTotal(results)
+	if chart {
+		top, err := spill.top(freq, topN)
+		if err != nil {
+			log.Fatal(err)
+		}
+		printChart(os.Stdout, top, 40)
+	}
+	if err := spill.remove(); err != nil {
+		log.Print(err)
+	}
+	if err := fetcher.remove(); err != nil {
+		log.Print(err)
+	}
+
+}
+
+// `options` collects the settings that control what counts as a word. All settings, including the word lists loaded from files, are set up once before counting starts and are only read afterwards. This way, the goroutines that count the chunks of a split file share them safely, without locks or copies.
+type options struct {
+    // `filter` selects the lines to count. If nil, all lines are counted.
+	filter *regexp.Regexp
+
+    // If `timestamp` is not nil, its first capture group extracts a timestamp from each line. The timestamp is parsed with the first of `timeLayouts` that fits.
+	timestamp   *regexp.Regexp
+	timeLayouts []string
+
+    // If `groupField` is not nil, the words of each line are attributed to the key that its first capture group extracts from the line.
+	groupField *regexp.Regexp
+
+    // If `wordRegex` is not nil, words are the matches of this regular expression rather than runs of non-space characters.
+	wordRegex *regexp.Regexp
+
+    // With `preTokenized`, each line is one word.
+	preTokenized bool
+
+    // If `within` is not nil, only the text between these delimiters counts.
+	within *delimiters
+
+    // With `alphaOnly`, tokens that contain anything but letters are not counted. Runes in `alphaInner` (say, apostrophes and hyphens) are accepted between letters, so that "don't" or "well-known" still count as words.
+	alphaOnly  bool
+	alphaInner string
+
+    // With `excludeNumbers`, numeric tokens like "42", "-3.5", or "1,000" are not counted as words but as numbers.
+	excludeNumbers bool
+
+    // `stripControl` removes byte order marks and all control characters except whitespace.
+	stripControl bool
+
+    // `invalidUTF8` is one of "replace", "skip", or "error".
+	invalidUTF8 string
+
+    // `normalizeNewlines` turns all line endings into "\n".
+	normalizeNewlines bool
+
+    // `stripChars` are removed from each word.
+	stripChars string
+
+    // `trimPrefixes` and `trimSuffixes` are removed from the start and the end of each word.
+	trimPrefixes, trimSuffixes []string
+
+    // With `allMetrics`, lines, runes, and grapheme clusters are counted, too.
+	allMetrics bool
+
+    // With `longestLine`, the longest line of each file is tracked, with a preview of `linePreview` runes.
+	longestLine bool
+	linePreview int
+
+    // `blankLines` is "empty" or "whitespace" to count blank lines by that definition, or "" not to count them.
+	blankLines string
+
+    // With `transliterate`, accents are removed.
+	transliterate bool
+
+    // With `foldDigits`, the frequencies are tracked for words with digit runs replaced by "<NUM>".
+	foldDigits bool
+
+    // With `freqFoldCase`, the frequencies are tracked for lowercased words.
+	freqFoldCase bool
+
+    // With `totalFoldCase`, the unique words are tracked lowercased.
+	totalFoldCase bool
+
+    // If `dumpTokens` is not zero, up to this many counted tokens are recorded per file.
+	dumpTokens int
+
+    // `pipeline` transforms each word before it is counted.
+	pipeline []Preprocessor
+
+    // `terms` are the words to count separately. With `termLines`, each line counts only once per term.
+	terms     map[string]bool
+	termLines bool
+
+    // `denyWords` and `allowWords` are the lowercase banned and required words of a compliance check.
+	denyWords, allowWords map[string]bool
+
+    // If `abbreviations` is not nil, sentences are counted, too. A sentence ends with one of the `sentencePunct` characters.
+	abbreviations map[string]bool
+	sentencePunct string
+
+    // `handlers` maps lowercase file extensions to the handler that turns the file into plain text.
+	handlers map[string]fileHandler
+}
+
+// A `fileHandler` extracts the countable text from a file of a specific type.
+type fileHandler func([]byte) ([]byte, error)
+
+// These are the built-in handlers and the extensions they are used for by default.
+var (
+	fileHandlers = map[string]fileHandler{
+		"plain":    nil,
+		"markdown": stripMarkdown,
+		"html":     stripHTML,
+		"json":     jsonText,
+	}
+	defaultHandlers = map[string]string{
+		".md":       "markdown",
+		".markdown": "markdown",
+		".html":     "html",
+		".htm":      "html",
+		".json":     "json",
+	}
+)
+
+// `parseHandlers` turns a list like `defaults,.txt=markdown` into an extension map.
+func parseHandlers(spec string) (map[string]fileHandler, error) {
+	handlers := map[string]fileHandler{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "defaults" {
+			for ext, name := range defaultHandlers {
+				handlers[ext] = fileHandlers[name]
+			}
+			continue
+		}
+		ext, name, ok := strings.Cut(entry, "=")
+		h, known := fileHandlers[name]
+		if !ok || !known {
+			return nil, fmt.Errorf("invalid handler mapping %q", entry)
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		handlers[strings.ToLower(ext)] = h
+	}
+	return handlers, nil
+}
+
+// `preprocess` runs the file at `path` through the handler for its extension. Files without a handler are passed through unchanged, so that they can still be streamed rather than read into memory. `name` is the file name as reported in the results.
+func preprocess(path, name string, f io.Reader, opts *options) (io.Reader, error) {
+	h := opts.handlers[strings.ToLower(filepath.Ext(path))]
+	if h == nil {
+		return f, nil
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("preprocess %s: %w", path, err)
+	}
+	data, err = h(data)
+	if err != nil {
+		return nil, fmt.Errorf("preprocess %s: %w", path, err)
+	}
+    // A file may have no text at all, like a PDF of scanned pages. It still counts with zero words, but this deserves a note.
+	if len(bytes.TrimSpace(data)) == 0 {
+		warn(name, "no text found")
+	}
+	return bytes.NewReader(data), nil
+}
+
+// `errNotEncoded` means that the content is not in the expected encoding.
+var errNotEncoded = errors.New("not encoded")
+
+// `decodeContent` decodes the whole content of `r` from base64 or hex. If the content cannot be decoded, it returns the raw content along with an error that wraps `errNotEncoded`.
+func decodeContent(r io.Reader, encoding string) (io.Reader, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("decodeContent: %w", err)
+	}
+	compact := strings.Join(strings.Fields(string(data)), "")
+	if encoding == "hex" {
+		if decoded, err := hex.DecodeString(compact); err == nil {
+			return bytes.NewReader(decoded), nil
+		}
+	} else {
+		for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+			if decoded, err := enc.DecodeString(compact); err == nil {
+				return bytes.NewReader(decoded), nil
+			}
+		}
+	}
+	return bytes.NewReader(data), fmt.Errorf("%w as %s", errNotEncoded, encoding)
+}
+
+// Markdown syntax that would otherwise be counted as words: heading markers, quote markers, list bullets, horizontal rules, and code fences. Links and images are reduced to their text.
+var (
+	mdLineSyntax = regexp.MustCompile(`(?m)^[ \t]*(#{1,6}|>+|[-*+]|\d+\.)[ \t]+`)
+	mdRule       = regexp.MustCompile("(?m)^[ \\t]*(([-*_][ \\t]*){3,}|(```|~~~).*)$")
+	mdLink       = regexp.MustCompile(`!?\[([^\]]*)\]\([^)]*\)`)
+)
+
+func stripMarkdown(data []byte) ([]byte, error) {
+	data = mdRule.ReplaceAll(data, nil)
+	data = mdLineSyntax.ReplaceAll(data, nil)
+	return mdLink.ReplaceAll(data, []byte("$1")), nil
+}
+
+// Code blocks are either fenced by at least three backticks or tildes, or indented by four spaces or a tab after a blank line. Code spans are enclosed in single or double backticks.
+var (
+	mdFence      = regexp.MustCompile("^ {0,3}(`{3,}|~{3,})")
+	mdIndented   = regexp.MustCompile(`^( {4}|\t)`)
+	mdInlineCode = regexp.MustCompile("``[^`](?:[^`]|`[^`])*``|`[^`]+`")
+)
+
+// `stripCode` blanks out the lines of code blocks, and handles code spans according to `inline`. A fence that is never closed extends to the end of the file.
+func stripCode(data []byte, inline string) []byte {
+	var out bytes.Buffer
+	var fence []byte
+	inParagraph, inIndented := false, false
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		blank := len(bytes.TrimSpace(line)) == 0
+		switch {
+		case fence != nil:
+			if m := mdFence.FindSubmatch(line); m != nil && m[1][0] == fence[0] && len(m[1]) >= len(fence) && len(bytes.TrimSpace(line[len(m[0]):])) == 0 {
+				fence = nil
+			}
+		case mdFence.Match(line):
+			fence = mdFence.FindSubmatch(line)[1]
+			inParagraph = false
+		case (inIndented || !inParagraph) && mdIndented.Match(line):
+			inIndented = true
+		case blank:
+			inParagraph = false
+			out.Write(line)
+			continue
+		default:
+			inParagraph, inIndented = true, false
+			switch inline {
+			case "unwrap":
+				line = mdInlineCode.ReplaceAllFunc(line, func(span []byte) []byte { return bytes.Trim(span, "` ") })
+			case "strip":
+				line = mdInlineCode.ReplaceAll(line, []byte(" "))
+			}
+			out.Write(line)
+			continue
+		}
+        // Code lines turn into blank lines, so that the line structure stays intact.
+		if bytes.HasSuffix(line, []byte("\n")) {
+			out.WriteByte('\n')
+		}
+	}
+	return out.Bytes()
+}
+
+// HTML tags are replaced by spaces, because a tag may be the only thing that separates two words. Scripts, styles, and comments are not text and go away entirely.
+var (
+	htmlNonText = regexp.MustCompile(`(?is)<script\b.*?</script>|<style\b.*?</style>|<!--.*?-->`)
+	htmlTag     = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+func stripHTML(data []byte) ([]byte, error) {
+	data = htmlNonText.ReplaceAll(data, []byte(" "))
+	data = htmlTag.ReplaceAll(data, []byte(" "))
+	return []byte(html.UnescapeString(string(data))), nil
+}
+
+// `jsonText` collects all string values of a JSON document. Object keys are structure, not text, and are left out.
+func jsonText(data []byte) ([]byte, error) {
+	var doc any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	var text bytes.Buffer
+	var walk func(v any)
+	walk = func(v any) {
+		switch v := v.(type) {
+		case string:
+			text.WriteString(v)
+			text.WriteByte('\n')
+		case []any:
+			for _, e := range v {
+				walk(e)
+			}
+		case map[string]any:
+			for _, e := range v {
+				walk(e)
+			}
+		}
+	}
+	walk(doc)
+	return text.Bytes(), nil
+}
+
+// `fileStats` collects optional metrics besides the word count. Metrics with a nil map are not tracked.
+type fileStats struct {
+    // `freq` adds up how often each word occurs.
+	freq map[string]int
+
+    // `trigrams` samples the letter trigrams of the first words, for language detection.
+	trigrams map[string]int
+
+    // `numbers` counts the numeric tokens that were not counted as words.
+	numbers int
+
+    // `byKey` adds up the words per group key.
+	byKey map[string]int
+
+    // `keyFreq` adds up how often each word occurs per group key. `key` is the group key of the current line.
+	keyFreq map[string]map[string]int
+	key     string
+
+    // `terms` counts the occurrences of the match terms.
+	terms map[string]int
+
+    // `hashtags` and `mentions` count the social media tags, without their "#" or "@".
+	hashtags, mentions map[string]int
+
+    // `shapes` counts the tokens per shape.
+	shapes map[string]int
+
+    // `banned` counts the banned words, and `required` records the required words that occur.
+	banned   map[string]int
+	required map[string]bool
+
+    // `growth` is shared by all files and sees every word in order.
+	growth *vocabGrowth
+
+    // `firstTime` and `lastTime` are the earliest and latest timestamps found.
+	firstTime, lastTime time.Time
+
+    // `sentences` counts the sentences. `inSentence` is true while the current sentence has not ended yet.
+	sentences  int
+	inSentence bool
+
+    // If `tokens` is not nil, it records the counted tokens in order.
+	tokens []string
+
+    // If `timeline` is not nil, it records the words of each line with a timestamp.
+	timeline []timedWords
+
+    // `lines`, `runes`, and `graphemes` are only counted with `allMetrics`, `longestLine`, or `blankLines`, and `blank` only with `blankLines`.
+	lines, runes, graphemes int
+	blank                   int
+
+    // `longest` is the longest line so far, if tracked.
+	longest longLine
+
+    // If `alphabet` is not nil, it collects the distinct characters other than whitespace.
+	alphabet map[rune]bool
+}
+
+// A `longLine` is a line's number, starting at 1, its length in runes without the line break, and the start of its text.
+type longLine struct {
+	number, runes int
+	preview       string
+}
+
+// `sameMetrics` returns empty stats that track the same metrics as `s`.
+func (s *fileStats) sameMetrics() *fileStats {
+	n := &fileStats{}
+	if s.freq != nil {
+		n.freq = map[string]int{}
+	}
+	if s.trigrams != nil {
+		n.trigrams = map[string]int{}
+	}
+	if s.byKey != nil {
+		n.byKey = map[string]int{}
+	}
+	if s.keyFreq != nil {
+		n.keyFreq = map[string]map[string]int{}
+	}
+	if s.terms != nil {
+		n.terms = map[string]int{}
+	}
+	if s.hashtags != nil {
+		n.hashtags, n.mentions = map[string]int{}, map[string]int{}
+	}
+	if s.shapes != nil {
+		n.shapes = map[string]int{}
+	}
+	if s.alphabet != nil {
+		n.alphabet = map[rune]bool{}
+	}
+	if s.banned != nil {
+		n.banned, n.required = map[string]int{}, map[string]bool{}
+	}
+	if s.timeline != nil {
+		n.timeline = []timedWords{}
+	}
+	if s.tokens != nil {
+		n.tokens = []string{}
+	}
+	return n
+}
+
+// `merge` adds the metrics of `o` to `s`.
+func (s *fileStats) merge(o *fileStats) {
+	s.numbers += o.numbers
+	s.lines += o.lines
+	s.runes += o.runes
+	s.graphemes += o.graphemes
+	s.blank += o.blank
+	for r := range o.alphabet {
+		s.alphabet[r] = true
+	}
+	if !o.firstTime.IsZero() {
+		s.addTime(o.firstTime)
+		s.addTime(o.lastTime)
+	}
+	for w, c := range o.freq {
+		s.freq[w] += c
+	}
+	for t, c := range o.trigrams {
+		s.trigrams[t] += c
+	}
+	for k, c := range o.byKey {
+		s.byKey[k] += c
+	}
+	for k, f := range o.keyFreq {
+		for w, c := range f {
+			s.addKeyFreq(k, w, c)
+		}
+	}
+	for t, c := range o.terms {
+		s.terms[t] += c
+	}
+	for t, c := range o.hashtags {
+		s.hashtags[t] += c
+	}
+	for t, c := range o.mentions {
+		s.mentions[t] += c
+	}
+	for sh, c := range o.shapes {
+		s.shapes[sh] += c
+	}
+	for w, c := range o.banned {
+		s.banned[w] += c
+	}
+	for w := range o.required {
+		s.required[w] = true
+	}
+	s.timeline = append(s.timeline, o.timeline...)
+	s.tokens = append(s.tokens, o.tokens...)
+}
+
+// `addKeyFreq` adds `n` occurrences of a word to the frequencies of a group.
+func (s *fileStats) addKeyFreq(key, word string, n int) {
+	f := s.keyFreq[key]
+	if f == nil {
+		f = map[string]int{}
+		s.keyFreq[key] = f
+	}
+	f[word] += n
+}
+
+// `addTime` widens the time range to include `t`.
+func (s *fileStats) addTime(t time.Time) {
+	if s.firstTime.IsZero() || t.Before(s.firstTime) {
+		s.firstTime = t
+	}
+	if t.After(s.lastTime) {
+		s.lastTime = t
+	}
+}
+
+// `vocabGrowth` tracks the number of unique words over the number of words seen so far.
+type vocabGrowth struct {
+	interval int
+	seen     map[string]struct{}
+	words    int
+	points   []growthPoint
+}
+
+type growthPoint struct {
+	Words  int `json:"words"`
+	Unique int `json:"unique"`
+}
+
+func (g *vocabGrowth) add(word string) {
+	g.seen[word] = struct{}{}
+	g.words++
+	if g.words%g.interval == 0 {
+		g.points = append(g.points, growthPoint{Words: g.words, Unique: len(g.seen)})
+	}
+}
+
+// `curve` returns the sampled points. The last point is always the final state, so that the curve ends at the true number of unique words.
+func (g *vocabGrowth) curve() []growthPoint {
+	if len(g.points) == 0 || g.points[len(g.points)-1].Words != g.words {
+		return append(g.points, growthPoint{Words: g.words, Unique: len(g.seen)})
+	}
+	return g.points
+}
+
+// `timedWords` is the number of words in a line with the given timestamp.
+type timedWords struct {
+	t     time.Time
+	words int
+}
+
+// A `burst` is the time window with the most words. `Start` and `End` are the timestamps of the first and the last line in the window.
+type burst struct {
+	Window string `json:"window"`
+	Start  string `json:"start,omitempty"`
+	End    string `json:"end,omitempty"`
+	Words  int    `json:"words"`
+}
+
+// `findBurst` slides a window of the given length over the sorted timeline and returns the window with the most words. Among windows with equal word counts, the earliest wins.
+func findBurst(timeline []timedWords, window time.Duration) burst {
+	sort.SliceStable(timeline, func(i, j int) bool { return timeline[i].t.Before(timeline[j].t) })
+	b := burst{Window: window.String()}
+	first, sum := 0, 0
+	for last, tw := range timeline {
+		sum += tw.words
+		for tw.t.Sub(timeline[first].t) >= window {
+			sum -= timeline[first].words
+			first++
+		}
+		if last == 0 || sum > b.Words {
+			b.Words = sum
+			b.Start = timeline[first].t.Format(time.RFC3339Nano)
+			b.End = timeline[last].t.Format(time.RFC3339Nano)
+		}
+	}
+	return b
+}
+
+// `mmapFile` maps a file into memory and returns the data along with a function to unmap it. It is nil on platforms without memory-mapped files.
+var mmapFile func(f *os.File, size int64) ([]byte, func() error, error)
+
+// `readBufferSize` is the buffer size of the "buffered" read strategy.
+const readBufferSize = 1 << 20
+
+// `fileReader` returns a reader for the file according to the read strategy. Files that cannot be mapped, like empty files or special files, are read through a buffer instead. `name` is the file name for warnings. A non-nil release function must be called when reading is done.
+func fileReader(f *os.File, name string, size int64, strategy string) (io.Reader, func() error, error) {
+	switch strategy {
+	case "buffered":
+		return bufio.NewReaderSize(f, readBufferSize), nil, nil
+	case "mmap":
+		if size > 0 && size == int64(int(size)) {
+			data, unmap, err := mmapFile(f, size)
+			if err == nil {
+				return bytes.NewReader(data), unmap, nil
+			}
+			warn(name, "%v, using buffered reads", err)
+		}
+		return bufio.NewReaderSize(f, readBufferSize), nil, nil
+	}
+	return f, nil, nil
+}
+
+// `countSplit` counts the words of a large file in parallel. Each chunk ends at a line break, so no word (and no line, for line filters) spans two chunks and thus is neither counted twice nor missed. A file without line breaks ends up as a single chunk.
+func countSplit(f *os.File, size int64, workers int, opts *options, stats *fileStats) (int, error) {
+	bounds, err := chunkBounds(f, size, max(workers, 1))
+	if err != nil {
+		return 0, err
+	}
+	n := len(bounds) - 1
+	counts := make([]int, n)
+	chunkStats := make([]*fileStats, n)
+	errs := make([]error, n)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			chunk := io.NewSectionReader(f, bounds[i], bounds[i+1]-bounds[i])
+			chunkStats[i] = stats.sameMetrics()
+			if i > 0 {
+                // Language detection samples the first words of the file, which are in the first chunk.
+				chunkStats[i].trigrams = nil
+			}
+			counts[i], errs[i] = countWords(bufio.NewReader(chunk), opts, chunkStats[i])
+		}(i)
+	}
+	wg.Wait()
+
+	total := 0
+	for i := 0; i < n; i++ {
+		if errs[i] != nil {
+			return 0, errs[i]
+		}
+		total += counts[i]
+		stats.merge(chunkStats[i])
+	}
+	return total, nil
+}
+
+// `chunkBounds` divides a file into up to `n` chunks of roughly equal size. Every chunk boundary is moved forward to just behind the next line break.
+func chunkBounds(f *os.File, size int64, n int) ([]int64, error) {
+	bounds := []int64{0}
+	for i := 1; i < n; i++ {
+		pos, err := lineStart(f, size, max(size*int64(i)/int64(n), bounds[len(bounds)-1]))
+		if err != nil {
+			return nil, fmt.Errorf("chunkBounds: %w", err)
+		}
+		if pos >= size {
+			break
+		}
+		bounds = append(bounds, pos)
+	}
+	return append(bounds, size), nil
+}
+
+// `lineStart` returns the offset just behind the first line break at or after `pos`, or `size` if there is none.
+func lineStart(f *os.File, size, pos int64) (int64, error) {
+	buf := make([]byte, 4096)
+	for pos < size {
+		m, err := f.ReadAt(buf, pos)
+		if j := bytes.IndexByte(buf[:m], '\n'); j >= 0 {
+			return pos + int64(j) + 1, nil
+		}
+		pos += int64(m)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return size, nil
+}
+
+// `fileRange` returns a reader for the lines of the file that start at or after `start` and before `end`, and their length in bytes. An `end` of zero means the end of the file. A line starts at the beginning of the file or behind a line break.
+func fileRange(f *os.File, size, start, end int64) (io.Reader, int64, error) {
+	if end == 0 || end > size {
+		end = size
+	}
+	var err error
+	if start > 0 {
+		if start, err = lineStart(f, size, min(start, size)-1); err != nil {
+			return nil, 0, fmt.Errorf("fileRange: %w", err)
+		}
+	}
+	if end > start {
+		if end, err = lineStart(f, size, end-1); err != nil {
+			return nil, 0, fmt.Errorf("fileRange: %w", err)
+		}
+	}
+	end = max(end, start)
+	return bufio.NewReaderSize(io.NewSectionReader(f, start, end-start), readBufferSize), end - start, nil
+}
+
+// `countWords` scans words from an input stream and counts them. The algorithm is simple and counts everything, including comment symbols, markdown heading markers, etc., unless the options say otherwise.
+func countWords(r *bufio.Reader, opts *options, stats *fileStats) (int, error) {
+	if opts.stripControl || opts.invalidUTF8 == "skip" || opts.normalizeNewlines {
+		drop := func(rune) bool { return false }
+		if opts.stripControl {
+			drop = isStrayControl
+		}
+		r = bufio.NewReader(&stripReader{
+			r:           r,
+			drop:        drop,
+			dropInvalid: opts.invalidUTF8 == "skip",
+			newlines:    opts.normalizeNewlines,
+		})
+	}
+	if opts.transliterate {
+		r = bufio.NewReader(transliterate(r))
+	}
+	if opts.allMetrics || opts.longestLine || opts.blankLines != "" || stats.alphabet != nil {
+		r = bufio.NewReader(&metricsReader{r: r, stats: stats, preview: opts.linePreview, blankSpace: opts.blankLines == "whitespace", filter: opts.filter})
+	}
+	if opts.within != nil {
+		r = bufio.NewReader(&withinReader{r: r, delimiters: *opts.within})
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Split(bufio.ScanWords)
+
+    // To filter lines or to match words by a regular expression, we need to look at whole lines first and split them into words afterwards.
+	lineMode := opts.filter != nil || opts.wordRegex != nil || opts.groupField != nil || opts.timestamp != nil || opts.preTokenized || opts.termLines
+	if lineMode {
+		scanner.Split(bufio.ScanLines)
+		scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), maxLineLength)
+	}
+
+    // `lineTerms` are the terms found in the current line, if each line counts only once.
+	var lineTerms map[string]bool
+	if opts.termLines {
+		lineTerms = map[string]bool{}
+	}
+
+	wordCount := 0
+	count := func(word string) {
+        // Some tokenizers can produce empty tokens, like a word regular expression that matches the empty string between two words. These are never words.
+		if word == "" {
+			return
+		}
+        // Sentence ends are detected on the raw words, as the filters below may remove the punctuation.
+		if opts.abbreviations != nil {
+			stats.sentences += innerSentenceEnds(word, opts.sentencePunct)
+			stats.inSentence = true
+			if endsSentence(word, opts.sentencePunct, opts.abbreviations) {
+				stats.sentences++
+				stats.inSentence = false
+			}
+		}
+		if stats.hashtags != nil {
+			stats.addSocialTags(word)
+		}
+		if stats.shapes != nil {
+			stats.shapes[tokenShape(word)]++
+		}
+		if opts.stripChars != "" {
+			word = strings.Map(func(r rune) rune {
+				if strings.ContainsRune(opts.stripChars, r) {
+					return -1
+				}
+				return r
+			}, word)
+			if word == "" {
+				return
+			}
+		}
+		if opts.trimPrefixes != nil || opts.trimSuffixes != nil {
+			if word = trimAffixes(word, opts.trimPrefixes, opts.trimSuffixes); word == "" {
+				return
+			}
+		}
+		for _, step := range opts.pipeline {
+			if word = step.Process(word); word == "" {
+				return
+			}
+		}
+		if opts.alphaOnly && !isAlpha(word, opts.alphaInner) {
+			return
+		}
+		if opts.excludeNumbers && isNumber(word) {
+			stats.numbers++
+			return
+		}
+		wordCount++
+		if stats.tokens != nil && len(stats.tokens) < opts.dumpTokens {
+			stats.tokens = append(stats.tokens, word)
+		}
+		if stats.freq != nil || stats.keyFreq != nil {
+			key := word
+			if opts.freqFoldCase {
+				key = strings.ToLower(key)
+			}
+			if opts.foldDigits {
+				key = digitRuns.ReplaceAllString(key, "<NUM>")
+			}
+			if stats.freq != nil {
+				stats.freq[key]++
+			}
+			if stats.keyFreq != nil {
+				stats.addKeyFreq(stats.key, key, 1)
+			}
+		}
+		if stats.growth != nil {
+			if opts.totalFoldCase {
+				stats.growth.add(strings.ToLower(word))
+			} else {
+				stats.growth.add(word)
+			}
+		}
+		if stats.banned != nil {
+			if lower := strings.ToLower(word); opts.denyWords[lower] {
+				stats.banned[lower]++
+			} else if opts.allowWords[lower] {
+				stats.required[lower] = true
+			}
+		}
+		if stats.terms != nil && opts.terms[word] && !lineTerms[word] {
+			stats.terms[word]++
+			if lineTerms != nil {
+				lineTerms[word] = true
+			}
+		}
+		if stats.trigrams != nil && wordCount <= languageSampleWords {
+			addTrigrams(word, stats.trigrams)
+		}
+	}
+	for scanner.Scan() {
+		if !lineMode {
+			count(scanner.Text())
+			continue
+		}
+		if opts.filter != nil && !opts.filter.Match(scanner.Bytes()) {
+			continue
+		}
+		if opts.groupField != nil {
+			stats.key = groupKey(scanner.Text(), opts.groupField)
+		}
+		clear(lineTerms)
+		before := wordCount
+		for _, word := range splitLine(scanner.Text(), opts) {
+			count(word)
+		}
+		if opts.groupField != nil {
+			stats.byKey[stats.key] += wordCount - before
+		}
+		if opts.timestamp != nil {
+			if t, ok := parseTimestamp(scanner.Text(), opts); ok {
+				stats.addTime(t)
+				if stats.timeline != nil {
+					stats.timeline = append(stats.timeline, timedWords{t, wordCount - before})
+				}
+			}
+		}
+	}
+
+    // Text after the last sentence terminator is a sentence, too.
+	if stats.inSentence {
+		stats.sentences++
+		stats.inSentence = false
+	}
+
+	if err := scanner.Err(); err != nil {
+        // EOF is expected in this context. 
+		if err == io.EOF {
+			return wordCount, nil
+		}
+        // Else return an error.
+		return wordCount, fmt.Errorf("countWords: %w", err)
+	}
+
+	return wordCount, nil
+}
+
+// The default abbreviations are common English ones.
+const defaultAbbreviations = "mr.,mrs.,ms.,dr.,prof.,sr.,jr.,st.,vs.,etc.,e.g.,i.e.,cf.,approx.,no.,fig."
+
+// The default sentence terminators: ". ! ?", their full-width forms "。！？｡", the Armenian full stop "։", the Arabic question mark "؟", the Urdu full stop "۔", the Devanagari dandas "। ॥", and the Ethiopic full stop and question mark "። ፧".
+const defaultSentencePunct = ".!?。！？｡։؟۔।॥።፧"
+
+// `sentenceClosers` may follow a sentence terminator.
+const sentenceClosers = "\"')]»”’」』）"
+
+// `endsSentence` reports whether a word ends with a sentence terminator. Closing quotes and brackets after the terminator are ignored. Decimal numbers like "3.14" cannot end a sentence, as the terminator must be at the end of the word.
+func endsSentence(word, punct string, abbreviations map[string]bool) bool {
+	trimmed := strings.TrimRight(word, sentenceClosers)
+	last, _ := utf8.DecodeLastRuneInString(trimmed)
+	if trimmed == "" || !strings.ContainsRune(punct, last) {
+		return false
+	}
+	return !abbreviations[strings.ToLower(trimmed)]
+}
+
+// `innerSentenceEnds` counts the sentences that end within a word, as in "你好。谢谢。". Only terminators other than ASCII count here, as an ASCII period within a word is rather part of a number, an abbreviation, or a URL. A run of terminators ends one sentence. The end of the word is left to `endsSentence`.
+func innerSentenceEnds(word, punct string) int {
+	ends := 0
+	inRun := false
+	for _, r := range strings.TrimRight(word, sentenceClosers) {
+		switch {
+		case r >= utf8.RuneSelf && strings.ContainsRune(punct, r):
+			inRun = true
+		case inRun && (strings.ContainsRune(punct, r) || strings.ContainsRune(sentenceClosers, r)):
+            // Still the same ending, as in "。」" or "？!".
+		case inRun:
+			ends++
+			inRun = false
+		}
+	}
+	return ends
+}
+
+// `socialTag` matches a hashtag or mention that starts the word or follows a character that cannot be part of a tag, as in "(#go)" but not "me@example.com".
+var socialTag = regexp.MustCompile(`(?:^|[^\p{L}\p{M}\p{N}_])([#@])([\p{L}\p{M}\p{N}_]+)`)
+
+// `addSocialTags` counts the hashtags and mentions in a word. Tags without a letter, like "#1", are ignored.
+func (s *fileStats) addSocialTags(word string) {
+	if !strings.ContainsAny(word, "#@") {
+		return
+	}
+	for _, m := range socialTag.FindAllStringSubmatch(word, -1) {
+		if !strings.ContainsFunc(m[2], unicode.IsLetter) {
+			continue
+		}
+		if m[1] == "#" {
+			s.hashtags[m[2]]++
+		} else {
+			s.mentions[m[2]]++
+		}
+	}
+}
+
+// `tokenShape` classifies a token by the case of its letters and its digits. Punctuation at either end is ignored, so that "Yes," and "42." have the shape of "Yes" and "42".
+//
+// - "number": a number, as `isNumber` sees it, like "42" or "-3.5".
+// - "punctuation": neither letters nor digits, like "--" or "…".
+// - "lowercase": only lowercase letters, like "word".
+// - "capitalized": an uppercase letter followed by lowercase letters, like "Word" or "I".
+// - "all_caps": at least two letters, all uppercase, like "NASA".
+// - "uncased": letters of a script without case, like "单词".
+// - "mixed": anything else, like "iPhone", "B2B", or "Ελλάδα2".
+func tokenShape(word string) string {
+	trimmed := strings.TrimFunc(word, unicode.IsPunct)
+	if trimmed == "" {
+		return "punctuation"
+	}
+	if isNumber(trimmed) {
+		return "number"
+	}
+	var letters, upper, lower, digits int
+	firstUpper := false
+	for _, r := range trimmed {
+		switch {
+		case unicode.IsLetter(r):
+			letters++
+			if unicode.IsUpper(r) {
+				upper++
+				firstUpper = firstUpper || letters == 1
+			} else if unicode.IsLower(r) {
+				lower++
+			}
+		case unicode.IsDigit(r):
+			digits++
+		}
+	}
+	switch {
+	case letters == 0 && digits == 0:
+		return "punctuation"
+	case digits > 0:
+		return "mixed"
+	case upper+lower < letters:
+		if upper+lower == 0 {
+			return "uncased"
+		}
+		return "mixed"
+	case upper == 0:
+		return "lowercase"
+	case upper == letters && letters > 1:
+		return "all_caps"
+	case upper == 1 && firstUpper:
+		return "capitalized"
+	}
+	return "mixed"
+}
+
+// `readWordList` reads a file of words, separated by white space, into a lookup table. A relative path is taken relative to `dir`. Without a file, the table is nil.
+func readWordList(file, dir string) (map[string]bool, error) {
+	if file == "" {
+		return nil, nil
+	}
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(dir, file)
+	}
+	recordInput(file)
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return wordSet(string(data)), nil
+}
+
+// `fileCompliance` is the result of the compliance check of a file. `Banned` lists the banned words that occur, with their counts, and `Missing` the required words that don't, in alphabetical order.
+type fileCompliance struct {
+	Name    string         `json:"name"`
+	Banned  map[string]int `json:"banned"`
+	Missing []string       `json:"missing"`
+	Pass    bool           `json:"pass"`
+}
+
+func checkCompliance(name string, stats *fileStats, allow map[string]bool) fileCompliance {
+	c := fileCompliance{Name: name, Banned: stats.banned, Missing: []string{}}
+	for w := range allow {
+		if !stats.required[w] {
+			c.Missing = append(c.Missing, w)
+		}
+	}
+	sort.Strings(c.Missing)
+	c.Pass = len(c.Banned) == 0 && len(c.Missing) == 0
+	return c
+}
+
+// `fileSocial` has the hashtag and mention counts of a file. The lists are only filled with `SOCIAL_LIST`.
+type fileSocial struct {
+	Name        string         `json:"name"`
+	Hashtags    int            `json:"hashtags"`
+	Mentions    int            `json:"mentions"`
+	HashtagList map[string]int `json:"hashtag_list,omitempty"`
+	MentionList map[string]int `json:"mention_list,omitempty"`
+}
+
+// `fileTerms` has the match term counts of a file. Terms that do not occur are listed with a count of zero.
+type fileTerms struct {
+	Name  string         `json:"name"`
+	Terms map[string]int `json:"terms"`
+}
+
+// ### Preprocessing pipeline
+//
+// A `Preprocessor` transforms a word. An empty result removes the word.
+//
+// Custom preprocessors need no changes to this file. A separate file can register them from an `init` function, like the optional file handlers do, and then `PIPELINE` can use them by name. WASM cannot load plugins at runtime, so this is composition at compile time.
+type Preprocessor interface {
+	Process(word string) string
+}
+
+// `PreprocessorFunc` turns a plain function into a `Preprocessor`.
+type PreprocessorFunc func(string) string
+
+func (f PreprocessorFunc) Process(word string) string {
+	return f(word)
+}
+
+// These are the built-in preprocessors available for `PIPELINE`:
+//
+// - `lowercase` converts the word to lower case.
+// - `strip-punct` removes punctuation and symbols at the start and end of the word, so that "(hello," becomes "hello" but "don't" remains intact.
+// - `stopwords` removes stop words, regardless of their case. This one depends on the configured stop words and is therefore set up by `parsePipeline`.
+// - `stem` reduces English words to a stem by removing common suffixes, so that "counting" and "counted" both become "count". This is a light stemmer, not a full Porter stemmer.
+var preprocessors = map[string]Preprocessor{
+	"lowercase": PreprocessorFunc(strings.ToLower),
+	"strip-punct": PreprocessorFunc(func(w string) string {
+		return strings.TrimFunc(w, func(r rune) bool { return unicode.IsPunct(r) || unicode.IsSymbol(r) })
+	}),
+	"stem": PreprocessorFunc(stem),
+}
+
+// `RegisterPreprocessor` makes a preprocessor available to `PIPELINE` under the given name. It must be called before `main` runs, and the name must not be taken yet.
+func RegisterPreprocessor(name string, p Preprocessor) {
+	if _, ok := preprocessors[name]; ok || name == "stopwords" {
+		panic("RegisterPreprocessor: duplicate name " + name)
+	}
+	preprocessors[name] = p
+}
+
+// A `stopwordFilter` removes the words in the set.
+type stopwordFilter map[string]bool
+
+func (s stopwordFilter) Process(w string) string {
+	if s[strings.ToLower(w)] {
+		return ""
+	}
+	return w
+}
+
+// `parsePipeline` turns a comma-separated list of preprocessor names into a pipeline.
+func parsePipeline(spec string, stopwords map[string]bool) ([]Preprocessor, error) {
+	var pipeline []Preprocessor
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if name == "stopwords" {
+			pipeline = append(pipeline, stopwordFilter(stopwords))
+			continue
+		}
+		p, ok := preprocessors[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown step %q", name)
+		}
+		pipeline = append(pipeline, p)
+	}
+	return pipeline, nil
+}
+
+// `stemSuffixes` are tried in this order. The first suffix that matches is replaced, if at least three letters remain.
+var stemSuffixes = []struct{ suffix, replacement string }{
+	{"ational", "ate"}, {"ization", "ize"}, {"fulness", "ful"}, {"iveness", "ive"}, {"ousness", "ous"},
+	{"ingly", ""}, {"edly", ""}, {"ness", ""}, {"ment", ""}, {"sses", "ss"}, {"ies", "y"},
+	{"ing", ""}, {"ed", ""}, {"ly", ""}, {"s", ""},
+}
+
+func stem(w string) string {
+	for _, s := range stemSuffixes {
+		if !strings.HasSuffix(w, s.suffix) {
+			continue
+		}
+		if s.suffix == "s" && (strings.HasSuffix(w, "ss") || strings.HasSuffix(w, "us") || strings.HasSuffix(w, "is")) {
+			return w
+		}
+		base := strings.TrimSuffix(w, s.suffix)
+		if utf8.RuneCountInString(base) < 3 {
+			return w
+		}
+        // "running" becomes "run", not "runn". Double l, s, and z are kept, as in "falling" or "kissed".
+		if n := len(base); (s.suffix == "ing" || s.suffix == "ed") && base[n-1] == base[n-2] && !strings.ContainsRune("lsz", rune(base[n-1])) {
+			base = base[:n-1]
+		}
+		return base + s.replacement
+	}
+	return w
+}
+
+// These are common English stop words.
+const defaultStopwords = `a about above after again against all am an and any are as at be because been before being below
+between both but by can could did do does doing down during each few for from further had has have having he her here
+hers herself him himself his how i if in into is it its itself just me more most my myself no nor not now of off on once
+only or other our ours ourselves out over own same she should so some such than that the their theirs them themselves
+then there these they this those through to too under until up very was we were what when where which while who whom
+why will with would you your yours yourself yourselves`
+
+// `wordSet` turns a list of words, separated by white space, into a lookup table. The words are lowercased.
+func wordSet(list string) map[string]bool {
+	set := map[string]bool{}
+	for _, w := range strings.Fields(list) {
+		set[strings.ToLower(w)] = true
+	}
+	return set
+}
+
+// These timestamp formats are tried if no `TIMESTAMP_LAYOUT` is given.
+var defaultTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006/01/02 15:04:05",
+	"02/Jan/2006:15:04:05 -0700",
+	time.RFC1123Z,
+	time.RFC1123,
+}
+
+// `parseTimestamp` extracts and parses the timestamp of a line.
+func parseTimestamp(line string, opts *options) (time.Time, bool) {
+	m := opts.timestamp.FindStringSubmatch(line)
+	if m == nil {
+		return time.Time{}, false
+	}
+	for _, layout := range opts.timeLayouts {
+		if t, err := time.Parse(layout, m[1]); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// `groupKey` extracts the group key from a line.
+func groupKey(line string, field *regexp.Regexp) string {
+	m := field.FindStringSubmatch(line)
+	if m == nil || m[1] == "" {
+		return "other"
+	}
+	return m[1]
+}
+
+// Lines are read as a whole in line mode, so they need a limit.
+const maxLineLength = 16 << 20
+
+var digitRuns = regexp.MustCompile(`[0-9]+`)
+
+// `splitLine` splits a line into words, either at white space or by matching the word regular expression. A pre-tokenized line is a single word, without surrounding white space.
+func splitLine(line string, opts *options) []string {
+	if opts.preTokenized {
+		return []string{strings.TrimSpace(line)}
+	}
+	if opts.wordRegex != nil {
+		return opts.wordRegex.FindAllString(line, -1)
+	}
+	return strings.Fields(line)
+}
+
+// A `stripReader` drops unwanted runes from a stream. Invalid UTF-8 bytes are dropped, too, if `dropInvalid` is set, or else passed through unchanged. With `newlines`, it also turns CRLF and lone CR line endings into LF.
+type stripReader struct {
+	r           *bufio.Reader
+	drop        func(rune) bool
+	dropInvalid bool
+	newlines    bool
+	afterCR     bool
+}
+
+func (s *stripReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		r, size, err := s.r.ReadRune()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+		if n+size > len(p) {
+			s.r.UnreadRune()
+			break
+		}
+		if s.newlines {
+			if r == '\n' && s.afterCR {
+				s.afterCR = false
+				continue
+			}
+			s.afterCR = r == '\r'
+			if s.afterCR {
+				r = '\n'
+			}
+		}
+		if r == utf8.RuneError && size == 1 {
+			if s.dropInvalid {
+				continue
+			}
+			s.r.UnreadRune()
+			p[n], _ = s.r.ReadByte()
+			n++
+			continue
+		}
+		if s.drop(r) {
+			continue
+		}
+		n += utf8.EncodeRune(p[n:], r)
+	}
+	return n, nil
+}
+
+// A `metricsReader` passes the text through unchanged while counting its lines, runes, grapheme clusters, and blank lines, and tracking the longest line. Invalid bytes count as one rune each, like in `utf8.RuneCount`. A last line without a line break counts as a line.
+type metricsReader struct {
+	r       *bufio.Reader
+	stats   *fileStats
+	prev    rune
+	riCount int
+	done    bool
+
+    // `lineRunes` is the length of the current line so far, and `line` the start of its text, up to `preview` runes.
+	preview   int
+	lineRunes int
+	line      []byte
+
+    // With `blankSpace`, a line of whitespace counts as blank. `lineText` tells whether the current line has any other characters.
+	blankSpace bool
+	lineText   bool
+
+    // With a `filter`, only the lines that match it count, and the other lines are dropped from the text. `number` is the number of the current line in the file, matching or not, and `pending` the part of the current line that has not been read yet.
+	filter  *regexp.Regexp
+	number  int
+	pending []byte
+}
+
+// `endLine` checks whether the current line is blank, and whether it is the longest so far. Of lines of equal length, the first one wins.
+func (m *metricsReader) endLine() {
+	if m.lineRunes == 0 || m.blankSpace && !m.lineText {
+		m.stats.blank++
+	}
+	if m.stats.longest.number == 0 || m.lineRunes > m.stats.longest.runes {
+		number := m.stats.lines
+		if m.filter != nil {
+			number = m.number
+		}
+		m.stats.longest = longLine{number: number, runes: m.lineRunes, preview: string(m.line)}
+	}
+	m.lineRunes = 0
+	m.lineText = false
+	m.line = m.line[:0]
+}
+
+func (m *metricsReader) Read(p []byte) (int, error) {
+	if m.filter != nil {
+		return m.readFiltered(p)
+	}
+	n := 0
+	for n < len(p) {
+		r, size, err := m.r.ReadRune()
+		if err != nil {
+			if err == io.EOF && !m.done {
+				m.done = true
+				if m.stats.runes > 0 && m.prev != '\n' {
+					m.stats.lines++
+					m.endLine()
+				}
+			}
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+		if n+size > len(p) {
+			m.r.UnreadRune()
+			break
+		}
+		if r == utf8.RuneError && size == 1 {
+			m.r.UnreadRune()
+			p[n], _ = m.r.ReadByte()
+		} else {
+			utf8.EncodeRune(p[n:], r)
+		}
+		n += size
+		m.add(r, p[n-size:n])
+	}
+	return n, nil
+}
+
+// `readFiltered` reads the text line by line, like the scanner in line mode does, and passes on only the lines that match the filter, so that the metrics cover the same lines as the word count.
+func (m *metricsReader) readFiltered(p []byte) (int, error) {
+	for len(m.pending) == 0 {
+		if m.done {
+			return 0, io.EOF
+		}
+		line, err := m.r.ReadSlice('\n')
+		for err == bufio.ErrBufferFull && len(line) <= maxLineLength {
+			var more []byte
+			more, err = m.r.ReadSlice('\n')
+			line = append(line[:len(line):len(line)], more...)
+		}
+		switch {
+		case err == io.EOF:
+			m.done = true
+		case err == bufio.ErrBufferFull:
+			return 0, bufio.ErrTooLong
+		case err != nil:
+			return 0, err
+		}
+		if len(line) == 0 {
+			continue
+		}
+		m.number++
+		text := bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+		if !m.filter.Match(text) {
+			continue
+		}
+		for i := 0; i < len(line); {
+			r, size := utf8.DecodeRune(line[i:])
+			m.add(r, line[i:i+size])
+			i += size
+		}
+		if line[len(line)-1] != '\n' {
+			m.stats.lines++
+			m.endLine()
+		}
+		m.pending = append(m.pending[:0], line...)
+	}
+	n := copy(p, m.pending)
+	m.pending = m.pending[n:]
+	return n, nil
+}
+
+// `add` counts the rune `r`, whose encoding in the text is `b`.
+func (m *metricsReader) add(r rune, b []byte) {
+	m.stats.runes++
+	if m.stats.alphabet != nil && !unicode.IsSpace(r) {
+		m.stats.alphabet[r] = true
+	}
+	if r == '\n' {
+		m.stats.lines++
+		m.endLine()
+	} else {
+		if m.lineRunes < m.preview {
+			m.line = append(m.line, b...)
+		}
+		m.lineRunes++
+		m.lineText = m.lineText || !unicode.IsSpace(r)
+	}
+	if isRegionalIndicator(r) {
+		m.riCount++
+	} else {
+		m.riCount = 0
+	}
+	if m.stats.runes == 1 || !extendsGrapheme(m.prev, r, m.riCount) {
+		m.stats.graphemes++
+	}
+	m.prev = r
+}
+
+// `extendsGrapheme` reports whether `r` belongs to the same grapheme cluster as the preceding rune `prev`. This covers the common cases of Unicode's segmentation rules: CRLF, combining marks, variation selectors, emoji modifiers and tags, zero width joiner sequences, and flags, which are pairs of regional indicators. `riCount` is the number of consecutive regional indicators up to and including `r`.
+func extendsGrapheme(prev, r rune, riCount int) bool {
+	switch {
+	case prev == '\r' && r == '\n':
+		return true
+	case unicode.IsControl(prev), unicode.IsControl(r):
+		return false
+	case unicode.Is(unicode.M, r), r == '\u200D', r >= 0x1F3FB && r <= 0x1F3FF, r >= 0xE0020 && r <= 0xE007F:
+		return true
+	case prev == '\u200D':
+		return true
+	case riCount > 0:
+		return riCount%2 == 0
+	}
+	return false
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+type delimiters struct {
+	open, close rune
+}
+
+// A `withinReader` passes on only the text between delimiters. Line breaks are always passed on, to keep the lines intact, and delimiters turn into spaces, so that they still separate words. If both delimiters are the same, like quotes, they simply alternate.
+type withinReader struct {
+	r *bufio.Reader
+	delimiters
+	depth int
+}
+
+func (w *withinReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		r, size, err := w.r.ReadRune()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+		closing := r == w.close && w.depth > 0
+		opening := !closing && r == w.open
+		if !closing && !opening && w.depth == 0 && r != '\n' {
+			continue
+		}
+		if n+size > len(p) {
+			w.r.UnreadRune()
+			break
+		}
+		switch {
+		case closing:
+			w.depth--
+			n += copy(p[n:], " ")
+			continue
+		case opening:
+			w.depth++
+			n += copy(p[n:], " ")
+			continue
+		}
+		if r == utf8.RuneError && size == 1 {
+			w.r.UnreadRune()
+			p[n], _ = w.r.ReadByte()
+			n++
+			continue
+		}
+		n += utf8.EncodeRune(p[n:], r)
+	}
+	return n, nil
+}
+
+// `transliterate` wraps a reader with one that removes accents. It is nil in builds without the `xtext` tag.
+var transliterate func(r io.Reader) io.Reader
+
+// `asciiLetters` maps letters that have no decomposition to the closest ASCII letter.
+var asciiLetters = map[rune]rune{
+	'ø': 'o', 'Ø': 'O', 'ł': 'l', 'Ł': 'L', 'đ': 'd', 'Đ': 'D', 'ħ': 'h', 'Ħ': 'H', 'ı': 'i',
+}
+
+// `isValidUTF8` checks a stream for invalid UTF-8 without reading it into memory at once. A rune that is cut off at the end of a block is carried over to the next block.
+func isValidUTF8(r io.Reader) (bool, error) {
+	buf := make([]byte, 64*1024)
+	carry := 0
+	for {
+		n, err := r.Read(buf[carry:])
+		n += carry
+		end := n
+		if err == nil {
+			for i := n - 1; i >= 0 && i >= n-utf8.UTFMax; i-- {
+				if utf8.RuneStart(buf[i]) {
+					if !utf8.FullRune(buf[i:n]) {
+						end = i
+					}
+					break
+				}
+			}
+		}
+		if !utf8.Valid(buf[:end]) {
+			return false, nil
+		}
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		carry = copy(buf, buf[end:n])
+	}
+}
+
+// `isStrayControl` matches the byte order mark and control characters. Whitespace control characters like tabs and line breaks separate words and are kept.
+func isStrayControl(r rune) bool {
+	return r == '\uFEFF' || unicode.IsControl(r) && !unicode.IsSpace(r)
+}
+
+// `splitList` splits a comma-separated list and drops empty entries. An empty list is nil.
+func splitList(list string) []string {
+	var entries []string
+	for _, e := range strings.Split(list, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// `trimAffixes` removes the prefixes from the start of `word` and the suffixes from its end until none is left.
+func trimAffixes(word string, prefixes, suffixes []string) string {
+	for trimmed := true; trimmed && word != ""; {
+		trimmed = false
+		for _, p := range prefixes {
+			if strings.HasPrefix(word, p) {
+				word, trimmed = word[len(p):], true
+			}
+		}
+		for _, s := range suffixes {
+			if strings.HasSuffix(word, s) {
+				word, trimmed = word[:len(word)-len(s)], true
+			}
+		}
+	}
+	return word
+}
+
+// `listAlphabet` returns up to `n` of the characters in `set`, in the order of their code points.
+func listAlphabet(set map[rune]bool, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	chars := make([]rune, 0, len(set))
+	for r := range set {
+		chars = append(chars, r)
+	}
+	slices.Sort(chars)
+	return string(chars[:min(n, len(chars))])
+}
+
+// `isAlpha` reports whether `word` consists of letters only. Runes from `inner` are allowed if they sit between two letters.
+func isAlpha(word, inner string) bool {
+	runes := []rune(word)
+	for i, r := range runes {
+		if unicode.IsLetter(r) {
+			continue
+		}
+		if i == 0 || i == len(runes)-1 || !strings.ContainsRune(inner, r) {
+			return false
+		}
+		if !unicode.IsLetter(runes[i-1]) || !unicode.IsLetter(runes[i+1]) {
+			return false
+		}
+	}
+	return len(runes) > 0
+}
+
+// A `report` is the content of "count.json". `reportSchemaVersion` changes whenever a change to the structure could break consumers.
+const reportSchemaVersion = 1
+
+type report struct {
+	SchemaVersion int    `json:"schema_version"`
+	Version       string `json:"version,omitempty"`
+
+	Total   int           `json:"total"`
+	Numbers int           `json:"numbers,omitempty"`
+	Bytes   int64         `json:"bytes"`
+	Records int           `json:"records,omitempty"`
+	Entropy float64       `json:"entropy,omitempty"`
+	Files   []fileCount   `json:"files"`
+	Skipped []skippedFile `json:"skipped,omitempty"`
+	Memory  *memoryPeaks  `json:"memory,omitempty"`
+
+	AlphabetSize int    `json:"alphabet_size,omitempty"`
+	Alphabet     string `json:"alphabet,omitempty"`
+
+	Warnings []warning `json:"warnings,omitempty"`
+
+	Fingerprint string `json:"fingerprint,omitempty"`
+
+    // `LimitReached` is true if `MAX_FILES` stopped the job before all files were counted.
+	LimitReached bool `json:"limit_reached,omitempty"`
+}
+
+// A `skippedFile` is a file that was not counted, for the given reason.
+type skippedFile struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// A `warning` is a problem that did not stop the job but may affect the results. `File` is empty for warnings about the run as a whole.
+type warning struct {
+	File    string `json:"file,omitempty"`
+	Message string `json:"message"`
+}
+
+// `warnings` collects the warnings of the run, in order.
+var warnings []warning
+
+// `warn` logs a warning and records it.
+func warn(file, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	if file != "" {
+		log.Printf("%s: %s", file, msg)
+	} else {
+		log.Print(msg)
+	}
+	warnings = append(warnings, warning{File: file, Message: msg})
+}
+
+// A `nameHasher` anonymizes file names, if enabled. The same name always gets the same hash, so that results of different runs can still be compared.
+type nameHasher struct {
+	enabled bool
+	salt    string
+	mapping map[string]string
+}
+
+func (h *nameHasher) hash(name string) string {
+	if !h.enabled {
+		return name
+	}
+	sum := sha256.Sum256([]byte(h.salt + name))
+	hashed := hex.EncodeToString(sum[:])
+	h.mapping[hashed] = name
+	return hashed
+}
+
+// `writeMapping` writes the hash-to-name mapping directly to `path`, bypassing the output files, so that the mapping doesn't end up in the results by accident.
+func (h *nameHasher) writeMapping(path string) error {
+	data, err := json.MarshalIndent(h.mapping, "", "  ")
+	if err != nil {
+		return fmt.Errorf("writeMapping: %w", err)
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// `isWithin` reports whether `path` is `dir` or lies below it. Both are made absolute and cleaned first, so that "/outputs/../outputs/x" is caught, too.
+func isWithin(dir, path string) bool {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// `readFileList` reads a list of file paths from a file.
+func readFileList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("readFileList: %w", err)
+	}
+	defer f.Close()
+
+	paths, err := readPaths(f)
+	if err != nil {
+		return nil, fmt.Errorf("readFileList: %w", err)
+	}
+	return paths, nil
+}
+
+// `readPaths` reads file paths from a stream, one per line. Blank lines are ignored.
+func readPaths(r io.Reader) ([]string, error) {
+	var paths []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if p := strings.TrimSpace(scanner.Text()); p != "" {
+			paths = append(paths, filepath.Clean(p))
+		}
+	}
+	return paths, scanner.Err()
+}
+
+// `ignoreFileName` is the name of the ignore file in the input directory.
+const ignoreFileName = ".wordcountignore"
+
+// `ignoreRules` decides which paths an ignore file excludes.
+type ignoreRules struct {
+	rules []ignoreRule
+}
+
+// An `ignoreRule` is one pattern of an ignore file, split at the slashes.
+type ignoreRule struct {
+	parts    []string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// `readIgnoreFile` reads the rules of an ignore file. If there is no such file, it returns nil rules.
+func readIgnoreFile(file string) (*ignoreRules, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("readIgnoreFile: %w", err)
+	}
+	ig := &ignoreRules{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var r ignoreRule
+		if strings.HasPrefix(line, "!") {
+			r.negate, line = true, line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly, line = true, strings.TrimRight(line, "/")
+		}
+		r.anchored = strings.Contains(line, "/")
+		r.parts = strings.Split(strings.TrimPrefix(line, "/"), "/")
+		for _, p := range r.parts {
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("readIgnoreFile: %q: %w", line, err)
+			}
+		}
+		ig.rules = append(ig.rules, r)
+	}
+	return ig, nil
+}
+
+// `ignored` reports whether a file or, with `dir`, a directory is excluded. The path is relative to the input directory and uses slashes. A file in an excluded directory is always excluded. Nil rules exclude nothing.
+func (ig *ignoreRules) ignored(p string, dir bool) bool {
+	if ig == nil {
+		return false
+	}
+	parts := strings.Split(p, "/")
+	for i := 1; i < len(parts); i++ {
+		if ig.match(parts[:i], true) {
+			return true
+		}
+	}
+	return ig.match(parts, dir)
+}
+
+// `match` applies all rules to a path. The last matching rule decides.
+func (ig *ignoreRules) match(parts []string, dir bool) bool {
+	ignored := false
+	for _, r := range ig.rules {
+		if r.dirOnly && !dir {
+			continue
+		}
+        // A pattern without a slash only needs to match the last name, as `ignored` checks each parent directory separately.
+		target := parts
+		if !r.anchored {
+			target = parts[len(parts)-1:]
+		}
+		if matchParts(r.parts, target) {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
+
+// `matchParts` matches path elements against pattern elements, where "**" matches any number of elements.
+func matchParts(pattern, parts []string) bool {
+	if len(pattern) == 0 {
+		return len(parts) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(parts); i++ {
+			if matchParts(pattern[1:], parts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(parts) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], parts[0])
+	return ok && matchParts(pattern[1:], parts[1:])
+}
+
+// `readURLList` reads URLs from a file, one per line. Blank lines are ignored.
+func readURLList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("readURLList: %w", err)
+	}
+	defer f.Close()
+
+	var urls []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if u := strings.TrimSpace(scanner.Text()); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("readURLList: %w", err)
+	}
+	return urls, nil
+}
+
+// A `urlFetcher` downloads documents into a temporary directory, so that they can be counted like files.
+type urlFetcher struct {
+	client *http.Client
+	dir    string
+}
+
+func newURLFetcher(timeout time.Duration) (*urlFetcher, error) {
+	dir, err := os.MkdirTemp("", "bacalhau-urls-")
+	if err != nil {
+		return nil, fmt.Errorf("newURLFetcher: %w", err)
+	}
+	return &urlFetcher{client: &http.Client{Timeout: timeout}, dir: dir}, nil
+}
+
+// `fetch` downloads the document at `url` and returns the path of the downloaded file. The file keeps the extension of the URL path, so that file handlers apply, and the modification time from the "Last-Modified" header, if any. The error explains why the document is not available, without the URL.
+func (u *urlFetcher) fetch(url string) (string, error) {
+	resp, err := u.client.Get(url)
+	if err != nil {
+		return "", downloadError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	f, err := os.CreateTemp(u.dir, "doc-*"+path.Ext(resp.Request.URL.Path))
+	if err != nil {
+		return "", fmt.Errorf("fetch: %w", err)
+	}
+	_, err = io.Copy(f, resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		var perr *fs.PathError
+		if errors.As(err, &perr) {
+			return "", fmt.Errorf("fetch: %w", err)
+		}
+		return "", downloadError(err)
+	}
+	if mt, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		os.Chtimes(f.Name(), mt, mt)
+	}
+	return f.Name(), nil
+}
+
+// `downloadError` names the class of a network error only. The errors of `net/http` contain the URL, which must not end up in the results or the log, as it would reveal the document with `HASH_FILENAMES`.
+func downloadError(err error) error {
+	var nerr net.Error
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &nerr) && nerr.Timeout():
+		return errors.New("download failed: timeout")
+	case errors.As(err, &dnsErr):
+		return errors.New("download failed: host not found")
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return errors.New("download failed: connection refused")
+	default:
+		return errors.New("download failed: network error")
+	}
+}
+
+// `remove` deletes the temporary directory.
+func (u *urlFetcher) remove() error {
+	if u == nil {
+		return nil
+	}
+	return os.RemoveAll(u.dir)
+}
+
+// A `columnSpec` selects the text columns of delimited data.
+type columnSpec struct {
+	indices []int
+	delim   rune
+	header  bool
+}
+
+func parseColumnSpec(list, delim string, header bool) (*columnSpec, error) {
+	c := &columnSpec{delim: ',', header: header}
+	switch {
+	case delim == "tab":
+		c.delim = '\t'
+	case utf8.RuneCountInString(delim) == 1:
+		c.delim, _ = utf8.DecodeRuneInString(delim)
+	case delim != "":
+		return nil, fmt.Errorf("delimiter %q is not a single character", delim)
+	}
+	for _, f := range strings.Split(list, ",") {
+		i, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || i < 0 {
+			return nil, fmt.Errorf("%q is not a column index", f)
+		}
+		c.indices = append(c.indices, i)
+	}
+	return c, nil
+}
+
+// `text` streams the selected fields of each row, one per line. Rows that are too short to have a column just lack that field. A malformed row ends the stream with an error.
+func (c *columnSpec) text(r io.Reader) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		cr := csv.NewReader(r)
+		cr.Comma = c.delim
+		cr.FieldsPerRecord = -1
+		cr.ReuseRecord = true
+		w := bufio.NewWriter(pw)
+		for first := true; ; first = false {
+			row, err := cr.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if first && c.header {
+				continue
+			}
+			for _, i := range c.indices {
+				if i < len(row) {
+					w.WriteString(row[i])
+					w.WriteByte('\n')
+				}
+			}
+		}
+		pw.CloseWithError(w.Flush())
+	}()
+	return pr
+}
+
+// `changedLines` returns the lines of `r` that are not in the old version of the file at `oldPath`. Both versions are read into memory for the diff.
+func changedLines(oldPath string, r io.Reader) (io.Reader, error) {
+	newData, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("changedLines: %w", err)
+	}
+	oldData, err := os.ReadFile(oldPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return bytes.NewReader(newData), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("changedLines: %w", err)
+	}
+	a, b := strings.Split(string(oldData), "\n"), strings.Split(string(newData), "\n")
+	var out strings.Builder
+	for i, added := range diffLines(a, b) {
+		if added {
+			out.WriteString(b[i])
+			out.WriteByte('\n')
+		}
+	}
+	return strings.NewReader(out.String()), nil
+}
+
+// `maxDiffEdits` bounds the work of `diffLines`. Beyond this many differences, the versions are too different for a meaningful diff.
+const maxDiffEdits = 2000
+
+// `diffLines` reports for each line of `b` whether it was added to or changed from `a`. The common start and end are matched first, which is all it takes for a file that only grows. The rest is compared with Myers' algorithm, which finds the shortest edit script. If that has more than `maxDiffEdits` edits, all lines in between count as changed.
+func diffLines(a, b []string) []bool {
+	added := make([]bool, len(b))
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	a, b = a[pre:len(a)-suf], b[pre:len(b)-suf]
+	ins := added[pre : pre+len(b)]
+
+	n, m := len(a), len(b)
+	maxD := min(n+m, maxDiffEdits)
+    // `v[k]` is the furthest x on diagonal k = x - y, stored at index k + maxD + 1. `trace` keeps a copy for each d, to find the way back.
+	off := maxD + 1
+	v := make([]int, 2*maxD+3)
+	var trace [][]int
+	for d := 0; d <= maxD; d++ {
+		trace = append(trace, slices.Clone(v[off-d-1:off+d+2]))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				markInsertions(trace, n, m, ins)
+				return added
+			}
+		}
+	}
+	for i := range ins {
+		ins[i] = true
+	}
+	return added
+}
+
+// `markInsertions` walks back from the end through the trace of `diffLines` and marks the lines of `b` that the edit script inserts.
+func markInsertions(trace [][]int, x, y int, ins []bool) {
+	for d := len(trace) - 1; d > 0; d-- {
+        // `trace[d]` holds the diagonals -d-1 to d+1 as they were before step d.
+		v := func(k int) int { return trace[d][k+d+1] }
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && v(k-1) < v(k+1)) {
+			prevK = k + 1
+		}
+		prevX := v(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+		}
+		if x == prevX {
+			ins[prevY] = true
+		}
+		x, y = prevX, prevY
+	}
+}
+
+// `extensionKey` returns the lowercase extension of a file name, or "(none)".
+func extensionKey(name string) string {
+	if ext := strings.ToLower(filepath.Ext(name)); ext != "" {
+		return ext
+	}
+	return "(none)"
+}
+
+// `readManifest` reads the paths and labels from the given columns of a CSV file.
+func readManifest(path string, pathCol, labelCol int, header bool) (paths, labels []string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("readManifest: %w", err)
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.ReuseRecord = true
+	for line := 1; ; line++ {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("readManifest: %w", err)
+		}
+		if header && line == 1 {
+			continue
+		}
+		if pathCol < 0 || pathCol >= len(row) || labelCol < 0 || labelCol >= len(row) {
+			return nil, nil, fmt.Errorf("readManifest: line %d has %d columns", line, len(row))
+		}
+		p := strings.TrimSpace(row[pathCol])
+		if p == "" {
+			continue
+		}
+		paths = append(paths, filepath.Clean(p))
+		labels = append(labels, strings.TrimSpace(row[labelCol]))
+	}
+	return paths, labels, nil
+}
+
+// `countRecords` counts the elements of a JSON array without decoding them. Anything other than a single, well-formed array is an error.
+func countRecords(r io.Reader) (int, error) {
+	dec := json.NewDecoder(r)
+	tok, err := dec.Token()
+	if err != nil {
+		return 0, fmt.Errorf("countRecords: %w", err)
+	}
+	if tok != json.Delim('[') {
+		return 0, fmt.Errorf("countRecords: not a JSON array")
+	}
+	n := 0
+	for dec.More() {
+        // Skip one element, tracking the nesting depth of objects and arrays within it.
+		depth := 0
+		for {
+			tok, err := dec.Token()
+			if err != nil {
+				return 0, fmt.Errorf("countRecords: record %d: %w", n+1, err)
+			}
+			switch tok {
+			case json.Delim('['), json.Delim('{'):
+				depth++
+			case json.Delim(']'), json.Delim('}'):
+				depth--
+			}
+			if depth == 0 {
+				break
+			}
+		}
+		n++
+	}
+    // Consume the closing bracket, and make sure that nothing follows.
+	if _, err := dec.Token(); err != nil {
+		return 0, fmt.Errorf("countRecords: %w", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return 0, fmt.Errorf("countRecords: unexpected data after the array")
+	}
+	return n, nil
+}
+
+// `sizeOutOfRange` returns the reason for skipping a file of the given size, or "" if the size is within the limits.
+func sizeOutOfRange(size, minSize, maxSize int64) string {
+	switch {
+	case minSize > 0 && size < minSize:
+		return fmt.Sprintf("size %d below MIN_FILE_BYTES %d", size, minSize)
+	case maxSize > 0 && size > maxSize:
+		return fmt.Sprintf("size %d above MAX_FILE_BYTES %d", size, maxSize)
+	}
+	return ""
+}
+
+type fileCount struct {
+	Name    string `json:"name"`
+	Words   int    `json:"words"`
+	Numbers int    `json:"numbers,omitempty"`
+	Bytes   int64  `json:"bytes,omitempty"`
+	Skipped bool   `json:"skipped,omitempty"`
+	Empty   bool   `json:"empty,omitempty"`
+	Records int    `json:"records,omitempty"`
+	Label   string `json:"label,omitempty"`
+	ModTime string `json:"mtime,omitempty"`
+
+	WordsPerKB float64 `json:"words_per_kb,omitempty"`
+
+	Shapes map[string]int `json:"shapes,omitempty"`
+
+	AlphabetSize int    `json:"alphabet_size,omitempty"`
+	Alphabet     string `json:"alphabet,omitempty"`
+
+	Entropy float64 `json:"entropy,omitempty"`
+
+	TopWord      string `json:"top_word,omitempty"`
+	TopWordCount int    `json:"top_word_count,omitempty"`
+
+	Lines     int `json:"lines,omitempty"`
+	Runes     int `json:"runes,omitempty"`
+	Graphemes int `json:"graphemes,omitempty"`
+
+	LongestLine        int    `json:"longest_line,omitempty"`
+	LongestLineNumber  int    `json:"longest_line_number,omitempty"`
+	LongestLinePreview string `json:"longest_line_preview,omitempty"`
+
+	BlankLines int     `json:"blank_lines,omitempty"`
+	BlankRatio float64 `json:"blank_line_ratio,omitempty"`
+
+	Sentences        int     `json:"sentences,omitempty"`
+	WordsPerSentence float64 `json:"words_per_sentence,omitempty"`
+
+	FirstTimestamp string `json:"first_timestamp,omitempty"`
+	LastTimestamp  string `json:"last_timestamp,omitempty"`
+}
+
+// `counted` returns the number of files that were actually counted.
+func (r *report) counted() int {
+	n := 0
+	for _, f := range r.Files {
+		if !f.Skipped {
+			n++
+		}
+	}
+	return n
+}
+
+// `reduceReports` merges the reports and frequency tables in the given files. The files are split into contiguous shares, one for each worker, which reads and merges its share into a partial result; with thousands of files, this is where the time goes. The partial results are then merged in the order of the shares, so the report is the same as if the files had been merged one by one in the order of `names`, no matter which worker finishes first. Frequencies are added up, which does not depend on the order at all. The frequency map is nil if there are no frequency tables.
+func reduceReports(dir string, names []string, workers int) (*report, map[string]int, error) {
+	workers = max(min(workers, len(names)), 1)
+	parts := make([]reduction, workers)
+	var wg sync.WaitGroup
+	for w := range parts {
+		part := &parts[w]
+		share := names[w*len(names)/workers : (w+1)*len(names)/workers]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			*part = reduceShare(dir, share)
+		}()
+	}
+	wg.Wait()
+
+	merged := reduction{report: &report{SchemaVersion: reportSchemaVersion, Version: version, Files: []fileCount{}}}
+	for _, part := range parts {
+		if part.err != nil {
+			return nil, nil, part.err
+		}
+		merged.add(part)
+	}
+    // Files of the same name may come from different nodes. The stable sort keeps them in the order of their reports.
+	sort.SliceStable(merged.report.Files, func(i, j int) bool { return merged.report.Files[i].Name < merged.report.Files[j].Name })
+	return merged.report, merged.freq, nil
+}
+
+// A `reduction` is the merged result of some of the input files of the reduce mode.
+type reduction struct {
+	report *report
+	freq   map[string]int
+	err    error
+}
+
+// `add` merges another partial result into `r`.
+func (r *reduction) add(o reduction) {
+	r.report.add(o.report)
+	if o.freq != nil && r.freq == nil {
+		r.freq = map[string]int{}
+	}
+	for word, n := range o.freq {
+		r.freq[word] += n
+	}
+}
+
+// `reduceShare` reads and merges the given files in order. It stops at the first file that can't be read.
+func reduceShare(dir string, names []string) reduction {
+	part := reduction{report: &report{}}
+	for _, name := range names {
+		rep, words, err := readReduceInput(filepath.Join(dir, name))
+		if err != nil {
+			part.err = err
+			return part
+		}
+		if rep != nil {
+			part.report.add(rep)
+			continue
+		}
+		if part.freq == nil {
+			part.freq = map[string]int{}
+		}
+		for _, wc := range words {
+			part.freq[wc.Word] += wc.Count
+		}
+	}
+	return part
+}
+
+// `readReduceInput` reads an input file of the reduce mode. A file that holds a JSON array is a frequency table, any other file a report.
+func readReduceInput(path string) (*report, []wordCount, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("readReport: %w", err)
+	}
+	if bytes.HasPrefix(bytes.TrimLeft(data, " \t\r\n"), []byte("[")) {
+		var words []wordCount
+		if err := json.Unmarshal(data, &words); err != nil {
+			return nil, nil, fmt.Errorf("readFreqTable: %s: %w", path, err)
+		}
+		return nil, words, nil
+	}
+	rep := &report{}
+	if err := json.Unmarshal(data, rep); err != nil {
+		return nil, nil, fmt.Errorf("readReport: %s: %w", path, err)
+	}
+	return rep, nil, nil
+}
+
+// `add` merges another report into `r`.
+func (r *report) add(o *report) {
+	r.Total += o.Total
+	r.Numbers += o.Numbers
+	r.Bytes += o.Bytes
+	r.Records += o.Records
+	r.Files = append(r.Files, o.Files...)
+	r.Skipped = append(r.Skipped, o.Skipped...)
+	r.Warnings = append(r.Warnings, o.Warnings...)
+}
+
+// `sortFiles` sorts the per-file results by "name" or "words". An empty key keeps the order as is. Files with the same word count are always sorted by ascending name.
+func sortFiles(files []fileCount, by string, desc bool) {
+	if by == "" {
+		return
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		a, b := files[i], files[j]
+		if by == "words" && a.Words != b.Words {
+			return (a.Words < b.Words) != desc
+		}
+		if by == "name" && desc {
+			return a.Name > b.Name
+		}
+		return a.Name < b.Name
+	})
+}
+
+// `orderEntries` sorts the file paths, relative to `dir`, by "name", "size", or "mtime". The labels, if any, are kept in line with their paths. Files that cannot be found sort as empty and old; they are reported when they are counted.
+func orderEntries(dir string, entries, labels []string, by string, desc bool) ([]string, []string, error) {
+	type entry struct {
+		path, label string
+		size        int64
+		mtime       time.Time
+	}
+	es := make([]entry, len(entries))
+	for i, p := range entries {
+		es[i].path = p
+		if labels != nil {
+			es[i].label = labels[i]
+		}
+		if by == "name" {
+			continue
+		}
+		fi, err := os.Stat(filepath.Join(dir, p))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("orderEntries: %w", err)
+		}
+		es[i].size, es[i].mtime = fi.Size(), fi.ModTime()
+	}
+	sort.SliceStable(es, func(i, j int) bool {
+		a, b := es[i], es[j]
+		switch {
+		case by == "size" && a.size != b.size:
+			return (a.size < b.size) != desc
+		case by == "mtime" && !a.mtime.Equal(b.mtime):
+			return a.mtime.Before(b.mtime) != desc
+		case by == "name" && desc:
+			return a.path > b.path
+		}
+		return a.path < b.path
+	})
+	for i, e := range es {
+		entries[i] = e.path
+		if labels != nil {
+			labels[i] = e.label
+		}
+	}
+	return entries, labels, nil
+}
+
+// `countOutputs` writes the counts in all requested formats.
+type countOutputs struct {
+	sortBy     string
+	sortDesc   bool
+	prometheus bool
+	formats    []string
+
+    // `shards` is the number of JSON files that the per-file results are spread over.
+	shards int
+
+    // With `perFile`, each file's result goes to a JSON file of its own.
+	perFile bool
+
+    // If `outliers` is not nil, files with unusual word counts are listed separately.
+	outliers *outlierRule
+
+	validate bool
+}
+
+// `countWriters` maps the names of extra output formats to their writers. Optional formats register themselves here.
+var countWriters = map[string]func(*outputFiles, *report) error{
+	"yaml":       writeYAML,
+	"properties": writeProperties,
+}
+
+// `writeYAML` writes the report to "count.yaml". YAML is a superset of JSON, so the JSON encoding is just restated in block style, with the fields in the same order. Strings stay double-quoted, which avoids YAML's many special cases for plain strings.
+func writeYAML(outputs *outputFiles, r *report) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("writeYAML: %w", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	root, err := decodeYAMLNode(dec)
+	if err != nil {
+		return fmt.Errorf("writeYAML: %w", err)
+	}
+	out, err := outputs.create("count.yaml")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	writeYAMLMap(w, root.(*yamlMap), "", "")
+	if err := w.Flush(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// A `yamlMap` is a JSON object that keeps its keys in order. Scalars are kept as their YAML text, and arrays as `[]any`.
+type yamlMap struct {
+	keys   []string
+	values []any
+}
+
+func decodeYAMLNode(dec *json.Decoder) (any, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := tok.(type) {
+	case json.Delim:
+		if t == '{' {
+			m := &yamlMap{}
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				v, err := decodeYAMLNode(dec)
+				if err != nil {
+					return nil, err
+				}
+				m.keys = append(m.keys, key.(string))
+				m.values = append(m.values, v)
+			}
+			_, err := dec.Token()
+			return m, err
+		}
+		items := []any{}
+		for dec.More() {
+			v, err := decodeYAMLNode(dec)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v)
+		}
+		_, err := dec.Token()
+		return items, err
+	case string:
+		return strconv.Quote(t), nil
+	case json.Number:
+		return t.String(), nil
+	case bool:
+		return strconv.FormatBool(t), nil
+	}
+	return "null", nil
+}
+
+// `writeYAMLMap` writes the keys of `m` at the given indentation. The first key gets the prefix `first` instead, to continue a list item.
+func writeYAMLMap(w *bufio.Writer, m *yamlMap, first, indent string) {
+	for i, k := range m.keys {
+		prefix := indent
+		if i == 0 {
+			prefix = first
+		}
+		w.WriteString(prefix + yamlKey(k) + ":")
+		writeYAMLValue(w, m.values[i], indent)
+	}
+}
+
+// `writeYAMLValue` writes a value behind a key or a list marker.
+func writeYAMLValue(w *bufio.Writer, v any, indent string) {
+	switch v := v.(type) {
+	case *yamlMap:
+		if len(v.keys) == 0 {
+			w.WriteString(" {}\n")
+			return
+		}
+		w.WriteString("\n")
+		writeYAMLMap(w, v, indent+"  ", indent+"  ")
+	case []any:
+		if len(v) == 0 {
+			w.WriteString(" []\n")
+			return
+		}
+		w.WriteString("\n")
+		for _, item := range v {
+			if m, ok := item.(*yamlMap); ok && len(m.keys) > 0 {
+				writeYAMLMap(w, m, indent+"  - ", indent+"    ")
+				continue
+			}
+			w.WriteString(indent + "  -")
+			writeYAMLValue(w, item, indent+"  ")
+		}
+	default:
+		w.WriteString(" " + v.(string) + "\n")
+	}
+}
+
+var yamlPlainKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// `yamlKey` quotes keys that would otherwise be read as something else than a string, like `yes` or `null`.
+func yamlKey(k string) string {
+	switch strings.ToLower(k) {
+	case "y", "n", "yes", "no", "on", "off", "true", "false", "null":
+		return strconv.Quote(k)
+	}
+	if yamlPlainKey.MatchString(k) {
+		return k
+	}
+	return strconv.Quote(k)
+}
+
+// `writeProperties` writes the word count of each file to "count.properties", in the format of Java's `.properties` files, and the total as "__total__". Skipped files are left out.
+func writeProperties(outputs *outputFiles, r *report) error {
+	out, err := outputs.create("count.properties")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	fmt.Fprintf(w, "__total__=%d\n", r.Total)
+	for _, f := range r.Files {
+		if !f.Skipped {
+			fmt.Fprintf(w, "%s=%d\n", propertiesKey(f.Name), f.Words)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// `propertiesKey` escapes the characters that would end a key or start a comment, and the line breaks. Readers decode `.properties` files as ISO 8859-1, so everything other than ASCII is written as `\uXXXX`, with surrogate pairs beyond the Basic Multilingual Plane.
+func propertiesKey(k string) string {
+	var b strings.Builder
+	for _, r := range k {
+		switch r {
+		case '\\', ' ', '=', ':', '#', '!':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\f':
+			b.WriteString(`\f`)
+		default:
+			if r >= 0x20 && r < 0x7f {
+				b.WriteRune(r)
+				continue
+			}
+			for _, u := range utf16.Encode([]rune{r}) {
+				fmt.Fprintf(&b, `\u%04X`, u)
+			}
+		}
+	}
+	return b.String()
+}
+
+func (c *countOutputs) write(outputs *outputFiles, r *report) error {
+    // "summary.txt" sums up the run in a single line that tools can grep, whatever the other outputs look like.
+	if err := writeSummary(outputs, r); err != nil {
+		return err
+	}
+
+    // File-specific counts go to "count.txt".
+	sortFiles(r.Files, c.sortBy, c.sortDesc)
+	if err := writeCountText(outputs, r.Files); err != nil {
+		return err
+	}
+
+    // The same results go to "count.json", for further processing by other tools, or by a later run of this job.
+	switch {
+	case c.perFile:
+		for _, f := range r.Files {
+			name := f.Name + ".json"
+            // Names from a file list or URLs may point anywhere. Only names that stay within the output directory are safe.
+			if !filepath.IsLocal(name) {
+				return fmt.Errorf("SPLIT_OUTPUT: %q is not a valid output path", f.Name)
+			}
+			if err := writeJSON(outputs, filepath.Join("counts", name), f); err != nil {
+				return err
+			}
+		}
+	case c.shards <= 1:
+		if err := c.writeReport(outputs, "count.json", r); err != nil {
+			return err
+		}
+	default:
+		for i, shard := range shardReport(r, c.shards) {
+			if err := c.writeReport(outputs, fmt.Sprintf("count-%d.json", i), shard); err != nil {
+				return err
+			}
+		}
+	}
+
+	if c.prometheus {
+		if err := writePrometheus(outputs, r); err != nil {
+			return err
+		}
+	}
+	for _, format := range c.formats {
+		if err := countWriters[format](outputs, r); err != nil {
+			return err
+		}
+	}
+
+	if c.outliers != nil {
+		if err := writeJSON(outputs, "outliers.json", c.outliers.find(r.Files)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// `writeReport` writes a report as JSON, after validating it if requested.
+func (c *countOutputs) writeReport(outputs *outputFiles, name string, r *report) error {
+	if c.validate {
+		data, err := json.Marshal(r)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if err := validateReport(data); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return writeJSON(outputs, name, r)
+}
+
+// `validateReport` checks the JSON encoding of a report for the fields that consumers rely on, and their types. This is a self-check that guards against accidental changes to the structure, not a full JSON schema validation.
+func validateReport(data []byte) error {
+	var doc map[string]any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("validateReport: %w", err)
+	}
+	if err := requireFields(doc, "", map[string]string{"schema_version": "number", "total": "number", "bytes": "number", "files": "array"}); err != nil {
+		return err
+	}
+	if v := doc["schema_version"].(float64); v != reportSchemaVersion {
+		return fmt.Errorf("validateReport: schema_version is %g, want %d", v, reportSchemaVersion)
+	}
+	for i, f := range doc["files"].([]any) {
+		if err := requireFields(f, fmt.Sprintf("files[%d].", i), map[string]string{"name": "string", "words": "number"}); err != nil {
+			return err
+		}
+	}
+	if skipped, ok := doc["skipped"]; ok {
+		if jsonType(skipped) != "array" {
+			return fmt.Errorf("validateReport: skipped is %s, want array", jsonType(skipped))
+		}
+		for i, f := range skipped.([]any) {
+			if err := requireFields(f, fmt.Sprintf("skipped[%d].", i), map[string]string{"name": "string", "reason": "string"}); err != nil {
+				return err
+			}
+		}
+	}
+	if ws, ok := doc["warnings"]; ok {
+		if jsonType(ws) != "array" {
+			return fmt.Errorf("validateReport: warnings is %s, want array", jsonType(ws))
+		}
+		for i, w := range ws.([]any) {
+			if err := requireFields(w, fmt.Sprintf("warnings[%d].", i), map[string]string{"message": "string"}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// `requireFields` checks that `v` is a JSON object with the given fields of the given types. `path` prefixes the field names in errors.
+func requireFields(v any, path string, fields map[string]string) error {
+	obj, ok := v.(map[string]any)
+	if !ok {
+		return fmt.Errorf("validateReport: %s is %s, want object", strings.TrimSuffix(path, "."), jsonType(v))
+	}
+	for name, want := range fields {
+		f, ok := obj[name]
+		if !ok {
+			return fmt.Errorf("validateReport: %s%s is missing", path, name)
+		}
+		if got := jsonType(f); got != want {
+			return fmt.Errorf("validateReport: %s%s is %s, want %s", path, name, got, want)
+		}
+	}
+	return nil
+}
+
+// `jsonType` returns the JSON type name of a decoded value.
+func jsonType(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// An `outlierRule` decides which word counts are unusual, based on either the mean and standard deviation or on percentiles of all word counts.
+type outlierRule struct {
+	method    string
+	stddevs   float64
+	low, high float64
+}
+
+// `outliers` is the content of "outliers.json". `Low` and `High` are the bounds of the usual word counts.
+type outliers struct {
+	Method string      `json:"method"`
+	Mean   float64     `json:"mean"`
+	Stddev float64     `json:"stddev"`
+	Low    float64     `json:"low"`
+	High   float64     `json:"high"`
+	Files  []fileCount `json:"files"`
+}
+
+// `find` returns the counted files with a word count outside the bounds. Percentiles are interpolated linearly between the closest ranks.
+func (o *outlierRule) find(files []fileCount) *outliers {
+	var words []float64
+	for _, f := range files {
+		if !f.Skipped {
+			words = append(words, float64(f.Words))
+		}
+	}
+	res := &outliers{Method: o.method, Files: []fileCount{}}
+	if len(words) == 0 {
+		return res
+	}
+	for _, w := range words {
+		res.Mean += w
+	}
+	res.Mean /= float64(len(words))
+	for _, w := range words {
+		res.Stddev += (w - res.Mean) * (w - res.Mean)
+	}
+	res.Stddev = math.Sqrt(res.Stddev / float64(len(words)))
+
+	if o.method == "percentile" {
+		sort.Float64s(words)
+		percentile := func(p float64) float64 {
+			rank := p / 100 * float64(len(words)-1)
+			i := int(rank)
+			if i+1 >= len(words) {
+				return words[len(words)-1]
+			}
+			return words[i] + (rank-float64(i))*(words[i+1]-words[i])
+		}
+		res.Low, res.High = percentile(o.low), percentile(o.high)
+	} else {
+		res.Low, res.High = res.Mean-o.stddevs*res.Stddev, res.Mean+o.stddevs*res.Stddev
+	}
+
+	for _, f := range files {
+		if !f.Skipped && (float64(f.Words) < res.Low || float64(f.Words) > res.High) {
+			res.Files = append(res.Files, f)
+		}
+	}
+	return res
+}
+
+// `shardReport` partitions the results into `n` reports by the hash of the file name, so that a file always lands in the same shard. The totals of each shard cover its own files only, so that reduce mode can merge the shards like the reports of different nodes. Data about the run as a whole goes to the first shard.
+func shardReport(r *report, n int) []*report {
+	shards := make([]*report, n)
+	for i := range shards {
+		shards[i] = &report{SchemaVersion: reportSchemaVersion, Version: r.Version, Files: []fileCount{}}
+	}
+	shards[0].Memory = r.Memory
+	shards[0].LimitReached = r.LimitReached
+	shards[0].Warnings = r.Warnings
+	shardOf := func(name string) *report {
+		h := fnv.New32a()
+		h.Write([]byte(name))
+		return shards[h.Sum32()%uint32(n)]
+	}
+	for _, f := range r.Files {
+		s := shardOf(f.Name)
+		s.Total += f.Words
+		s.Numbers += f.Numbers
+		s.Bytes += f.Bytes
+		s.Records += f.Records
+		s.Files = append(s.Files, f)
+	}
+	for _, sk := range r.Skipped {
+		s := shardOf(sk.Name)
+		s.Skipped = append(s.Skipped, sk)
+	}
+	return shards
+}
+
+// `writePrometheus` writes the counts as Prometheus metrics. All metrics are gauges, as they describe the state of the input data.
+func writePrometheus(outputs *outputFiles, r *report) error {
+	out, err := outputs.create("metrics.prom")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, "# HELP wordcount_total Number of words per file.")
+	fmt.Fprintln(out, "# TYPE wordcount_total gauge")
+	for _, f := range r.Files {
+		if !f.Skipped {
+			fmt.Fprintf(out, "wordcount_total{file=\"%s\"} %d\n", promEscaper.Replace(f.Name), f.Words)
+		}
+	}
+	for _, m := range []struct {
+		name, help string
+		value      int64
+	}{
+		{"wordcount_words", "Number of words in all files.", int64(r.Total)},
+		{"wordcount_bytes", "Number of bytes in all files.", r.Bytes},
+		{"wordcount_files", "Number of counted files.", int64(r.counted())},
+		{"wordcount_skipped_files", "Number of skipped files.", int64(len(r.Skipped))},
+	} {
+		fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", m.name, m.help, m.name, m.name, m.value)
+	}
+	return out.Close()
+}
+
+// In label values, backslashes, double quotes, and line breaks must be escaped.
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// `writeTokens` writes the tokens of a file to "tokens/<file>.txt", one per line.
+func writeTokens(outputs *outputFiles, name string, tokens []string) error {
+    // Like with `SPLIT_OUTPUT`, the file name must not lead out of the output directory.
+	if !filepath.IsLocal(name + ".txt") {
+		return fmt.Errorf("DUMP_TOKENS: %q is not a valid output path", name)
+	}
+	out, err := outputs.create(filepath.Join("tokens", name+".txt"))
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	for _, t := range tokens {
+		w.WriteString(t)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// `writeCountText` writes "count.txt", one line per file.
+func writeCountText(outputs *outputFiles, files []fileCount) error {
+	out, err := outputs.create("count.txt")
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		fmt.Fprintf(out, "%s has %d words\n", f.Name, f.Words)
+	}
+	return out.Close()
+}
+
+// `writeSummary` writes the one-line "summary.txt". The format is `key=value` pairs separated by spaces, and is meant to stay stable.
+func writeSummary(outputs *outputFiles, r *report) error {
+	out, err := outputs.create("summary.txt")
+	if err != nil {
+		return err
+	}
+	line := fmt.Sprintf("files=%d words=%d bytes=%d skipped=%d", r.counted(), r.Total, r.Bytes, len(r.Skipped))
+	if r.Memory != nil {
+		line += fmt.Sprintf(" heap_peak=%d sys_peak=%d", r.Memory.HeapAllocPeak, r.Memory.SysPeak)
+	}
+	if r.Fingerprint != "" {
+		line += " fingerprint=" + r.Fingerprint
+	}
+	fmt.Fprintln(out, line)
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if !outputs.details {
+		return nil
+	}
+
+    // The details layout repeats the summary at the top.
+	top, err := outputs.create("SUMMARY")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(top, line)
+	return top.Close()
+}
+
+// A `memorySampler` tracks the peak memory usage in the background.
+type memorySampler struct {
+	peaks memoryPeaks
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+type memoryPeaks struct {
+	HeapAllocPeak uint64 `json:"heap_alloc_peak"`
+	SysPeak       uint64 `json:"sys_peak"`
+}
+
+func startMemorySampler(interval time.Duration) *memorySampler {
+	m := &memorySampler{done: make(chan struct{})}
+	m.sample()
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.sample()
+			case <-m.done:
+				return
+			}
+		}
+	}()
+	return m
+}
+
+func (m *memorySampler) sample() {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	m.peaks.HeapAllocPeak = max(m.peaks.HeapAllocPeak, ms.HeapAlloc)
+	m.peaks.SysPeak = max(m.peaks.SysPeak, ms.Sys)
+}
+
+// `stop` ends the sampling and returns the peaks, including a last sample. A nil sampler returns nil, so that callers need not check whether sampling is enabled.
+func (m *memorySampler) stop() *memoryPeaks {
+	if m == nil {
+		return nil
+	}
+	close(m.done)
+	m.wg.Wait()
+	m.sample()
+	return &m.peaks
+}
+
+// A `checkpointer` writes the intermediate results every so many files.
+type checkpointer struct {
+	every int
+	n     int
+}
+
+// `update` is called after each counted file.
+func (c *checkpointer) update(path string, r *report) error {
+	c.n++
+	if c.n%c.every != 0 {
+		return nil
+	}
+	return c.write(path, r)
+}
+
+// `write` replaces the checkpoint atomically: The new content goes to a temporary file first, which is then renamed. An interruption thus leaves either the old or the new checkpoint, but never a partial one.
+func (c *checkpointer) write(path string, r *report) error {
+	data, err := json.Marshal(r)
+	if err == nil {
+		err = writeAtomic(path, data)
+	}
+	if err != nil {
+		return fmt.Errorf("checkpoint: %w", err)
+	}
+	return nil
+}
+
+func writeAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// A `recordStream` writes per-file results to a gzip-compressed file, one JSON object per line. A nil `recordStream` writes nothing.
+type recordStream struct {
+	f        *os.File
+	zw       *gzip.Writer
+	enc      *json.Encoder
+	interval time.Duration
+	last     time.Time
+}
+
+func newRecordStream(path string, interval time.Duration) (*recordStream, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("newRecordStream: %w", err)
+	}
+	zw := gzip.NewWriter(f)
+	return &recordStream{f: f, zw: zw, enc: json.NewEncoder(zw), interval: interval, last: time.Now()}, nil
+}
+
+// `write` adds a record. If the interval has passed since the last flush, the compressor is flushed, which writes all pending data as a complete block.
+func (s *recordStream) write(fc fileCount) error {
+	if s == nil {
+		return nil
+	}
+	err := s.enc.Encode(fc)
+	if err == nil && time.Since(s.last) >= s.interval {
+		s.last = time.Now()
+		err = s.zw.Flush()
+	}
+	if err != nil {
+		return fmt.Errorf("stream: %w", err)
+	}
+	return nil
+}
+
+// `close` ends the stream. Only then is the gzip file complete, with the checksum at the end.
+func (s *recordStream) close() error {
+	if s == nil {
+		return nil
+	}
+	err := s.zw.Close()
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("stream: %w", err)
+	}
+	return nil
+}
+
+// A `progressFile` reports the progress of the job. A nil `progressFile` reports nothing.
+type progressFile struct {
+	path     string
+	interval time.Duration
+	start    time.Time
+	last     time.Time
+}
+
+type progressState struct {
+	Processed int     `json:"processed"`
+	Total     int     `json:"total"`
+	Percent   float64 `json:"percent"`
+	Elapsed   float64 `json:"elapsed"`
+}
+
+// `update` writes the progress if the interval has passed since the last write.
+func (p *progressFile) update(processed, total int) error {
+	if p == nil || time.Since(p.last) < p.interval {
+		return nil
+	}
+	return p.write(processed, total)
+}
+
+// `write` replaces the progress file atomically, like a checkpoint.
+func (p *progressFile) write(processed, total int) error {
+	if p == nil {
+		return nil
+	}
+	p.last = time.Now()
+	state := progressState{Processed: processed, Total: total, Percent: 100, Elapsed: p.last.Sub(p.start).Seconds()}
+	if total > 0 {
+		state.Percent = math.Round(float64(processed)/float64(total)*10000) / 100
+	}
+	data, err := json.Marshal(state)
+	if err == nil {
+		err = writeAtomic(p.path, data)
+	}
+	if err != nil {
+		return fmt.Errorf("progress: %w", err)
+	}
+	return nil
+}
+
+// `readReport` reads a "count.json" file written by a previous run.
+func readReport(path string) (*report, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("readReport: %w", err)
+	}
+	rep := &report{}
+	if err := json.Unmarshal(data, rep); err != nil {
+		return nil, fmt.Errorf("readReport: %s: %w", path, err)
+	}
+	return rep, nil
+}
+
+// `readFreqTable` reads a frequency table like "frequencies.json" into a map. A missing file is an empty table. Words that are listed twice are added up.
+func readFreqTable(path string) (map[string]int, error) {
+	freq := map[string]int{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return freq, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("readFreqTable: %w", err)
+	}
+	var words []wordCount
+	if err := json.Unmarshal(data, &words); err != nil {
+		return nil, fmt.Errorf("readFreqTable: %s: %w", path, err)
+	}
+	for _, wc := range words {
+		freq[wc.Word] += wc.Count
+	}
+	return freq, nil
+}
+
+// A `reportDiff` lists the differences between two reports. Each file ends up in exactly one of the categories.
+type reportDiff struct {
+	Added      []fileCount  `json:"added"`
+	Removed    []fileCount  `json:"removed"`
+	Changed    []fileChange `json:"changed"`
+	Unchanged  int          `json:"unchanged"`
+	TotalDelta int          `json:"total_delta"`
+}
+
+type fileChange struct {
+	Name   string `json:"name"`
+	Before int    `json:"before"`
+	After  int    `json:"after"`
+	Delta  int    `json:"delta"`
+}
+
+// `diffReports` compares the current report against a baseline. All lists are sorted by file name, so that the diff is the same for the same inputs.
+func diffReports(baseline, current *report) *reportDiff {
+	d := &reportDiff{
+		Added:      []fileCount{},
+		Removed:    []fileCount{},
+		Changed:    []fileChange{},
+		TotalDelta: current.Total - baseline.Total,
+	}
+	before := map[string]int{}
+	for _, f := range baseline.Files {
+		before[f.Name] = f.Words
+	}
+	for _, f := range current.Files {
+		old, ok := before[f.Name]
+		delete(before, f.Name)
+		switch {
+		case !ok:
+			d.Added = append(d.Added, f)
+		case old != f.Words:
+			d.Changed = append(d.Changed, fileChange{Name: f.Name, Before: old, After: f.Words, Delta: f.Words - old})
+		default:
+			d.Unchanged++
+		}
+	}
+	for name, words := range before {
+		d.Removed = append(d.Removed, fileCount{Name: name, Words: words})
+	}
+	sort.Slice(d.Added, func(i, j int) bool { return d.Added[i].Name < d.Added[j].Name })
+	sort.Slice(d.Removed, func(i, j int) bool { return d.Removed[i].Name < d.Removed[j].Name })
+	sort.Slice(d.Changed, func(i, j int) bool { return d.Changed[i].Name < d.Changed[j].Name })
+	return d
+}
+
+// `writeJSON` writes `v` as indented JSON to the output file `name`.
+func writeJSON(outputs *outputFiles, name string, v any) error {
+	out, err := outputs.create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		out.Close()
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return out.Close()
+}
+
+// A `wordCount` is an entry of a frequency table.
+type wordCount struct {
+	Word  string `json:"word"`
+	Count int    `json:"count"`
+}
+
+// `topWords` returns the `n` most frequent words, most frequent first. Words with the same count are sorted alphabetically, to get the same result for the same input.
+func topWords(freq map[string]int, n int) []wordCount {
+	words := make([]wordCount, 0, len(freq))
+	for w, c := range freq {
+		words = append(words, wordCount{Word: w, Count: c})
+	}
+	sort.Slice(words, func(i, j int) bool { return byFrequency(words[i], words[j]) })
+	if n >= 0 && n < len(words) {
+		words = words[:n]
+	}
+	return words
+}
+
+// An `entropySum` computes the Shannon entropy of a distribution from its counts: with the total N, the entropy is log2(N) - Σ c·log2(c) / N. No counts at all have an entropy of 0.
+// The counts usually come from a map, in random order, and floating-point sums depend on the order of the terms. So, `add` only tallies how many words have each count, and `bits` sums up in the order of the counts. This also takes fewer logarithms, as most words share their count with many others.
+type entropySum struct {
+	counts map[int]int
+}
+
+func (e *entropySum) add(count int) {
+	if e.counts == nil {
+		e.counts = map[int]int{}
+	}
+	e.counts[count]++
+}
+
+func (e *entropySum) bits() float64 {
+	cs := make([]int, 0, len(e.counts))
+	for c := range e.counts {
+		cs = append(cs, c)
+	}
+	slices.Sort(cs)
+	var n, sum float64
+	for _, c := range cs {
+		k, fc := float64(e.counts[c]), float64(c)
+		n += k * fc
+		sum += k * fc * math.Log2(fc)
+	}
+	if n == 0 {
+		return 0
+	}
+	return math.Max(math.Log2(n)-sum/n, 0)
+}
+
+// `byFrequency` orders words by descending count, then alphabetically.
+func byFrequency(a, b wordCount) bool {
+	if a.Count != b.Count {
+		return a.Count > b.Count
+	}
+	return wordLess(a.Word, b.Word)
+}
+
+// `newCollator` returns the collation order of a language, or the language-neutral order for an empty locale. It is nil in builds without the `xtext` tag.
+var newCollator func(locale string) (func(a, b string) bool, error)
+
+// `wordLess` is the alphabetical order of words with the same frequency. Words that collate as equal are still ordered by their bytes, so that the order is always the same. A collator must not be used concurrently, but all sorting happens in the main goroutine.
+var wordLess = func(a, b string) bool { return a < b }
+
+func byWord(a, b wordCount) bool {
+	return a.Word < b.Word
+}
+
+// A `freqSpill` bounds the size of a frequency map by moving its content to sorted temporary files, or "runs", when it grows beyond `limit` words. The results merge the runs with what is left in the map. A nil `freqSpill` does not spill, and the results come from the map alone.
+type freqSpill struct {
+	limit int
+	dir   string
+	runs  []string
+}
+
+// `check` spills the map if it holds too many words.
+func (s *freqSpill) check(freq map[string]int) error {
+	if s == nil || len(freq) <= s.limit {
+		return nil
+	}
+	return s.spill(freq)
+}
+
+// `spill` writes the map to a new run, sorted by word, and clears it.
+func (s *freqSpill) spill(freq map[string]int) error {
+	if len(s.runs) == 0 {
+		dir, err := os.MkdirTemp(s.dir, "freq-")
+		if err != nil {
+			return fmt.Errorf("spill: %w", err)
+		}
+		s.dir = dir
+	}
+	words := make([]wordCount, 0, len(freq))
+	for w, c := range freq {
+		words = append(words, wordCount{Word: w, Count: c})
+	}
+	sort.Slice(words, func(i, j int) bool { return byWord(words[i], words[j]) })
+	path, err := writeRun(s.dir, words)
+	if err != nil {
+		return fmt.Errorf("spill: %w", err)
+	}
+	s.runs = append(s.runs, path)
+	clear(freq)
+	return nil
+}
+
+// `merged` calls `fn` for each word with its total count, in alphabetical order. This spills the rest of the map first.
+func (s *freqSpill) merged(freq map[string]int, fn func(wordCount) error) error {
+	if len(freq) > 0 {
+		if err := s.spill(freq); err != nil {
+			return err
+		}
+	}
+	var cur wordCount
+	err := mergeRuns(s.runs, byWord, func(wc wordCount) error {
+		if wc.Word == cur.Word && cur.Count > 0 {
+			cur.Count += wc.Count
+			return nil
+		}
+		if cur.Count > 0 {
+			if err := fn(cur); err != nil {
+				return err
+			}
+		}
+		cur = wc
+		return nil
+	})
+	if err != nil || cur.Count == 0 {
+		return err
+	}
+	return fn(cur)
+}
+
+// `each` calls `fn` for each word with its total count, in no particular order if nothing was spilled.
+func (s *freqSpill) each(freq map[string]int, fn func(wordCount) error) error {
+	if s == nil || len(s.runs) == 0 {
+		for w, c := range freq {
+			if err := fn(wordCount{Word: w, Count: c}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return s.merged(freq, fn)
+}
+
+// `top` returns the `n` most frequent words, like `topWords`. With runs, only the `n` most frequent words seen so far are kept in memory.
+func (s *freqSpill) top(freq map[string]int, n int) ([]wordCount, error) {
+	if s == nil || len(s.runs) == 0 {
+		return topWords(freq, n), nil
+	}
+    // The heap has the least frequent of the top words at its root, ready to be replaced.
+	h := &wordHeap{less: func(a, b wordCount) bool { return byFrequency(b, a) }}
+	err := s.merged(freq, func(wc wordCount) error {
+		heap.Push(h, runItem{wc: wc})
+		if h.Len() > n {
+			heap.Pop(h)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	words := make([]wordCount, h.Len())
+	for i := len(words) - 1; i >= 0; i-- {
+		words[i] = heap.Pop(h).(runItem).wc
+	}
+	return words, nil
+}
+
+// `otherWord` stands for the words beyond the `MAX_VOCAB` limit, and `truncatedWord` for the words beyond the `MAX_FREQ_BYTES` limit.
+const (
+	otherWord     = "<OTHER>"
+	truncatedWord = "<TRUNCATED>"
+)
+
+// `tableLimits` restrict a frequency table. Zero means no limit.
+type tableLimits struct {
+    // `minCount` leaves out the words that occur less often.
+	minCount int
+
+    // `maxWords` keeps only this many words and adds up the rest, including the words below `minCount`, as `otherWord`.
+	maxWords int
+
+    // `maxBytes` is the maximum size of the table. The words that don't fit anymore are added up as `truncatedWord`.
+	maxBytes int64
+}
+
+// `truncationReserve` is the room at the end of a table with a byte limit: for the note about truncated words, with a count of any size, and for the closing bracket. A limit must leave this room after the opening bracket.
+func truncationReserve() int64 {
+	note, _ := marshalEntry(wordCount{Word: truncatedWord, Count: math.MaxInt})
+	return int64(len(",\n  ") + len(note) + len("\n]\n"))
+}
+
+// `marshalEntry` formats an entry of a frequency table, indented for its place in the array. Unlike `writeJSON`, it does not escape "<" and ">", so that "<OTHER>" and "<TRUNCATED>" appear literally.
+func marshalEntry(wc wordCount) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("  ", "  ")
+	if err := enc.Encode(wc); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// `writeTable` writes all words within the limits, most frequent first, as a JSON array. With runs, the table is sorted on disk: the merged words go to new runs of up to `limit` words each, sorted by frequency, which are then merged into the output.
+func (s *freqSpill) writeTable(outputs *outputFiles, name string, freq map[string]int, limits tableLimits) error {
+    // `dropped` adds up the words below `minCount`.
+	dropped := 0
+	var each func(func(wordCount) error) error
+	if s == nil || len(s.runs) == 0 {
+		words := topWords(freq, -1)
+		each = func(fn func(wordCount) error) error {
+			for _, wc := range words {
+				if wc.Count < limits.minCount {
+					dropped += wc.Count
+					continue
+				}
+				if err := fn(wc); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	} else {
+		var runs []string
+		var batch []wordCount
+		flush := func() error {
+			sort.Slice(batch, func(i, j int) bool { return byFrequency(batch[i], batch[j]) })
+			path, err := writeRun(s.dir, batch)
+			if err != nil {
+				return err
+			}
+			runs = append(runs, path)
+			batch = batch[:0]
+			return nil
+		}
+		err := s.merged(freq, func(wc wordCount) error {
+			if wc.Count < limits.minCount {
+				dropped += wc.Count
+				return nil
+			}
+			batch = append(batch, wc)
+			if len(batch) >= s.limit {
+				return flush()
+			}
+			return nil
+		})
+		if err == nil && len(batch) > 0 {
+			err = flush()
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		each = func(fn func(wordCount) error) error {
+			return mergeRuns(runs, byFrequency, fn)
+		}
+	}
+
+    // The array is written element by element, formatted like `writeJSON` does.
+	out, err := outputs.create(name)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	w.WriteString("[")
+	size := int64(1)
+	sep := "\n  "
+    // With a byte limit, there must always be room left for the end of the table.
+	var reserve int64
+	if limits.maxBytes > 0 {
+		reserve = truncationReserve()
+	}
+	truncated := false
+	omitted := 0
+	write := func(wc wordCount) error {
+		if truncated {
+			omitted += wc.Count
+			return nil
+		}
+		data, err := marshalEntry(wc)
+		if err != nil {
+			return err
+		}
+		if limits.maxBytes > 0 && size+int64(len(sep)+len(data))+reserve > limits.maxBytes {
+			truncated = true
+			omitted += wc.Count
+			return nil
+		}
+		w.WriteString(sep)
+		w.Write(data)
+		size += int64(len(sep) + len(data))
+		sep = ",\n  "
+		return nil
+	}
+	written, other := 0, 0
+	err = each(func(wc wordCount) error {
+		if limits.maxWords > 0 && written >= limits.maxWords {
+			other += wc.Count
+			return nil
+		}
+		written++
+		return write(wc)
+	})
+    // With a word limit, the table covers all words, so the words below `minCount` count as other words, too.
+	if limits.maxWords > 0 {
+		other += dropped
+	}
+	if err == nil && other > 0 {
+		err = write(wordCount{Word: otherWord, Count: other})
+	}
+	if err == nil && truncated {
+		reserve, truncated = 0, false
+		err = write(wordCount{Word: truncatedWord, Count: omitted})
+	}
+	if sep == "\n  " {
+        // No words, as with a high `MIN_FREQUENCY`.
+		w.WriteString("]\n")
+	} else {
+		w.WriteString("\n]\n")
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		out.Close()
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return out.Close()
+}
+
+// `remove` deletes the runs.
+func (s *freqSpill) remove() error {
+	if s == nil || len(s.runs) == 0 {
+		return nil
+	}
+	return os.RemoveAll(s.dir)
+}
+
+// `writeRun` writes words to a new temporary file, one per line as the count and the quoted word, so that words with spaces or line breaks survive.
+func writeRun(dir string, words []wordCount) (string, error) {
+	f, err := os.CreateTemp(dir, "run-")
+	if err != nil {
+		return "", err
+	}
+	w := bufio.NewWriter(f)
+	for _, wc := range words {
+		fmt.Fprintf(w, "%d %s\n", wc.Count, strconv.Quote(wc.Word))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// `mergeRuns` calls `fn` for every word in the runs, which must all be sorted by `less`, in that same order.
+func mergeRuns(paths []string, less func(a, b wordCount) bool, fn func(wordCount) error) error {
+	scanners := make([]*bufio.Scanner, len(paths))
+	h := &wordHeap{less: less}
+	next := func(i int) error {
+		if !scanners[i].Scan() {
+			return scanners[i].Err()
+		}
+		count, word, _ := strings.Cut(scanners[i].Text(), " ")
+		c, err := strconv.Atoi(count)
+		if err == nil {
+			word, err = strconv.Unquote(word)
+		}
+		if err != nil {
+			return fmt.Errorf("mergeRuns: %s: %w", paths[i], err)
+		}
+		heap.Push(h, runItem{wc: wordCount{Word: word, Count: c}, run: i})
+		return nil
+	}
+	for i, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("mergeRuns: %w", err)
+		}
+		defer f.Close()
+		scanners[i] = bufio.NewScanner(f)
+		scanners[i].Buffer(make([]byte, 0, bufio.MaxScanTokenSize), maxLineLength)
+		if err := next(i); err != nil {
+			return err
+		}
+	}
+	for h.Len() > 0 {
+		item := heap.Pop(h).(runItem)
+		if err := fn(item.wc); err != nil {
+			return err
+		}
+		if err := next(item.run); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A `wordHeap` is a heap of words in the order of `less`, for `container/heap`. Each word remembers the run it came from.
+type wordHeap struct {
+	items []runItem
+	less  func(a, b wordCount) bool
+}
+
+type runItem struct {
+	wc  wordCount
+	run int
+}
+
+func (h *wordHeap) Len() int           { return len(h.items) }
+func (h *wordHeap) Less(i, j int) bool { return h.less(h.items[i].wc, h.items[j].wc) }
+func (h *wordHeap) Swap(i, j int)      { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *wordHeap) Push(x any)         { h.items = append(h.items, x.(runItem)) }
+func (h *wordHeap) Pop() any {
+	last := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return last
+}
+
+// A `wordCloud` holds the weighted words of either all files or of each single file.
+type wordCloud struct {
+	Words []weightedWord `json:"words,omitempty"`
+	Files []fileCloud    `json:"files,omitempty"`
+}
+
+type fileCloud struct {
+	Name  string         `json:"name"`
+	Words []weightedWord `json:"words"`
+}
+
+type weightedWord struct {
+	Word   string  `json:"word"`
+	Count  int     `json:"count"`
+	Weight float64 `json:"weight"`
+}
+
+// `cloudWeights` weights the most frequent words by their count relative to the first, most frequent word.
+func cloudWeights(top []wordCount) []weightedWord {
+	words := make([]weightedWord, len(top))
+	for i, wc := range top {
+		words[i] = weightedWord{
+			Word:   wc.Word,
+			Count:  wc.Count,
+			Weight: float64(wc.Count) / float64(top[0].Count),
+		}
+	}
+	return words
+}
+
+// `printChart` renders a horizontal bar chart. The most frequent word gets a bar of `width` characters, the other bars are scaled accordingly.
+func printChart(w io.Writer, words []wordCount, width int) {
+	if len(words) == 0 {
+		return
+	}
+	pad := 0
+	for _, wc := range words {
+		pad = max(pad, utf8.RuneCountInString(wc.Word))
+	}
+	top := words[0].Count
+	for _, wc := range words {
+		bar := max(wc.Count*width/top, 1)
+		fmt.Fprintf(w, "%-*s %s %d\n", pad, wc.Word, strings.Repeat("#", bar), wc.Count)
+	}
+}
+
+// ### Language detection
+//
+// Language detection compares the letter trigrams of a file against trigram profiles of a few languages. The profiles are built from short sample texts at startup, which keeps the binary small and works with TinyGo. This is crude but sufficient to tell apart, say, English, French, and German documents.
+
+// Only the first words of a file are sampled. This is plenty for detecting the language and keeps the effort per file constant.
+const languageSampleWords = 2000
+
+var languageSamples = map[string]string{
+	"de": "der die und in den von zu das mit sich des auf für ist im dem nicht ein die eine als auch es an werden aus er hat dass sie nach wird bei einer um am sind noch wie einem über einen so zum war haben nur oder aber vor zur bis mehr durch man sein wurde sei ich wir können schon heute zwischen müssen über straße größer Alle Menschen sind frei und gleich an Würde und Rechten geboren. Sie sind mit Vernunft und Gewissen begabt und sollen einander im Geist der Brüderlichkeit begegnen. Heute scheint die Sonne, aber morgen gibt es schlechtes Wetter.",
+	"en": "the of and to in is you that it he was for on are as with his they at be this have from or one had by word but not what all were we when your can said there use an each which she do how their if will up other about out many then them these so some her would make like him into time has look two more write go see number no way could people my than first water been call who oil its now find long down day did get come made may part All human beings are born free and equal in dignity and rights. They are endowed with reason and conscience and should act towards one another in a spirit of brotherhood. Which thing should we think through while walking through the weather?",
+	"es": "de la que el en y a los del se las por un para con no una su al lo como más pero sus le ya o este sí porque esta entre cuando muy sin sobre también me hasta hay donde quien desde todo nos durante todos uno les ni contra otros ese eso ante ellos e esto mí antes algunos qué unos yo otro otras otra él tanto esa estos mucho quienes nada muchos cual poco ella estar estas algunas algo nosotros año niño Todos los seres humanos nacen libres e iguales en dignidad y derechos y, dotados como están de razón y conciencia, deben comportarse fraternalmente los unos con los otros. Hoy hace buen tiempo y mañana también.",
+	"fr": "de la le et les des en un du une que est pour qui dans par plus pas au sur ne se ce il sont avec ou elle mais nous vous été leur comme tout bien aussi fait où cette même ces être avoir faire dit sans très donc alors peu déjà après encore toujours chez notre votre leurs quelque chose était avait français à ça Tous les êtres humains naissent libres et égaux en dignité et en droits. Ils sont doués de raison et de conscience et doivent agir les uns envers les autres dans un esprit de fraternité. Aujourd'hui nous pensons que le temps sera beau.",
+	"it": "di che è e la il un a per in una sono mi non ho lo ma ti ha le si con cosa da io se no come questo qui bene del tutto della sei mio ci sta solo era hai gli al anche più nel ne fare lei voglio dove quando perché chi gli ancora sempre nella tutti degli molto essere stato questa così loro Tutti gli esseri umani nascono liberi ed eguali in dignità e diritti. Essi sono dotati di ragione e di coscienza e devono agire gli uni verso gli altri in spirito di fratellanza. Oggi fa bel tempo, ma domani pioverà.",
+	"nl": "de en van ik te dat die in een hij het niet zijn is was op aan met als voor had er maar om hem dan zou of wat mijn men dit zo door over ze zich bij ook tot je mij uit der daar haar naar heb hoe heeft hebben deze u want nog zal me zij nu ge geen omdat iets worden toch al waren veel meer doen toen moet ben zonder kan hun dus alles onder ja eens hier wie werd altijd doch wordt wezen kunnen ons zelf tegen na reeds wil kon niets uw iemand geweest andere Alle mensen worden vrij en gelijk in waardigheid en rechten geboren. Zij zijn begiftigd met verstand en geweten, en behoren zich jegens elkander in een geest van broederschap te gedragen. Vandaag is het mooi weer.",
+	"pt": "de a o que e do da em um para é com não uma os no se na por mais as dos como mas foi ao ele das tem à seu sua ou ser quando muito há nos já está eu também só pelo pela até isso ela entre era depois sem mesmo aos ter seus quem nas me esse eles estão você tinha foram essa num nem suas meu às minha têm numa pelos elas havia seja qual será nós tenho lhe deles essas esses pelas este fosse dele tu te vocês vos lhes meus minhas teu tua teus tuas nosso nossa nossos nossas dela delas esta estes estas aquele aquela aqueles aquelas isto aquilo não ação Todos os seres humanos nascem livres e iguais em dignidade e em direitos. Dotados de razão e de consciência, devem agir uns para com os outros em espírito de fraternidade. Hoje o tempo está bom, então vamos sair. Não há coração sem informação, trabalho e filhos.",
+}
+
+// `languageProfiles` builds the trigram profile of every sample text.
+func languageProfiles() map[string]map[string]int {
+	profiles := map[string]map[string]int{}
+	for lang, text := range languageSamples {
+		profiles[lang] = map[string]int{}
+		for _, word := range strings.Fields(text) {
+			addTrigrams(word, profiles[lang])
+		}
+	}
+	return profiles
+}
+
+// `addTrigrams` adds the trigrams of a word, with spaces marking the word boundaries. Case and non-letters are ignored.
+func addTrigrams(word string, into map[string]int) {
+	for _, w := range strings.FieldsFunc(strings.ToLower(word), func(r rune) bool { return !unicode.IsLetter(r) }) {
+		r := []rune(" " + w + " ")
+		for i := 0; i+3 <= len(r); i++ {
+			into[string(r[i:i+3])]++
+		}
+	}
+}
+
+type fileLanguage struct {
+	Name       string  `json:"name"`
+	Language   string  `json:"language"`
+	Confidence float64 `json:"confidence"`
+}
+
+// `detectLanguage` picks the profile with the highest cosine similarity to the file's trigrams. Ties go to the alphabetically first language, to keep the result deterministic.
+func detectLanguage(name string, trigrams map[string]int, profiles map[string]map[string]int, threshold float64) fileLanguage {
+	best := fileLanguage{Name: name, Language: "unknown"}
+	langs := make([]string, 0, len(profiles))
+	for lang := range profiles {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	for _, lang := range langs {
+		if sim := cosine(trigrams, profiles[lang]); sim > best.Confidence {
+			best.Language, best.Confidence = lang, sim
+		}
+	}
+	if best.Confidence < threshold {
+		best.Language = "unknown"
+	}
+	best.Confidence = math.Round(best.Confidence*1000) / 1000
+	return best
+}
+
+// `cosine` is the cosine similarity of two frequency vectors: 1 for identical distributions, 0 for nothing in common.
+func cosine(a, b map[string]int) float64 {
+	var dot, na, nb float64
+	for k, v := range a {
+		na += float64(v) * float64(v)
+		dot += float64(v) * float64(b[k])
+	}
+	for _, v := range b {
+		nb += float64(v) * float64(v)
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(na*nb)
+}
+
+// `envFloat` is `envInt` for floating-point options.
+func envFloat(name string, def float64) float64 {
+	v, _ := lookupOption(name)
+	if v == "" {
+		recordOption(name, def)
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.Fatalf("%s: %s", name, err)
+	}
+	recordOption(name, f)
+	return f
+}
+
+// `envInt` reads an integer option, or returns `def` if the option is not set. Invalid numbers are fatal, as they are certainly not what the user intended.
+func envInt(name string, def int) int {
+	v, _ := lookupOption(name)
+	if v == "" {
+		recordOption(name, def)
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("%s: %s", name, err)
+	}
+	recordOption(name, n)
+	return n
+}
+
+// `totalPrinter` returns a function that prints the total word count to `stdout`, as JSON or as text from a template. The template is tried out right away, so that an invalid template fails the job before any work is done.
+func totalPrinter(prefix, format, text string) (func(*report), error) {
+	summary := func(r *report) stdoutSummary {
+		return stdoutSummary{Prefix: prefix, Total: r.Total, Files: r.counted(), Bytes: r.Bytes, Skipped: len(r.Skipped)}
+	}
+	if format == "ndjson" {
+		return func(r *report) {
+			enc := json.NewEncoder(os.Stdout)
+			for _, fc := range r.Files {
+				if err := enc.Encode(fc); err != nil {
+					log.Fatal(err)
+				}
+			}
+		}, nil
+	}
+	if format == "json" {
+		return func(r *report) {
+			data, err := json.Marshal(summary(r))
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("%s\n", data)
+		}, nil
+	}
+	tmpl, err := template.New("stdout").Parse(text)
+	if err == nil {
+		err = tmpl.Execute(io.Discard, stdoutSummary{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" {
+		prefix += " "
+	}
+	return func(r *report) {
+		var line strings.Builder
+		if err := tmpl.Execute(&line, summary(r)); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s%s\n", prefix, line.String())
+	}, nil
+}
+
+// `reduceStream` adds up the per-file results in `r`, which are JSON objects separated by whitespace, usually one per line. Skipped files are counted as such.
+func reduceStream(r io.Reader) (stdoutSummary, error) {
+	var sum stdoutSummary
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for n := 1; ; n++ {
+		var fc fileCount
+		err := dec.Decode(&fc)
+		if err == io.EOF {
+			return sum, nil
+		}
+		if err != nil {
+			return sum, fmt.Errorf("reduceStream: record %d: %w", n, err)
+		}
+		if fc.Skipped {
+			sum.Skipped++
+			continue
+		}
+		sum.Total += fc.Words
+		sum.Files++
+		sum.Bytes += fc.Bytes
+	}
+}
+
+// `stdoutSummary` is the JSON line that `STDOUT_FORMAT=json` prints, and the data of `STDOUT_TEMPLATE`.
+type stdoutSummary struct {
+	Prefix  string `json:"prefix,omitempty"`
+	Total   int    `json:"total"`
+	Files   int    `json:"files"`
+	Bytes   int64  `json:"bytes"`
+	Skipped int    `json:"skipped"`
+}
+
+// `envInt64` is `envInt` for values that may exceed 32 bits, like file sizes. (On WASM, `int` is only 32 bits wide.)
+func envInt64(name string, def int64) int64 {
+	v, _ := lookupOption(name)
+	if v == "" {
+		recordOption(name, def)
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		log.Fatalf("%s: %s", name, err)
+	}
+	recordOption(name, n)
+	return n
+}
+
+// `isNumber` reports whether `word` is a number: digits, optionally with a sign, decimal or thousands separators, and a trailing percent sign.
+func isNumber(word string) bool {
+	word = strings.TrimSuffix(strings.TrimLeft(word, "+-"), "%")
+	digits := 0
+	for i, r := range word {
+		switch {
+		case unicode.IsDigit(r):
+			digits++
+		case (r == '.' || r == ',') && i > 0 && i < len(word)-1:
+		default:
+			return false
+		}
+	}
+	return digits > 0
+}
+
+// `envBool` reads a boolean option. Unset or unparsable values mean `false`.
+func envBool(name string) bool {
+	v, _ := lookupOption(name)
+	b, _ := strconv.ParseBool(v)
+	recordOption(name, b)
+	return b
+}
+
+// `envBoolDefault` reads a boolean option that is `def` if unset or unparsable.
+func envBoolDefault(name string, def bool) bool {
+	v, _ := lookupOption(name)
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		b = def
+	}
+	recordOption(name, b)
+	return b
+}
+
+// `envString` reads a string option.
+func envString(name string) string {
+	v, _ := lookupOption(name)
+	recordOption(name, v)
+	return v
+}
+
+// `version` identifies the build. Release builds set it with the linker flag `-X main.version=...`.
+var version = "dev"
+
+// `printVersion` writes the version and the tokenizer defaults, which are what most likely changes the counts from one version to the next.
+func printVersion(w io.Writer) {
+	fmt.Fprintf(w, "wordcount %s (%s)\n", version, runtime.Version())
+	fmt.Fprintln(w, "Words: separated by white space")
+	fmt.Fprintf(w, "Maximum line length: %d bytes\n", maxLineLength)
+	fmt.Fprintf(w, "Sentence terminators: %s\n", defaultSentencePunct)
+	fmt.Fprintf(w, "Abbreviations: %s\n", defaultAbbreviations)
+	fmt.Fprintln(w, "Invalid UTF-8: replace")
+}
+
+// `knownOptions` are the names of all options. Every new option must be added here, or else it can't be passed as an argument.
+var knownOptions = []string{
+	"ABBREVIATIONS", "ALLOW_EMPTY", "ALLOW_LIST", "ALL_METRICS", "ALPHABET_LIST", "ALPHA_INNER",
+	"ALPHA_ONLY", "ASCII_CHART", "BASELINE", "BLANK_LINES", "BUNDLE_OUTPUT", "BURST_WINDOW",
+	"BY_EXTENSION", "CHECKPOINT", "CHECKPOINT_EVERY", "CHECKPOINT_FILE", "COMPUTE_ENTROPY",
+	"COUNT_ALPHABET", "COUNT_LINES_MATCHING", "COUNT_SENTENCES", "COUNT_SOCIAL", "DECODE",
+	"DECODE_ERRORS", "DENY_LIST", "DETECT_LANGUAGE", "DIFF_MODE", "DUMP_TOKENS", "EMPTY_FILE",
+	"EXCLUDE_CODE_BLOCKS", "FILE_HANDLERS", "FILE_LIST", "FILTER_LINES", "FINGERPRINT",
+	"FLAG_OUTLIERS", "FOLD_DIGITS", "FREQ_CASE_INSENSITIVE", "FREQ_MEMORY_LIMIT", "FREQ_SORT",
+	"FREQ_SPILL_DIR", "FREQ_STORE", "GROUP_FIELD_REGEX", "GROUP_TOP_WORDS", "HASH_FILENAMES",
+	"HASH_MAPPING", "HASH_SALT", "INCLUDE_MTIME", "INCLUDE_ZERO", "INLINE_CODE", "INVALID_UTF8",
+	"JSON_RECORDS", "LANGUAGE_THRESHOLD", "LOCALE", "LONGEST_LINE", "LONGEST_LINE_PREVIEW",
+	"MANIFEST", "MANIFEST_HEADER", "MANIFEST_LABEL_COLUMN", "MANIFEST_PATH_COLUMN", "MATCH_TERMS",
+	"MATCH_TERMS_FILE", "MAX_DUMP_TOKENS", "MAX_FILES", "MAX_FILE_BYTES", "MAX_FREQ_BYTES",
+	"MAX_VOCAB", "MERGE_FREQUENCIES", "MIN_FILE_BYTES", "MIN_FREQUENCY", "NORMALIZE_NEWLINES",
+	"OUTLIER_METHOD", "OUTLIER_PERCENTILES", "OUTLIER_STDDEVS", "OUTPUT_FORMAT", "OUTPUT_LAYOUT",
+	"OUTPUT_SHARDS", "PATHS_FROM_STDIN", "PIPELINE", "PRE_TOKENIZED", "PROCESS_ORDER",
+	"PROCESS_ORDER_DESC", "PROGRESS", "PROGRESS_INTERVAL", "PROMETHEUS_METRICS", "RANGE_END",
+	"RANGE_START", "READ_STRATEGY", "REDUCE", "REDUCE_STDIN", "REDUCE_WORKERS", "REPORT_MEMORY",
+	"REPORT_MEMORY_INTERVAL", "RESUME", "SENTENCE_PUNCT", "SOCIAL_LIST", "SORT_BY", "SORT_DESC",
+	"SPLIT_LARGE_FILES", "SPLIT_MIN_BYTES", "SPLIT_OUTPUT", "SPLIT_WORKERS", "STDOUT_FORMAT",
+	"STDOUT_NUMERIC_ONLY", "STDOUT_PREFIX", "STDOUT_TEMPLATE", "STOPWORDS_FILE",
+	"STREAM_FLUSH_INTERVAL", "STREAM_NDJSON", "STRIP_CHARS", "STRIP_CONTROL", "TEXT_COLUMNS",
+	"TEXT_DELIMITER", "TEXT_HEADER", "TIMESTAMP_LAYOUT", "TIMESTAMP_REGEX", "TOKEN_SHAPES", "TOP_N",
+	"TOP_WORD", "TOTAL_CASE_SENSITIVE", "TOTAL_EXCLUDE_NUMBERS", "TRANSLITERATE", "TRIM_PREFIX",
+	"TRIM_SUFFIX", "URL_LIST", "URL_TIMEOUT", "VALIDATE_OUTPUT", "VERSION_INFO", "VOCAB_GROWTH",
+	"VOCAB_GROWTH_INTERVAL", "WARNINGS_IN_OUTPUT", "WITHIN_DELIMITERS", "WORDCLOUD",
+	"WORDCLOUD_SIZE", "WORDS_PER_KB", "WORD_REGEX",
+}
+
+// `argOptions` holds the options passed as arguments.
+var argOptions = map[string]string{}
+
+// `errHelp` is returned by `parseArgs` if the arguments ask for help.
+var errHelp = errors.New("help requested")
+
+// `parseArgs` parses arguments like "--top-n 10", "--top-n=10", or "--ascii-chart", which stands for "--ascii-chart true", into `argOptions`.
+func parseArgs(args []string) error {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--help" || arg == "-h" || arg == "-help" {
+			return errHelp
+		}
+		if arg == "--version" {
+			arg = "--version-info"
+		}
+		if !strings.HasPrefix(arg, "-") {
+			return fmt.Errorf("unexpected argument %q", arg)
+		}
+		key, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		name := strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+		if !slices.Contains(knownOptions, name) {
+			return fmt.Errorf("unknown option %q", arg)
+		}
+		if !hasValue {
+			value = "true"
+			if i+1 < len(args) && !strings.HasPrefix(args[i+1], "--") {
+				i++
+				value = args[i]
+			}
+		}
+		argOptions[name] = value
+	}
+	return nil
+}
+
+// `lookupOption` returns the value of an option from the arguments or else from the environment.
+func lookupOption(name string) (string, bool) {
+	if v, ok := argOptions[name]; ok {
+		return v, true
+	}
+	return os.LookupEnv(name)
+}
+
+// `printOptions` writes the usage and the names of all options.
+func printOptions(w io.Writer) {
+	fmt.Fprintln(w, "Usage: wordcount [--option value]...")
+	fmt.Fprintln(w, "\nEach option can also be set as the environment variable in parentheses.\n\nOptions:")
+	for _, name := range knownOptions {
+		fmt.Fprintf(w, "  --%s (%s)\n", strings.ToLower(strings.ReplaceAll(name, "_", "-")), name)
+	}
+}
+
+// `effectiveConfig` records each option that the job has looked up, with the value it resolved to, defaults included. Options that did not matter for this run, like the settings of a disabled feature, are never looked up and thus not recorded.
+var effectiveConfig = map[string]any{}
+
+// The values of `secretOptions` are redacted in the effective configuration.
+var secretOptions = map[string]bool{"HASH_SALT": true}
+
+func recordOption(name string, v any) {
+	if secretOptions[name] && v != "" {
+		v = "REDACTED"
+	}
+	effectiveConfig[name] = v
+}
+
+// `locationOptions` only say where the job writes or keeps its files. They do not change the results and are left out of the fingerprint.
+var locationOptions = map[string]bool{"CHECKPOINT_FILE": true, "FREQ_SPILL_DIR": true, "HASH_MAPPING": true}
+
+// `auxiliaryInputs` are the files that the job reads besides the counted files, like word lists. They are recorded by `recordInput`.
+var auxiliaryInputs = map[string]bool{}
+
+// `recordInput` records a file that the job reads besides the counted files, so that the fingerprint covers it.
+func recordInput(path string) {
+	auxiliaryInputs[filepath.Clean(path)] = true
+}
+
+// `fingerprint` hashes the version, the effective configuration, and the input files. The version comes first, on a line of its own. The configuration is hashed as JSON, with sorted keys and with the secret values, which change the results but must not appear in the output. Then follows a line for each file, sorted by path, with the path and the hash of its content, or "-" if it is missing, and with `withMtime` also its modification time. The same follows for the auxiliary inputs, without modification times.
+func fingerprint(dir string, entries []string, withMtime bool) (string, error) {
+	config := maps.Clone(effectiveConfig)
+	for name := range secretOptions {
+		if _, ok := config[name]; ok {
+			config[name], _ = lookupOption(name)
+		}
+	}
+	for name := range locationOptions {
+		delete(config, name)
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return "", fmt.Errorf("fingerprint: %w", err)
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%q\n", version)
+	h.Write(data)
+	h.Write([]byte("\n"))
+	sorted := slices.Clone(entries)
+	slices.Sort(sorted)
+	for _, e := range sorted {
+		path := filepath.Join(dir, e)
+		sum, err := fileHash(path)
+		if err != nil {
+			return "", fmt.Errorf("fingerprint: %w", err)
+		}
+		if !withMtime {
+			fmt.Fprintf(h, "%q %s\n", e, sum)
+			continue
+		}
+		mtime := "-"
+		fi, err := os.Stat(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("fingerprint: %w", err)
+		}
+		if err == nil {
+			mtime = strconv.FormatInt(fi.ModTime().UnixNano(), 10)
+		}
+		fmt.Fprintf(h, "%q %s %s\n", e, sum, mtime)
+	}
+	h.Write([]byte("\n"))
+	aux := make([]string, 0, len(auxiliaryInputs))
+	for path := range auxiliaryInputs {
+		aux = append(aux, path)
+	}
+	slices.Sort(aux)
+	for _, path := range aux {
+		sum, err := fileHash(path)
+		if err != nil {
+			return "", fmt.Errorf("fingerprint: %w", err)
+		}
+		fmt.Fprintf(h, "%q %s\n", path, sum)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// `fileHash` returns the SHA-256 hash of a file's content in hex, or "-" if there is no such file.
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "-", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+
+// `outputFiles` creates the output files of the job. Usually, these are plain files in the output directory. In bundle mode, the contents are kept in memory until `close` writes them all into one `results.tar.gz`.
+type outputFiles struct {
+	dir     string
+	bundle  bool
+	details bool
+	bundled []*bundledFile
+}
+
+// A `bundledFile` is an output file that waits in memory to be added to the bundle.
+type bundledFile struct {
+	name string
+	bytes.Buffer
+}
+
+func (b *bundledFile) Close() error { return nil }
+
+func (o *outputFiles) create(name string) (io.WriteCloser, error) {
+	if !o.bundle {
+		path, err := o.filePath(name)
+		if err != nil {
+			return nil, err
+		}
+		return os.Create(path)
+	}
+	if o.details && name != "SUMMARY" {
+		name = filepath.Join("details", name)
+	}
+	f := &bundledFile{name: name}
+	o.bundled = append(o.bundled, f)
+	return f, nil
+}
+
+// `filePath` returns the path of an output file as a plain file in the output directory, according to the layout, and creates its directory.
+func (o *outputFiles) filePath(name string) (string, error) {
+	if o.details && name != "SUMMARY" {
+		name = filepath.Join("details", name)
+	}
+	path := filepath.Join(o.dir, name)
+	return path, os.MkdirAll(filepath.Dir(path), 0755)
+}
+
+// `close` writes the bundle. The tar writer and the gzip writer must both be closed, in this order, or else the archive is truncated.
+func (o *outputFiles) close() error {
+	if !o.bundle {
+		return nil
+	}
+	f, err := os.Create(filepath.Join(o.dir, "results.tar.gz"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	for _, b := range o.bundled {
+		hdr := &tar.Header{
+			Name:    b.name,
+			Mode:    0644,
+			Size:    int64(b.Len()),
+			ModTime: time.Now(),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("bundle %s: %w", b.name, err)
+		}
+		if _, err := tw.Write(b.Bytes()); err != nil {
+			return fmt.Errorf("bundle %s: %w", b.name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("bundle: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("bundle: %w", err)
+	}
+	return f.Close()
 }
 /*
 
@@ -0,0 +1,3010 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"maps"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// The job reads its settings from the environment and stops with `log.Fatal` on errors, so the tests run it in a child process: The test binary runs itself with `BACALHAU_TEST_JOB` set to a directory, and `TestMain` then runs the job on the "inputs" and "outputs" directories in there instead of the tests.
+func TestMain(m *testing.M) {
+	if dir := os.Getenv("BACALHAU_TEST_JOB"); dir != "" {
+		inputDir = filepath.Join(dir, "inputs")
+		outputDir = filepath.Join(dir, "outputs")
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// A `testJob` is a directory with the input files of a job and room for its outputs.
+type testJob struct {
+	t   *testing.T
+	dir string
+
+	// `stdin` is the input of the job on `stdin`.
+	stdin string
+}
+
+// `newTestJob` writes the input files, given by their paths and contents, to a new directory. Paths may contain subdirectories.
+func newTestJob(t *testing.T, inputs map[string]string) *testJob {
+	t.Helper()
+	j := &testJob{t: t, dir: t.TempDir()}
+	for name, content := range inputs {
+		j.writeInput(name, content)
+	}
+	if err := os.MkdirAll(j.path("outputs"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+// `path` returns the path of a file in the job directory.
+func (j *testJob) path(name string) string {
+	return filepath.Join(j.dir, filepath.FromSlash(name))
+}
+
+// `writeInput` adds or replaces an input file.
+func (j *testJob) writeInput(name, content string) {
+	j.t.Helper()
+	p := j.path("inputs/" + name)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		j.t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+		j.t.Fatal(err)
+	}
+}
+
+// `exec` runs the job with the given arguments and environment variables, like "TOP_N=5", and returns its `stdout` and `stderr`. `failed` is true if the job exited with an error.
+func (j *testJob) exec(args []string, env ...string) (stdout, stderr string, failed bool) {
+	j.t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(append(os.Environ(), "BACALHAU_TEST_JOB="+j.dir), env...)
+	cmd.Stdin = strings.NewReader(j.stdin)
+	var out, errOut bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &errOut
+	err := cmd.Run()
+	var exit *exec.ExitError
+	if err != nil && !errors.As(err, &exit) {
+		j.t.Fatal(err)
+	}
+	return out.String(), errOut.String(), err != nil
+}
+
+// `run` runs the job and fails the test if the job fails. It returns `stdout`.
+func (j *testJob) run(env ...string) string {
+	j.t.Helper()
+	stdout, stderr, failed := j.exec(nil, env...)
+	if failed {
+		j.t.Fatalf("job failed: %s", stderr)
+	}
+	return stdout
+}
+
+// `fail` runs the job, expects it to fail with a message that contains `want`, and fails the test otherwise.
+func (j *testJob) fail(want string, env ...string) {
+	j.t.Helper()
+	_, stderr, failed := j.exec(nil, env...)
+	if !failed {
+		j.t.Fatalf("job succeeded, want failure with %q", want)
+	}
+	if !strings.Contains(stderr, want) {
+		j.t.Fatalf("stderr = %q, want %q", stderr, want)
+	}
+}
+
+// `output` returns the content of an output file.
+func (j *testJob) output(name string) string {
+	j.t.Helper()
+	data, err := os.ReadFile(j.path("outputs/" + name))
+	if err != nil {
+		j.t.Fatal(err)
+	}
+	return string(data)
+}
+
+// `hasOutput` reports whether the job wrote an output file.
+func (j *testJob) hasOutput(name string) bool {
+	_, err := os.Stat(j.path("outputs/" + name))
+	return err == nil
+}
+
+// `outputJSON` decodes an output file into `v`.
+func (j *testJob) outputJSON(name string, v any) {
+	j.t.Helper()
+	if err := json.Unmarshal([]byte(j.output(name)), v); err != nil {
+		j.t.Fatalf("%s: %v", name, err)
+	}
+}
+
+// `bundle` returns the contents of the files in "results.tar.gz", by name.
+func (j *testJob) bundle() map[string]string {
+	j.t.Helper()
+	f, err := os.Open(j.path("outputs/results.tar.gz"))
+	if err != nil {
+		j.t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		j.t.Fatal(err)
+	}
+	files := map[string]string{}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			j.t.Fatal(err)
+		}
+		var b strings.Builder
+		if _, err := io.Copy(&b, tr); err != nil {
+			j.t.Fatal(err)
+		}
+		files[hdr.Name] = b.String()
+	}
+}
+
+// `report` returns the decoded "count.json".
+func (j *testJob) report() *report {
+	j.t.Helper()
+	r := &report{}
+	j.outputJSON("count.json", r)
+	return r
+}
+
+// `file` returns the result of the named file in the report, and fails the test if there is none.
+func (r *report) file(t *testing.T, name string) fileCount {
+	t.Helper()
+	for _, f := range r.Files {
+		if f.Name == name {
+			return f
+		}
+	}
+	t.Fatalf("no result for %q", name)
+	return fileCount{}
+}
+
+// `countText` counts the words of `text` with the given options, without running the job. It returns the word count and the frequency of each word.
+func countText(t *testing.T, text string, opts *options) (int, map[string]int) {
+	t.Helper()
+	stats := &fileStats{freq: map[string]int{}}
+	n, err := countWords(bufio.NewReader(strings.NewReader(text)), opts, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n, stats.freq
+}
+
+func TestCountWords(t *testing.T) {
+	j := newTestJob(t, map[string]string{
+		"file1.txt": "one two three",
+		"file2.txt": "four\nfive  six\tseven\n",
+		"file3.txt": "",
+	})
+	if got, want := j.run(), "Total word count:  7\n"; got != want {
+		t.Errorf("stdout = %q, want %q", got, want)
+	}
+	r := j.report()
+	for name, want := range map[string]int{"file1.txt": 3, "file2.txt": 4, "file3.txt": 0} {
+		if got := r.file(t, name).Words; got != want {
+			t.Errorf("%s: %d words, want %d", name, got, want)
+		}
+	}
+	if !strings.Contains(j.output("count.txt"), "file1.txt has 3 words") {
+		t.Errorf("count.txt = %q", j.output("count.txt"))
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "the cat and the hat"})
+	stop := j.path("stop.txt")
+	fingerprint := func(env ...string) string {
+		t.Helper()
+		j.run(append(env, "FINGERPRINT=true", "PIPELINE=stopwords", "STOPWORDS_FILE="+stop)...)
+		return j.report().Fingerprint
+	}
+	if err := os.WriteFile(stop, []byte("the"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	first := fingerprint()
+	if first == "" || first != fingerprint() {
+		t.Fatalf("fingerprint is not stable: %q", first)
+	}
+	if fingerprint("CHECKPOINT=true", "CHECKPOINT_FILE="+j.path("a.json")) != fingerprint("CHECKPOINT=true", "CHECKPOINT_FILE="+j.path("b.json")) {
+		t.Error("fingerprint depends on CHECKPOINT_FILE")
+	}
+	if err := os.WriteFile(stop, []byte("the and"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if fingerprint() == first {
+		t.Error("fingerprint ignores the content of STOPWORDS_FILE")
+	}
+
+	before := map[string]string{}
+	for _, env := range []string{"INCLUDE_MTIME=false", "INCLUDE_MTIME=true", "PROCESS_ORDER=mtime"} {
+		before[env] = fingerprint(env)
+	}
+	touched := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(j.path("inputs/a.txt"), touched, touched); err != nil {
+		t.Fatal(err)
+	}
+	if fingerprint("INCLUDE_MTIME=false") != before["INCLUDE_MTIME=false"] {
+		t.Error("fingerprint depends on the modification time without INCLUDE_MTIME")
+	}
+	for _, env := range []string{"INCLUDE_MTIME=true", "PROCESS_ORDER=mtime"} {
+		if fingerprint(env) == before[env] {
+			t.Errorf("fingerprint ignores the modification time with %s", env)
+		}
+	}
+}
+
+func TestFingerprintVersion(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("one two"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(v string) { version = v }(version)
+	version = "1.0"
+	first, err := fingerprint(dir, []string{"a.txt"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version = "1.1"
+	if second, err := fingerprint(dir, []string{"a.txt"}, false); err != nil || second == first {
+		t.Errorf("fingerprint ignores the version: %q, %v", second, err)
+	}
+}
+
+func TestIgnoreFile(t *testing.T) {
+	j := newTestJob(t, map[string]string{
+		ignoreFileName: "# generated files\nbuild/\n*.log\n!keep.log\n",
+		"a.txt":        "one two",
+		"b.log":        "three",
+		"keep.log":     "four",
+		"build/x.txt":  "five six seven",
+	})
+	j.run()
+	r := j.report()
+	if r.Total != 3 || len(r.Files) != 2 {
+		t.Errorf("counted %d words in %d files, want 3 words in a.txt and keep.log", r.Total, len(r.Files))
+	}
+}
+
+func TestIgnoreRules(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, ignoreFileName)
+	if err := os.WriteFile(file, []byte("build/\n/docs/*.md\n**/tmp/**\n*.bak\n!important.bak\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ig, err := readIgnoreFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		dir  bool
+		want bool
+	}{
+		{"build", true, true},
+		{"build", false, false},
+		{"src/build", true, true},
+		{"build/out.txt", false, true},
+		{"docs/a.md", false, true},
+		{"src/docs/a.md", false, false},
+		{"a/tmp/b/c.txt", false, true},
+		{"old.bak", false, true},
+		{"important.bak", false, false},
+		{"main.go", false, false},
+	}
+	for _, tt := range tests {
+		if got := ig.ignored(tt.path, tt.dir); got != tt.want {
+			t.Errorf("ignored(%q, %v) = %v, want %v", tt.path, tt.dir, got, tt.want)
+		}
+	}
+	if (*ignoreRules)(nil).ignored("a.txt", false) {
+		t.Error("nil rules ignore a file")
+	}
+}
+
+func TestCompliance(t *testing.T) {
+	j := newTestJob(t, map[string]string{
+		"lists/deny.txt":  "darn\nheck",
+		"lists/allow.txt": "please",
+		"files.txt":       "a.txt\nb.txt",
+		"a.txt":           "Please be nice",
+		"b.txt":           "Darn it, darn it all",
+	})
+	j.run("DENY_LIST=lists/deny.txt", "ALLOW_LIST=lists/allow.txt", "FILE_LIST=files.txt")
+	var got []fileCompliance
+	j.outputJSON("compliance.json", &got)
+	if len(got) != 2 {
+		t.Fatalf("compliance.json = %+v, want a.txt and b.txt", got)
+	}
+	if !got[0].Pass || got[0].Name != "a.txt" {
+		t.Errorf("a.txt: %+v, want a pass", got[0])
+	}
+	if got[1].Pass || got[1].Banned["darn"] != 2 || len(got[1].Missing) != 1 {
+		t.Errorf("b.txt: %+v, want 2 × darn and missing please", got[1])
+	}
+}
+
+func TestComplianceListsNotCounted(t *testing.T) {
+	j := newTestJob(t, map[string]string{
+		"deny.txt": "darn",
+		"a.txt":    "no bad words",
+	})
+	j.run("DENY_LIST=deny.txt")
+	var got []fileCompliance
+	j.outputJSON("compliance.json", &got)
+	if len(got) != 1 || got[0].Name != "a.txt" || !got[0].Pass {
+		t.Errorf("compliance.json = %+v, want a pass for a.txt only", got)
+	}
+	if r := j.report(); r.Total != 3 {
+		t.Errorf("total = %d, want 3", r.Total)
+	}
+}
+
+func TestFreqStore(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "red green red"})
+	j.run("FREQ_STORE=freq_store.json")
+	j.writeInput("freq_store.json", j.output("freq_store.json"))
+	j.writeInput("a.txt", "red blue")
+	j.run("FREQ_STORE=freq_store.json")
+	store, err := readFreqTable(j.path("outputs/freq_store.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"red": 3, "green": 1, "blue": 1}
+	if !maps.Equal(store, want) {
+		t.Errorf("store = %v, want %v", store, want)
+	}
+	if r := j.report(); r.Total != 2 {
+		t.Errorf("total = %d, want 2, the store must not be counted", r.Total)
+	}
+}
+
+func TestRange(t *testing.T) {
+	var text strings.Builder
+	for i := range 500 {
+		fmt.Fprintf(&text, "word%d %s\n", i, strings.Repeat("x ", i%7))
+	}
+	j := newTestJob(t, map[string]string{"big.txt": text.String()})
+	j.run()
+	whole := j.report()
+	size := int64(text.Len())
+	for _, cuts := range [][]int64{{1}, {10, 11}, {size / 3, 2 * size / 3}, {size - 1}, {size / 2, size + 100}} {
+		bounds := append(append([]int64{0}, cuts...), 0)
+		words, bytes := 0, int64(0)
+		for i := 0; i+1 < len(bounds); i++ {
+			j.run(fmt.Sprintf("RANGE_START=%d", bounds[i]), fmt.Sprintf("RANGE_END=%d", bounds[i+1]))
+			r := j.report()
+			words += r.Total
+			bytes += r.Bytes
+		}
+		if words != whole.Total || bytes != whole.Bytes {
+			t.Errorf("ranges %v: %d words and %d bytes, want %d and %d", bounds, words, bytes, whole.Total, whole.Bytes)
+		}
+	}
+}
+
+func TestRangeNeedsWholeFiles(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.json": `{"text": "hello"}`})
+	j.fail("do not work with FILE_HANDLERS", "RANGE_END=5", "FILE_HANDLERS=defaults")
+	j.fail("not a byte range", "RANGE_START=5", "RANGE_END=5")
+}
+
+func TestResume(t *testing.T) {
+	inputs := map[string]string{"a.txt": "one two", "b.txt": "three", "c.txt": "four five six"}
+	j := newTestJob(t, inputs)
+	checkpoint := j.path("checkpoint.json")
+
+	// A checkpoint that claims more words for a.txt than it has shows that the file was taken over rather than counted again.
+	data, err := json.Marshal(&report{Total: 10, Files: []fileCount{{Name: "a.txt", Words: 10}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(checkpoint, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	j.run("RESUME=true", "CHECKPOINT=true", "CHECKPOINT_FILE="+checkpoint)
+	if r := j.report(); r.Total != 14 || r.file(t, "a.txt").Words != 10 || r.file(t, "c.txt").Words != 3 {
+		t.Errorf("resumed report = %+v, want a.txt from the checkpoint and the rest counted", r)
+	}
+	if cp, err := readReport(checkpoint); err != nil || cp.Total != 14 || len(cp.Files) != 3 {
+		t.Errorf("final checkpoint = %+v, %v, want all files", cp, err)
+	}
+
+	fresh := newTestJob(t, inputs)
+	fresh.run("RESUME=true")
+	if r := fresh.report(); r.Total != 6 {
+		t.Errorf("total without a checkpoint = %d, want 6", r.Total)
+	}
+	fresh.fail("RESUME does not work with", "RESUME=true", "MERGE_FREQUENCIES=true")
+}
+
+func TestExcludeCodeBlocks(t *testing.T) {
+	doc := "# Usage\n\nRun `go build` first.\n\n```go\nfunc main() { fmt.Println(1) }\n```\n\n    indented code here\n\nThen deploy.\n"
+	j := newTestJob(t, map[string]string{"README.md": doc, "notes.txt": "```\nnot markdown\n```\n"})
+	tests := []struct {
+		env  []string
+		want int
+	}{
+		{nil, 18 + 4},
+		{[]string{"EXCLUDE_CODE_BLOCKS=true"}, 8 + 4},
+		{[]string{"EXCLUDE_CODE_BLOCKS=true", "INLINE_CODE=strip"}, 6 + 4},
+		{[]string{"EXCLUDE_CODE_BLOCKS=true", "FILE_HANDLERS=defaults"}, 7 + 4},
+	}
+	for _, tt := range tests {
+		j.run(tt.env...)
+		if got := j.report().Total; got != tt.want {
+			t.Errorf("%v: %d words, want %d", tt.env, got, tt.want)
+		}
+	}
+}
+
+func TestEntropy(t *testing.T) {
+	var e entropySum
+	if e.bits() != 0 {
+		t.Errorf("empty entropy = %v, want 0", e.bits())
+	}
+	for range 4 {
+		e.add(5)
+	}
+	if got := e.bits(); math.Abs(got-2) > 1e-12 {
+		t.Errorf("entropy of 4 equally frequent words = %v, want 2", got)
+	}
+
+	// The same counts in a different order give exactly the same entropy.
+	counts := make([]int, 5000)
+	for i := range counts {
+		counts[i] = i%37 + i%11*3 + 1
+	}
+	var a, b entropySum
+	for _, c := range counts {
+		a.add(c)
+	}
+	for i := len(counts) - 1; i >= 0; i-- {
+		b.add(counts[i])
+	}
+	if a.bits() != b.bits() {
+		t.Errorf("entropy depends on the order: %v vs %v", a.bits(), b.bits())
+	}
+
+	j := newTestJob(t, map[string]string{"a.txt": "a b c d a b c d", "b.txt": "a a a a"})
+	j.run("COMPUTE_ENTROPY=true")
+	r := j.report()
+	if math.Abs(r.file(t, "a.txt").Entropy-2) > 1e-12 || r.file(t, "b.txt").Entropy != 0 {
+		t.Errorf("per-file entropy = %v, %v, want 2 and 0", r.file(t, "a.txt").Entropy, r.file(t, "b.txt").Entropy)
+	}
+	first := j.output("count.json")
+	j.run("COMPUTE_ENTROPY=true")
+	if j.output("count.json") != first {
+		t.Error("entropy differs between identical runs")
+	}
+}
+
+func TestFilterLinesMetrics(t *testing.T) {
+	j := newTestJob(t, map[string]string{"app.log": "INFO a very long informational line with many words in it\nERROR disk full\n\nERROR no space left on device\nINFO ok\n"})
+	j.run("FILTER_LINES=ERROR", "ALL_METRICS=true", "LONGEST_LINE=true", "BLANK_LINES=empty", "COUNT_ALPHABET=true")
+	f := j.report().file(t, "app.log")
+	if f.Words != 9 || f.Lines != 2 || f.BlankLines != 0 {
+		t.Errorf("words, lines, blank lines = %d, %d, %d, want 9, 2, 0", f.Words, f.Lines, f.BlankLines)
+	}
+	if f.LongestLine != 29 || f.LongestLineNumber != 4 || f.LongestLinePreview != "ERROR no space left on device" {
+		t.Errorf("longest line = %d runes in line %d (%q), want 29 in line 4", f.LongestLine, f.LongestLineNumber, f.LongestLinePreview)
+	}
+	if strings.ContainsAny(f.Alphabet, "FIN") {
+		t.Errorf("alphabet %q has letters of filtered lines", f.Alphabet)
+	}
+}
+
+func TestWriteTokensPath(t *testing.T) {
+	dir := t.TempDir()
+	outputs := &outputFiles{dir: filepath.Join(dir, "outputs")}
+	if err := writeTokens(outputs, "sub/a.txt", []string{"one", "two"}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "outputs", "tokens", "sub", "a.txt.txt"))
+	if err != nil || string(data) != "one\ntwo\n" {
+		t.Errorf("tokens = %q, %v, want one and two", data, err)
+	}
+	for _, name := range []string{"../../escape", "/abs/x", "a/../../../b"} {
+		if err := writeTokens(outputs, name, []string{"x"}); err == nil {
+			t.Errorf("writeTokens(%q) succeeded, want an error", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escape.txt")); err == nil {
+		t.Error("tokens written outside of the output directory")
+	}
+}
+
+func TestStreamLayout(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "one two", "b.txt": "three"})
+	j.run("STREAM_NDJSON=true", "OUTPUT_LAYOUT=details", "BUNDLE_OUTPUT=true")
+	if !j.hasOutput("results.tar.gz") || j.hasOutput("count.ndjson.gz") {
+		t.Fatal("want the bundle and the stream in the details directory")
+	}
+	f, err := os.Open(j.path("outputs/details/count.ndjson.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := json.NewDecoder(zr)
+	words := map[string]int{}
+	for dec.More() {
+		var fc fileCount
+		if err := dec.Decode(&fc); err != nil {
+			t.Fatal(err)
+		}
+		words[fc.Name] = fc.Words
+	}
+	if !maps.Equal(words, map[string]int{"a.txt": 2, "b.txt": 1}) {
+		t.Errorf("streamed records = %v", words)
+	}
+}
+
+func TestProgressUpdate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "progress.json")
+	p := &progressFile{path: path, start: time.Now()}
+	var prev progressState
+	for i := range 8 {
+		if err := p.update(i, 7); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var state progressState
+		if err := json.Unmarshal(data, &state); err != nil {
+			t.Fatalf("update %d: progress.json is not valid JSON: %v\n%s", i, err, data)
+		}
+		if state.Processed != i || state.Total != 7 || i > 0 && (state.Percent <= prev.Percent || state.Elapsed < prev.Elapsed) {
+			t.Errorf("update %d: progress %+v after %+v", i, state, prev)
+		}
+		prev = state
+	}
+	if prev.Percent != 100 {
+		t.Errorf("progress after all files = %v%%, want 100%%", prev.Percent)
+	}
+	if _, err := os.Stat(path + ".tmp"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+
+	p.interval = time.Hour
+	if err := p.update(1, 1); err != nil {
+		t.Fatal(err)
+	}
+	var state progressState
+	if data, err := os.ReadFile(path); err != nil || json.Unmarshal(data, &state) != nil || state.Processed != 7 {
+		t.Errorf("progress within the interval = %+v, %v, want no new write", state, err)
+	}
+	if err := (*progressFile)(nil).update(1, 1); err != nil {
+		t.Errorf("nil progress file: %v", err)
+	}
+}
+
+func TestProgressLayout(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "one two", "b.txt": "three"})
+	j.run("PROGRESS=true", "OUTPUT_LAYOUT=details", "BUNDLE_OUTPUT=true")
+	if j.hasOutput("progress.json") {
+		t.Error("progress.json is not in the details directory")
+	}
+	var state progressState
+	j.outputJSON("details/progress.json", &state)
+	if state.Processed != 2 || state.Total != 2 || state.Percent != 100 {
+		t.Errorf("progress = %+v, want 2 of 2 files", state)
+	}
+}
+
+func TestMaxFreqBytes(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "alpha beta beta gamma gamma gamma"})
+	least := 1 + truncationReserve()
+	j.fail("MAX_FREQ_BYTES: 20 is too small", "MERGE_FREQUENCIES=true", "MAX_FREQ_BYTES=20")
+	j.fail("too small", "MERGE_FREQUENCIES=true", fmt.Sprintf("MAX_FREQ_BYTES=%d", least-1))
+
+	j.run("MERGE_FREQUENCIES=true", fmt.Sprintf("MAX_FREQ_BYTES=%d", least))
+	var words []wordCount
+	j.outputJSON("frequencies.json", &words)
+	if len(words) != 1 || words[0] != (wordCount{Word: truncatedWord, Count: 6}) {
+		t.Errorf("table at the smallest limit = %v, want only the note", words)
+	}
+	if size := int64(len(j.output("frequencies.json"))); size > least {
+		t.Errorf("table has %d bytes, limit %d", size, least)
+	}
+
+	j.run("MERGE_FREQUENCIES=true", fmt.Sprintf("MAX_FREQ_BYTES=%d", least+60))
+	j.outputJSON("frequencies.json", &words)
+	if len(words) != 2 || words[0] != (wordCount{Word: "gamma", Count: 3}) || words[1] != (wordCount{Word: truncatedWord, Count: 3}) {
+		t.Errorf("table = %v, want gamma and the note", words)
+	}
+}
+
+func TestMaxVocab(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "a a a a b b b c c d e"})
+	j.run("MERGE_FREQUENCIES=true", "MAX_VOCAB=1", "MIN_FREQUENCY=2")
+	var words []wordCount
+	j.outputJSON("frequencies.json", &words)
+	want := []wordCount{{"a", 4}, {otherWord, 7}}
+	if fmt.Sprint(words) != fmt.Sprint(want) {
+		t.Errorf("table = %v, want %v", words, want)
+	}
+	if out := j.output("frequencies.json"); !strings.Contains(out, `"<OTHER>"`) {
+		t.Errorf("<OTHER> is escaped:\n%s", out)
+	}
+
+	// With spilled frequencies, the words below the minimum are other words, too.
+	j.writeInput("b.txt", "e f")
+	j.run("MERGE_FREQUENCIES=true", "MAX_VOCAB=1", "MIN_FREQUENCY=2", "FREQ_MEMORY_LIMIT=1", "FREQ_SPILL_DIR="+t.TempDir())
+	j.outputJSON("frequencies.json", &words)
+	want = []wordCount{{"a", 4}, {otherWord, 9}}
+	if fmt.Sprint(words) != fmt.Sprint(want) {
+		t.Errorf("spilled table = %v, want %v", words, want)
+	}
+
+	j.run("MERGE_FREQUENCIES=true", "MIN_FREQUENCY=2")
+	j.outputJSON("frequencies.json", &words)
+	want = []wordCount{{"a", 4}, {"b", 3}, {"c", 2}, {"e", 2}}
+	if fmt.Sprint(words) != fmt.Sprint(want) {
+		t.Errorf("table without a word limit = %v, want %v", words, want)
+	}
+}
+
+func TestDetectLanguage(t *testing.T) {
+	j := newTestJob(t, map[string]string{
+		"de.txt":    "Die Katze sitzt auf der Matte und schläft, weil es heute draußen regnet und der Wind weht.",
+		"en.txt":    "The cat is sitting on the mat and sleeping, because it is raining outside and the wind blows.",
+		"fr.txt":    "Le chat est assis sur le tapis et dort, parce qu'il pleut dehors et que le vent souffle.",
+		"empty.txt": "",
+		"nums.txt":  "123 456 789",
+	})
+	j.run("DETECT_LANGUAGE=true")
+	var got []fileLanguage
+	j.outputJSON("languages.json", &got)
+	want := map[string]string{"de.txt": "de", "en.txt": "en", "fr.txt": "fr", "empty.txt": "unknown", "nums.txt": "unknown"}
+	if len(got) != len(want) {
+		t.Fatalf("languages = %v", got)
+	}
+	for _, l := range got {
+		if l.Language != want[l.Name] {
+			t.Errorf("%s: %s (%v), want %s", l.Name, l.Language, l.Confidence, want[l.Name])
+		}
+	}
+	j.run("DETECT_LANGUAGE=true", "LANGUAGE_THRESHOLD=1")
+	j.outputJSON("languages.json", &got)
+	for _, l := range got {
+		if l.Language != "unknown" {
+			t.Errorf("%s: %s at the highest threshold, want unknown", l.Name, l.Language)
+		}
+	}
+}
+
+func TestDetectLanguageSplit(t *testing.T) {
+	en := strings.Repeat("the people of this town said that they would walk through the weather\n", 200)
+	fr := strings.Repeat("les êtres humains naissent libres et égaux en dignité et en droits\n", 1000)
+	j := newTestJob(t, map[string]string{"mixed.txt": en + fr})
+	var whole, split []fileLanguage
+	j.run("DETECT_LANGUAGE=true")
+	j.outputJSON("languages.json", &whole)
+	j.run("DETECT_LANGUAGE=true", "SPLIT_LARGE_FILES=true", "SPLIT_MIN_BYTES=1", "SPLIT_WORKERS=4")
+	j.outputJSON("languages.json", &split)
+	if len(whole) != 1 || whole[0].Language != "en" {
+		t.Fatalf("languages = %v, want en from the first words", whole)
+	}
+	if len(split) != 1 || split[0] != whole[0] {
+		t.Errorf("languages of the split file = %v, want %v", split, whole)
+	}
+}
+
+func TestFilterLines(t *testing.T) {
+	j := newTestJob(t, map[string]string{
+		"app.log":   "INFO started\nERROR disk full\nWARN low memory\nERROR no route to host\n",
+		"other.log": "INFO all good\n",
+	})
+	j.run("FILTER_LINES=^ERROR")
+	r := j.report()
+	if r.file(t, "app.log").Words != 8 || r.file(t, "other.log").Words != 0 || r.Total != 8 {
+		t.Errorf("words = %d and %d, total %d, want 8, 0, and 8", r.file(t, "app.log").Words, r.file(t, "other.log").Words, r.Total)
+	}
+	j.fail("FILTER_LINES:", "FILTER_LINES=(")
+}
+
+func TestBundleOutput(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "one two three"})
+	j.run("BUNDLE_OUTPUT=true")
+	entries, err := os.ReadDir(j.path("outputs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "results.tar.gz" {
+		t.Fatalf("outputs = %v, want only results.tar.gz", entries)
+	}
+	files := j.bundle()
+	if !strings.Contains(files["count.txt"], "a.txt has 3 words") {
+		t.Errorf("count.txt in the bundle = %q", files["count.txt"])
+	}
+	var r report
+	if err := json.Unmarshal([]byte(files["count.json"]), &r); err != nil || r.Total != 3 {
+		t.Errorf("count.json in the bundle: total %d, %v", r.Total, err)
+	}
+}
+
+func TestAlphaOnly(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "Hello world 42 don't well-known x1 Größe -"})
+	j.run("ALPHA_ONLY=true")
+	if r := j.report(); r.Total != 3 {
+		t.Errorf("total = %d, want 3", r.Total)
+	}
+	j.run("ALPHA_ONLY=true", "ALPHA_INNER='-")
+	if r := j.report(); r.Total != 5 {
+		t.Errorf("total with inner apostrophes and hyphens = %d, want 5", r.Total)
+	}
+}
+
+func TestBaseline(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "one two", "b.txt": "three", "c.txt": "four five"})
+	j.run()
+	base := j.path("base.json")
+	if err := os.WriteFile(base, []byte(j.output("count.json")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(j.path("inputs/b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	j.writeInput("c.txt", "four five six")
+	j.writeInput("d.txt", "seven")
+	j.run("BASELINE=" + base)
+	var d reportDiff
+	j.outputJSON("diff.json", &d)
+	if len(d.Added) != 1 || d.Added[0].Name != "d.txt" || len(d.Removed) != 1 || d.Removed[0].Name != "b.txt" {
+		t.Errorf("added %v and removed %v, want d.txt and b.txt", d.Added, d.Removed)
+	}
+	if len(d.Changed) != 1 || d.Changed[0] != (fileChange{Name: "c.txt", Before: 2, After: 3, Delta: 1}) {
+		t.Errorf("changed = %v, want c.txt from 2 to 3", d.Changed)
+	}
+	if d.Unchanged != 1 || d.TotalDelta != 1 {
+		t.Errorf("unchanged %d, total delta %d, want 1 and 1", d.Unchanged, d.TotalDelta)
+	}
+}
+
+func TestFileHandlers(t *testing.T) {
+	j := newTestJob(t, map[string]string{
+		"a.md":    "# Title\n\n- item one\n\nSee [the docs](https://example.com/docs).\n",
+		"b.html":  "<html><head><style>p { color: red }</style></head><body><p>Hello <b>world</b> &amp; more</p></body></html>",
+		"c.json":  `{"title": "two words", "tags": ["three", "more words"], "count": 3}`,
+		"d.txt":   "# not a heading",
+		"e.notes": "- one item",
+	})
+	j.run("FILE_HANDLERS=defaults,notes=markdown")
+	r := j.report()
+	for name, want := range map[string]int{"a.md": 6, "b.html": 4, "c.json": 5, "d.txt": 4, "e.notes": 2} {
+		if got := r.file(t, name).Words; got != want {
+			t.Errorf("%s: %d words, want %d", name, got, want)
+		}
+	}
+	j.fail("FILE_HANDLERS:", "FILE_HANDLERS=.txt=unknown")
+
+	j.writeInput("c.json", "{not json")
+	j.fail("preprocess", "FILE_HANDLERS=defaults")
+}
+
+func TestASCIIChart(t *testing.T) {
+	var b strings.Builder
+	printChart(&b, []wordCount{{"the", 40}, {"a", 10}, {"épée", 1}}, 20)
+	want := "the  #################### 40\n" +
+		"a    ##### 10\n" +
+		"épée # 1\n"
+	if b.String() != want {
+		t.Errorf("chart =\n%s\nwant\n%s", b.String(), want)
+	}
+
+	j := newTestJob(t, map[string]string{"a.txt": "b a b c b a"})
+	out := j.run("ASCII_CHART=true", "TOP_N=2")
+	if !strings.Contains(out, "b "+strings.Repeat("#", 40)+" 3\na "+strings.Repeat("#", 26)+" 2\n") || strings.Contains(out, "c ") {
+		t.Errorf("stdout =\n%s", out)
+	}
+	j.fail("ASCII_CHART does not work with STDOUT_FORMAT=json", "ASCII_CHART=true", "STDOUT_FORMAT=json")
+}
+
+func TestFileSizeLimits(t *testing.T) {
+	j := newTestJob(t, map[string]string{"small.txt": "a", "medium.txt": "one two three", "large.txt": strings.Repeat("word ", 20)})
+	j.run("MIN_FILE_BYTES=5", "MAX_FILE_BYTES=50")
+	r := j.report()
+	if len(r.Files) != 1 || r.Files[0].Name != "medium.txt" {
+		t.Errorf("counted %v, want only medium.txt", r.Files)
+	}
+	want := []skippedFile{
+		{"large.txt", "size 100 above MAX_FILE_BYTES 50"},
+		{"small.txt", "size 1 below MIN_FILE_BYTES 5"},
+	}
+	if fmt.Sprint(r.Skipped) != fmt.Sprint(want) {
+		t.Errorf("skipped = %v, want %v", r.Skipped, want)
+	}
+}
+
+func TestIncludeZero(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "one two", "big.txt": strings.Repeat("word ", 20)})
+	j.run("MAX_FILE_BYTES=50")
+	if r := j.report(); len(r.Files) != 1 || len(r.Skipped) != 1 {
+		t.Errorf("files %v, skipped %v, want a.txt counted and big.txt skipped", r.Files, r.Skipped)
+	}
+	j.run("MAX_FILE_BYTES=50", "INCLUDE_ZERO=true")
+	r := j.report()
+	if len(r.Files) != 2 || len(r.Skipped) != 1 {
+		t.Fatalf("files %v, skipped %v, want both files listed", r.Files, r.Skipped)
+	}
+	if big := r.file(t, "big.txt"); !big.Skipped || big.Words != 0 {
+		t.Errorf("big.txt = %+v, want skipped with zero words", big)
+	}
+	if r.Total != 2 {
+		t.Errorf("total = %d, want 2", r.Total)
+	}
+}
+
+func TestFileList(t *testing.T) {
+	j := newTestJob(t, map[string]string{
+		"list.txt":  "b.txt\n\nsub/c.txt\nmissing.txt\n../outside.txt\na.txt\n",
+		"a.txt":     "one",
+		"b.txt":     "one two",
+		"sub/c.txt": "one two three",
+		"d.txt":     "not listed",
+	})
+	j.run("FILE_LIST=list.txt")
+	r := j.report()
+	var names []string
+	for _, f := range r.Files {
+		names = append(names, f.Name)
+	}
+	if strings.Join(names, " ") != "b.txt sub/c.txt a.txt" || r.Total != 6 {
+		t.Errorf("counted %v with %d words, want b.txt, sub/c.txt, and a.txt in this order, with 6 words", names, r.Total)
+	}
+	want := []skippedFile{{"missing.txt", "file not found"}, {"../outside.txt", "outside the input directory"}}
+	if fmt.Sprint(r.Skipped) != fmt.Sprint(want) {
+		t.Errorf("skipped = %v, want %v", r.Skipped, want)
+	}
+}
+
+func TestHashFilenames(t *testing.T) {
+	j := newTestJob(t, map[string]string{"secret.txt": "one two"})
+	mapping := j.path("mapping.json")
+	j.run("HASH_FILENAMES=true", "HASH_SALT=pepper", "HASH_MAPPING="+mapping)
+	sum := sha256.Sum256([]byte("peppersecret.txt"))
+	hashed := hex.EncodeToString(sum[:])
+	if r := j.report(); len(r.Files) != 1 || r.Files[0].Name != hashed {
+		t.Errorf("files = %v, want the salted hash %s", r.Files, hashed)
+	}
+	entries, err := os.ReadDir(j.path("outputs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if strings.Contains(j.output(e.Name()), "secret") {
+			t.Errorf("%s contains the file name", e.Name())
+		}
+	}
+	data, err := os.ReadFile(mapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names map[string]string
+	if err := json.Unmarshal(data, &names); err != nil || names[hashed] != "secret.txt" {
+		t.Errorf("mapping = %s, %v", data, err)
+	}
+
+	for _, mapping := range []string{j.path("outputs/mapping.json"), j.path("outputs/sub/../mapping.json"), j.path("inputs/../outputs/mapping.json"), j.path("outputs")} {
+		j.fail("where it would reveal the file names", "HASH_FILENAMES=true", "HASH_MAPPING="+mapping)
+	}
+	if j.hasOutput("mapping.json") {
+		t.Error("the mapping was written to the output directory")
+	}
+	j.run("HASH_FILENAMES=true", "HASH_MAPPING="+j.path("outputs-mapping.json"))
+}
+
+func TestIsWithin(t *testing.T) {
+	for _, tc := range []struct {
+		dir, path string
+		want      bool
+	}{
+		{"/outputs", "/outputs/mapping.json", true},
+		{"/outputs", "/outputs/a/b/mapping.json", true},
+		{"/outputs", "/outputs", true},
+		{"/outputs/", "/outputs/./x/../mapping.json", true},
+		{"/outputs", "/outputs/../outputs/mapping.json", true},
+		{"/outputs", "/outputs-mapping.json", false},
+		{"/outputs", "/tmp/mapping.json", false},
+		{"/outputs", "/outputs/../mapping.json", false},
+		{"/outputs", "/..mapping.json", false},
+	} {
+		if got := isWithin(tc.dir, tc.path); got != tc.want {
+			t.Errorf("isWithin(%q, %q) = %v, want %v", tc.dir, tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestSplitLargeFiles(t *testing.T) {
+	var b strings.Builder
+	for i := range 500 {
+		fmt.Fprintf(&b, "line %d has some words, %d of them\n", i, i%7)
+	}
+	b.WriteString("a last line without a break")
+	j := newTestJob(t, map[string]string{"big.txt": b.String(), "small.txt": "one two"})
+	j.run("MERGE_FREQUENCIES=true", "ALL_METRICS=true")
+	whole, wholeFreq := j.report(), j.output("frequencies.json")
+	j.run("MERGE_FREQUENCIES=true", "ALL_METRICS=true", "SPLIT_LARGE_FILES=true", "SPLIT_MIN_BYTES=1000", "SPLIT_WORKERS=7")
+	split := j.report()
+	for _, name := range []string{"big.txt", "small.txt"} {
+		w, s := whole.file(t, name), split.file(t, name)
+		if w.Words != s.Words || w.Lines != s.Lines || w.Runes != s.Runes || w.Graphemes != s.Graphemes {
+			t.Errorf("%s: split %+v, whole %+v", name, s, w)
+		}
+	}
+	if j.output("frequencies.json") != wholeFreq {
+		t.Error("the frequencies of the split file differ")
+	}
+
+	f, err := os.Open(j.path("inputs/big.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	size := int64(b.Len())
+	bounds, err := chunkBounds(f, size, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bounds) != 8 || bounds[0] != 0 || bounds[7] != size {
+		t.Fatalf("bounds = %v", bounds)
+	}
+	for _, pos := range bounds[1:7] {
+		if b.String()[pos-1] != '\n' {
+			t.Errorf("chunk at %d does not start a line", pos)
+		}
+	}
+}
+
+func TestExcludeNumbers(t *testing.T) {
+	tests := map[string]bool{
+		"42": true, "-3.14": true, "+1,000,000": true, "50%": true, "007": true,
+		"": false, "%": false, "-": false, "1.": false, ".5": false, "1.2.3": true, "v2": false, "3rd": false, "1e6": false,
+	}
+	for word, want := range tests {
+		if got := isNumber(word); got != want {
+			t.Errorf("isNumber(%q) = %v, want %v", word, got, want)
+		}
+	}
+
+	j := newTestJob(t, map[string]string{"a.txt": "In 2023 revenue grew 12% to 1,500 units in v2"})
+	j.run("TOTAL_EXCLUDE_NUMBERS=true")
+	r := j.report()
+	if r.Total != 7 || r.Numbers != 3 || r.file(t, "a.txt").Numbers != 3 {
+		t.Errorf("total %d, numbers %d, want 7 words and 3 numbers", r.Total, r.Numbers)
+	}
+}
+
+func TestVocabGrowth(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "a b a c", "b.txt": "d a e"})
+	j.run("VOCAB_GROWTH=true", "VOCAB_GROWTH_INTERVAL=2")
+	var curve []growthPoint
+	j.outputJSON("vocab_growth.json", &curve)
+	want := []growthPoint{{2, 2}, {4, 3}, {6, 4}, {7, 5}}
+	if fmt.Sprint(curve) != fmt.Sprint(want) {
+		t.Errorf("curve = %v, want %v", curve, want)
+	}
+}
+
+func TestStripControl(t *testing.T) {
+	text := "\ufeffhello\x00world \x07bell\ttab\r\nend"
+	n, freq := countText(t, text, &options{stripControl: true})
+	want := map[string]int{"helloworld": 1, "bell": 1, "tab": 1, "end": 1}
+	if n != 4 || !maps.Equal(freq, want) {
+		t.Errorf("stripped: %d words %v, want %v", n, freq, want)
+	}
+	if _, freq := countText(t, text, &options{}); freq["\ufeffhello\x00world"] != 1 {
+		t.Errorf("unstripped: %v, want the BOM and NUL kept", freq)
+	}
+}
+
+func TestWordCloud(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "x x x x y y z", "b.txt": "z z"})
+	j.run("WORDCLOUD=global", "WORDCLOUD_SIZE=2")
+	var cloud wordCloud
+	j.outputJSON("wordcloud.json", &cloud)
+	want := []weightedWord{{"x", 4, 1}, {"z", 3, 0.75}}
+	if fmt.Sprint(cloud.Words) != fmt.Sprint(want) || cloud.Files != nil {
+		t.Errorf("global cloud = %+v, want %v", cloud, want)
+	}
+
+	j.run("WORDCLOUD=file", "WORDCLOUD_SIZE=2")
+	cloud = wordCloud{}
+	j.outputJSON("wordcloud.json", &cloud)
+	wantFiles := []fileCloud{
+		{"a.txt", []weightedWord{{"x", 4, 1}, {"y", 2, 0.5}}},
+		{"b.txt", []weightedWord{{"z", 2, 1}}},
+	}
+	if fmt.Sprint(cloud.Files) != fmt.Sprint(wantFiles) || cloud.Words != nil {
+		t.Errorf("file clouds = %+v, want %v", cloud, wantFiles)
+	}
+
+	j.fail("WORDCLOUD: unknown mode", "WORDCLOUD=everywhere")
+	j.fail("MERGE_FREQUENCIES does not work with WORDCLOUD=file", "WORDCLOUD=file", "MERGE_FREQUENCIES=true")
+}
+
+func TestCountSentences(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "Dr. Smith arrived. \"Is it 3.14?\" she asked! Then she left"})
+	j.run("COUNT_SENTENCES=true")
+	f := j.report().file(t, "a.txt")
+	if f.Sentences != 4 || f.WordsPerSentence != 2.75 {
+		t.Errorf("%d sentences, %v words per sentence, want 4 and 2.75", f.Sentences, f.WordsPerSentence)
+	}
+	j.run("COUNT_SENTENCES=true", "ABBREVIATIONS=")
+	if f := j.report().file(t, "a.txt"); f.Sentences != 5 {
+		t.Errorf("%d sentences without abbreviations, want 5", f.Sentences)
+	}
+	j.run()
+	if f := j.report().file(t, "a.txt"); f.Sentences != 0 {
+		t.Errorf("%d sentences without COUNT_SENTENCES, want none", f.Sentences)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "one two", "b.txt": "three", "big.txt": strings.Repeat("word ", 20)})
+	j.run("MAX_FILE_BYTES=50")
+	if got, want := j.output("summary.txt"), "files=2 words=3 bytes=12 skipped=1\n"; got != want {
+		t.Errorf("summary.txt = %q, want %q", got, want)
+	}
+	j.run("MAX_FILE_BYTES=50", "INCLUDE_ZERO=true")
+	if got, want := j.output("summary.txt"), "files=2 words=3 bytes=12 skipped=1\n"; got != want {
+		t.Errorf("summary.txt with INCLUDE_ZERO = %q, want %q", got, want)
+	}
+}
+
+func TestWordRegex(t *testing.T) {
+	n, freq := countText(t, "It's 9:30, isn't it? (yes)", &options{wordRegex: regexp.MustCompile(`[A-Za-z']+`)})
+	want := map[string]int{"It's": 1, "isn't": 1, "it": 1, "yes": 1}
+	if n != 4 || !maps.Equal(freq, want) {
+		t.Errorf("%d words %v, want %v", n, freq, want)
+	}
+
+	j := newTestJob(t, map[string]string{"a.txt": "foo_bar baz-qux\n42"})
+	j.run("WORD_REGEX=[a-z]+")
+	if r := j.report(); r.Total != 4 {
+		t.Errorf("total = %d, want 4", r.Total)
+	}
+	j.fail("matches the empty string", "WORD_REGEX=[a-z]*")
+	j.fail("WORD_REGEX:", "WORD_REGEX=[a-z")
+}
+
+func TestReduce(t *testing.T) {
+	node1 := newTestJob(t, map[string]string{"b.txt": "one two", "big.txt": strings.Repeat("word ", 20)})
+	node1.run("MAX_FILE_BYTES=50")
+	node2 := newTestJob(t, map[string]string{"a.txt": "three four five"})
+	node2.run()
+
+	j := newTestJob(t, map[string]string{
+		"node1.json": node1.output("count.json"),
+		"node2.json": node2.output("count.json"),
+	})
+	out := j.run("REDUCE=true", "REDUCE_WORKERS=2")
+	if out != "Total word count:  5\n" {
+		t.Errorf("stdout = %q", out)
+	}
+	r := j.report()
+	if r.Total != 5 || r.Bytes != 22 || len(r.Files) != 2 || r.Files[0].Name != "a.txt" || r.Files[1].Name != "b.txt" || len(r.Skipped) != 1 {
+		t.Errorf("merged report = %+v", r)
+	}
+
+	j.writeInput("node3.json", "{")
+	j.fail("readReport", "REDUCE=true")
+}
+
+// `reduceShards` returns the outputs of `n` jobs as inputs for a reduce job: a "count.json" and a "frequencies.json" for each. File names repeat across the shards, and so do words and their counts, so that the order of the merge shows in the results.
+func reduceShards(n int) map[string]string {
+	shards := map[string]string{}
+	for i := range n {
+		r := &report{SchemaVersion: reportSchemaVersion, Files: []fileCount{}}
+		for k := range 3 {
+			f := fileCount{Name: fmt.Sprintf("doc%02d.txt", (i+k)%40), Words: i%7 + k, Bytes: int64(10*i + k)}
+			r.Files = append(r.Files, f)
+			r.Total += f.Words
+			r.Bytes += f.Bytes
+		}
+		if i%10 == 0 {
+			r.Skipped = append(r.Skipped, skippedFile{Name: fmt.Sprintf("big%d.bin", i), Reason: "too big"})
+			r.Warnings = append(r.Warnings, warning{File: fmt.Sprintf("doc%02d.txt", i%40), Message: fmt.Sprintf("shard %d", i)})
+		}
+		var words []wordCount
+		for k := range 20 {
+			words = append(words, wordCount{Word: fmt.Sprintf("w%d", (i*k)%97), Count: k%3 + 1})
+		}
+		data, _ := json.Marshal(r)
+		shards[fmt.Sprintf("shard%04d.json", i)] = string(data)
+		data, _ = json.Marshal(words)
+		shards[fmt.Sprintf("shard%04d-frequencies.json", i)] = string(data)
+	}
+	return shards
+}
+
+func TestReduceWorkers(t *testing.T) {
+	j := newTestJob(t, reduceShards(300))
+	results := map[string][3]string{}
+	for _, workers := range []string{"1", "8"} {
+		stdout := j.run("REDUCE=true", "REDUCE_WORKERS="+workers)
+		results[workers] = [3]string{stdout, j.output("count.json"), j.output("frequencies.json")}
+	}
+	for i, name := range []string{"stdout", "count.json", "frequencies.json"} {
+		if one, eight := results["1"][i], results["8"][i]; one != eight {
+			t.Errorf("%s differs with 8 workers:\n%s\nwant\n%s", name, eight, one)
+		}
+	}
+
+	r := j.report()
+	total, files, occurrences := 0, 0, 0
+	for i := range 300 {
+		for k := range 3 {
+			total += i%7 + k
+			files++
+		}
+		for k := range 20 {
+			occurrences += k%3 + 1
+		}
+	}
+	if r.Total != total || len(r.Files) != files || len(r.Skipped) != 30 || len(r.Warnings) != 30 {
+		t.Errorf("total %d, %d files, %d skipped, %d warnings, want %d, %d, 30, 30", r.Total, len(r.Files), len(r.Skipped), len(r.Warnings), total, files)
+	}
+	if r.Warnings[1].Message != "shard 10" || r.Skipped[29].Name != "big290.bin" {
+		t.Errorf("warnings %v and skipped files %v are not in the order of the shards", r.Warnings, r.Skipped)
+	}
+	var words []wordCount
+	j.outputJSON("frequencies.json", &words)
+	sum := 0
+	for _, wc := range words {
+		sum += wc.Count
+	}
+	if sum != occurrences || !slices.IsSortedFunc(words, func(a, b wordCount) int {
+		if byFrequency(a, b) {
+			return -1
+		}
+		return 1
+	}) {
+		t.Errorf("frequencies.json has %d words in all, want %d, most frequent first", sum, occurrences)
+	}
+
+	j.run("REDUCE=true", "REDUCE_WORKERS=8", "MAX_VOCAB=5")
+	j.outputJSON("frequencies.json", &words)
+	if len(words) != 6 || words[5].Word != otherWord {
+		t.Errorf("frequencies.json with MAX_VOCAB=5 = %v", words)
+	}
+}
+
+func BenchmarkReduce(b *testing.B) {
+	dir := b.TempDir()
+	var names []string
+	for name, content := range reduceShards(2000) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			b.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, workers := range []int{1, 2, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for range b.N {
+				if _, _, err := reduceReports(dir, names, workers); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestGroupField(t *testing.T) {
+	j := newTestJob(t, map[string]string{
+		"a.csv": "alice,hello there\nbob,hi\n,anonymous comment\n",
+		"b.csv": "alice,good morning everyone\nno comma here\n",
+	})
+	j.run("GROUP_FIELD_REGEX=^(\\w*),")
+	var byKey map[string]int
+	j.outputJSON("by_key.json", &byKey)
+	want := map[string]int{"alice": 5, "bob": 1, "other": 5}
+	if !maps.Equal(byKey, want) {
+		t.Errorf("by_key.json = %v, want %v", byKey, want)
+	}
+	j.fail("has no capture group", "GROUP_FIELD_REGEX=^\\w+,")
+}
+
+func TestStdoutPrefix(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "one two three"})
+	if out := j.run("STDOUT_PREFIX=job-7"); out != "job-7 Total word count:  3\n" {
+		t.Errorf("stdout with prefix = %q", out)
+	}
+	if out := j.run("STDOUT_NUMERIC_ONLY=true"); out != "3\n" {
+		t.Errorf("numeric stdout = %q", out)
+	}
+	if out := j.run("STDOUT_NUMERIC_ONLY=true", "STDOUT_PREFIX=job-7"); out != "job-7 3\n" {
+		t.Errorf("numeric stdout with prefix = %q", out)
+	}
+}
+
+func TestInvalidUTF8(t *testing.T) {
+	text := "ab\xffcd ef \xfe\xfe gh"
+	if n, freq := countText(t, text, &options{invalidUTF8: "replace"}); n != 4 || freq["ab\xffcd"] != 1 {
+		t.Errorf("replace: %d words %v, want 4 with the invalid bytes kept", n, freq)
+	}
+	want := map[string]int{"abcd": 1, "ef": 1, "gh": 1}
+	if n, freq := countText(t, text, &options{invalidUTF8: "skip"}); n != 3 || !maps.Equal(freq, want) {
+		t.Errorf("skip: %d words %v, want %v", n, freq, want)
+	}
+
+	j := newTestJob(t, map[string]string{"bad.txt": text, "good.txt": "fine"})
+	j.run("INVALID_UTF8=error")
+	r := j.report()
+	if len(r.Files) != 1 || r.Files[0].Name != "good.txt" || len(r.Skipped) != 1 || r.Skipped[0] != (skippedFile{"bad.txt", "invalid UTF-8"}) {
+		t.Errorf("files %v, skipped %v, want bad.txt skipped", r.Files, r.Skipped)
+	}
+	j.run("INVALID_UTF8=skip")
+	if r := j.report(); r.Total != 4 {
+		t.Errorf("total with skip = %d, want 4", r.Total)
+	}
+	j.fail("INVALID_UTF8: unknown mode", "INVALID_UTF8=ignore")
+}
+
+func TestSortBy(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "one two", "b.txt": "one two three", "c.txt": "one", "d.txt": "one two"})
+	names := func(env ...string) string {
+		t.Helper()
+		j.run(env...)
+		var names []string
+		for _, f := range j.report().Files {
+			names = append(names, f.Name)
+		}
+		return strings.Join(names, " ")
+	}
+	for _, tt := range []struct {
+		env  []string
+		want string
+	}{
+		{nil, "a.txt b.txt c.txt d.txt"},
+		{[]string{"SORT_BY=words"}, "c.txt a.txt d.txt b.txt"},
+		{[]string{"SORT_BY=words", "SORT_DESC=true"}, "b.txt a.txt d.txt c.txt"},
+		{[]string{"SORT_BY=name", "SORT_DESC=true"}, "d.txt c.txt b.txt a.txt"},
+	} {
+		if got := names(tt.env...); got != tt.want {
+			t.Errorf("%v: %s, want %s", tt.env, got, tt.want)
+		}
+	}
+	j.fail("SORT_BY: unknown key", "SORT_BY=size")
+}
+
+func TestMatchTerms(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.log": "error timeout error\nok\n", "b.log": "all fine"})
+	termsFile := j.path("terms.txt")
+	if err := os.WriteFile(termsFile, []byte("timeout\n\nfine\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	j.run("MATCH_TERMS=error, panic", "MATCH_TERMS_FILE="+termsFile)
+	var got []fileTerms
+	j.outputJSON("term_counts.json", &got)
+	want := []fileTerms{
+		{"a.log", map[string]int{"error": 2, "fine": 0, "panic": 0, "timeout": 1}},
+		{"b.log", map[string]int{"error": 0, "fine": 1, "panic": 0, "timeout": 0}},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("term_counts.json = %v, want %v", got, want)
+	}
+	j.fail("MATCH_TERMS_FILE:", "MATCH_TERMS_FILE="+j.path("missing.txt"))
+}
+
+func TestReportMemory(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "one two"})
+	j.run()
+	if r := j.report(); r.Memory != nil || strings.Contains(j.output("summary.txt"), "peak") {
+		t.Error("memory reported without REPORT_MEMORY")
+	}
+	j.run("REPORT_MEMORY=true", "REPORT_MEMORY_INTERVAL=1")
+	r := j.report()
+	if r.Memory == nil || r.Memory.HeapAllocPeak == 0 || r.Memory.SysPeak < r.Memory.HeapAllocPeak {
+		t.Fatalf("memory = %+v", r.Memory)
+	}
+	want := fmt.Sprintf(" heap_peak=%d sys_peak=%d\n", r.Memory.HeapAllocPeak, r.Memory.SysPeak)
+	if summary := j.output("summary.txt"); !strings.HasSuffix(summary, want) {
+		t.Errorf("summary.txt = %q, want the peaks", summary)
+	}
+}
+
+func TestNormalizeNewlines(t *testing.T) {
+	text := "one\r\ntwo\rthree\r\n\r\nfour"
+	lines := func(normalize bool) (int, int) {
+		t.Helper()
+		stats := &fileStats{}
+		if _, err := countWords(bufio.NewReader(strings.NewReader(text)), &options{allMetrics: true, blankLines: "empty", normalizeNewlines: normalize}, stats); err != nil {
+			t.Fatal(err)
+		}
+		return stats.lines, stats.blank
+	}
+	if n, blank := lines(false); n != 4 || blank != 0 {
+		t.Errorf("lines without normalizing = %d, %d blank, want 4 and 0", n, blank)
+	}
+	if n, blank := lines(true); n != 5 || blank != 1 {
+		t.Errorf("normalized lines = %d, %d blank, want 5 and 1", n, blank)
+	}
+
+	j := newTestJob(t, map[string]string{"a.txt": "ERROR one\rERROR two\r\nINFO three"})
+	j.run("NORMALIZE_NEWLINES=true", "FILTER_LINES=^ERROR")
+	if r := j.report(); r.Total != 4 {
+		t.Errorf("total = %d, want 4", r.Total)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	for word, want := range map[string]string{
+		"counting": "count", "counted": "count", "relational": "relate", "happiness": "happi",
+		"classes": "class", "bus": "bus", "is": "is", "sing": "sing", "cats": "cat",
+	} {
+		if got := stem(word); got != want {
+			t.Errorf("stem(%q) = %q, want %q", word, got, want)
+		}
+	}
+
+	pipeline, err := parsePipeline("lowercase, strip-punct,stopwords,stem", wordSet("the and"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, freq := countText(t, "The (Counting), and THE counted! -- don't", &options{pipeline: pipeline})
+	want := map[string]int{"count": 2, "don't": 1}
+	if n != 3 || !maps.Equal(freq, want) {
+		t.Errorf("%d words %v, want %v", n, freq, want)
+	}
+	if _, err := parsePipeline("lowercase,unknown", nil); err == nil {
+		t.Error("unknown step accepted")
+	}
+
+	j := newTestJob(t, map[string]string{"a.txt": "The cat and the hat"})
+	j.run("PIPELINE=stopwords")
+	if r := j.report(); r.Total != 2 {
+		t.Errorf("total with the default stop words = %d, want 2", r.Total)
+	}
+	j.fail("PIPELINE: unknown step", "PIPELINE=lowercase,shout")
+}
+
+func TestTimestamps(t *testing.T) {
+	j := newTestJob(t, map[string]string{
+		"app.log":  "2024-03-01T10:00:05Z started\ngarbage line\n2024-03-01T09:59:00Z out of order\n2024-03-01T10:30:00Z done\n",
+		"web.log":  "[01/Mar/2024:08:00:00 +0000] GET /\n",
+		"none.log": "no timestamps here\n",
+	})
+	j.run("TIMESTAMP_REGEX=^\\[?(\\S+(?: \\+\\d{4})?)\\]?")
+	r := j.report()
+	app := r.file(t, "app.log")
+	if app.FirstTimestamp != "2024-03-01T09:59:00Z" || app.LastTimestamp != "2024-03-01T10:30:00Z" {
+		t.Errorf("app.log: %s to %s", app.FirstTimestamp, app.LastTimestamp)
+	}
+	if web := r.file(t, "web.log"); web.FirstTimestamp != "2024-03-01T08:00:00Z" {
+		t.Errorf("web.log: %s", web.FirstTimestamp)
+	}
+	if none := r.file(t, "none.log"); none.FirstTimestamp != "" || none.Words != 3 {
+		t.Errorf("none.log: %+v", none)
+	}
+
+	j.run("TIMESTAMP_REGEX=^(\\S+)", "TIMESTAMP_LAYOUT=2006-01-02T15:04")
+	if app := j.report().file(t, "app.log"); app.FirstTimestamp != "" {
+		t.Errorf("app.log with a layout that does not fit: %s", app.FirstTimestamp)
+	}
+	j.fail("has no capture group", "TIMESTAMP_REGEX=^\\S+")
+}
+
+func TestMaxFiles(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "one", "b.txt": strings.Repeat("word ", 20), "c.txt": "two three", "d.txt": "four"})
+	j.run("MAX_FILES=2", "MAX_FILE_BYTES=50")
+	r := j.report()
+	if len(r.Files) != 2 || r.Files[1].Name != "c.txt" || len(r.Skipped) != 1 || !r.LimitReached {
+		t.Errorf("report = %+v, want a.txt and c.txt counted, b.txt skipped, and the limit reached", r)
+	}
+	j.run("MAX_FILES=4")
+	if r := j.report(); len(r.Files) != 4 || r.LimitReached {
+		t.Errorf("report = %+v, want all files and no limit reached", r)
+	}
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	j := newTestJob(t, map[string]string{`say "hi".txt`: "one two", "b.txt": "three", "big.txt": strings.Repeat("word ", 20)})
+	j.run("PROMETHEUS_METRICS=true", "MAX_FILE_BYTES=50", "INCLUDE_ZERO=true")
+	want := `# HELP wordcount_total Number of words per file.
+# TYPE wordcount_total gauge
+wordcount_total{file="b.txt"} 1
+wordcount_total{file="say \"hi\".txt"} 2
+# HELP wordcount_words Number of words in all files.
+# TYPE wordcount_words gauge
+wordcount_words 3
+# HELP wordcount_bytes Number of bytes in all files.
+# TYPE wordcount_bytes gauge
+wordcount_bytes 12
+# HELP wordcount_files Number of counted files.
+# TYPE wordcount_files gauge
+wordcount_files 2
+# HELP wordcount_skipped_files Number of skipped files.
+# TYPE wordcount_skipped_files gauge
+wordcount_skipped_files 1
+`
+	if got := j.output("metrics.prom"); got != want {
+		t.Errorf("metrics.prom =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestReadStrategy(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": strings.Repeat("lorem ipsum dolor\n", 1000), "empty.txt": ""})
+	j.run()
+	want := j.output("count.json")
+	for _, strategy := range []string{"scanner", "buffered", "mmap"} {
+		j.run("READ_STRATEGY=" + strategy)
+		if got := j.output("count.json"); got != want {
+			t.Errorf("READ_STRATEGY=%s: count.json =\n%s\nwant\n%s", strategy, got, want)
+		}
+	}
+	j.fail("READ_STRATEGY: unknown", "READ_STRATEGY=telepathy")
+}
+
+func BenchmarkReadStrategy(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "big.txt")
+	text := strings.Repeat("lorem ipsum dolor sit amet, consectetur adipiscing elit\n", 64<<10)
+	if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	want := len(strings.Fields(text))
+	for _, strategy := range []string{"buffered", "scanner", "mmap"} {
+		b.Run(strategy, func(b *testing.B) {
+			if strategy == "mmap" && mmapFile == nil {
+				b.Skip("mmap is not supported on this platform")
+			}
+			b.SetBytes(int64(len(text)))
+			for range b.N {
+				f, err := os.Open(path)
+				if err != nil {
+					b.Fatal(err)
+				}
+				in, release, err := fileReader(f, "big.txt", int64(len(text)), strategy)
+				if err != nil {
+					b.Fatal(err)
+				}
+				n, err := countWords(bufio.NewReader(in), &options{}, &fileStats{})
+				if release != nil {
+					if rerr := release(); err == nil {
+						err = rerr
+					}
+				}
+				f.Close()
+				if err != nil || n != want {
+					b.Fatalf("%d words, %v, want %d", n, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestJSONRecords(t *testing.T) {
+	for doc, want := range map[string]int{
+		`[]`:                                   0,
+		`[1, "two", null]`:                     3,
+		`[{"a": [1, 2, {"b": []}]}, [[], {}]]`: 2,
+	} {
+		if n, err := countRecords(strings.NewReader(doc)); err != nil || n != want {
+			t.Errorf("countRecords(%s) = %d, %v, want %d", doc, n, err, want)
+		}
+	}
+	for _, doc := range []string{`{"a": 1}`, `[1, 2`, `[1] [2]`, ``} {
+		if _, err := countRecords(strings.NewReader(doc)); err == nil {
+			t.Errorf("countRecords(%s) succeeded, want an error", doc)
+		}
+	}
+
+	j := newTestJob(t, map[string]string{"a.json": `[{"text": "hello"}, {"text": "world"}]`, "b.txt": "[1, 2, 3]"})
+	j.run("JSON_RECORDS=true")
+	r := j.report()
+	if r.Records != 2 || r.file(t, "a.json").Records != 2 || r.file(t, "b.txt").Records != 0 {
+		t.Errorf("records = %d, want 2, all in a.json", r.Records)
+	}
+	if r.file(t, "a.json").Words != 4 {
+		t.Errorf("a.json: %d words, want 4, as the records are counted on top", r.file(t, "a.json").Words)
+	}
+	j.writeInput("a.json", `{"not": "an array"}`)
+	j.fail("not a JSON array", "JSON_RECORDS=true")
+}
+
+func TestOutputFormatNeedsTag(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "one"})
+	for _, format := range []string{"parquet", "sqlite"} {
+		if countWriters[format] == nil {
+			j.fail(fmt.Sprintf("unknown format %q (build with -tags %s?)", format, format), "OUTPUT_FORMAT="+format)
+		}
+	}
+	j.fail(`unknown format "xml"`, "OUTPUT_FORMAT=yaml,xml")
+}
+
+func TestOutputShards(t *testing.T) {
+	inputs := map[string]string{}
+	for i := range 10 {
+		inputs[fmt.Sprintf("f%d.txt", i)] = strings.Repeat("word ", i+1)
+	}
+	j := newTestJob(t, inputs)
+	j.run("OUTPUT_SHARDS=3")
+	if j.hasOutput("count.json") {
+		t.Error("count.json written alongside the shards")
+	}
+	seen := map[string]bool{}
+	total := 0
+	for i := range 3 {
+		var r report
+		j.outputJSON(fmt.Sprintf("count-%d.json", i), &r)
+		sum := 0
+		for _, f := range r.Files {
+			h := fnv.New32a()
+			h.Write([]byte(f.Name))
+			if shard := int(h.Sum32() % 3); shard != i {
+				t.Errorf("%s in shard %d, want %d", f.Name, i, shard)
+			}
+			if seen[f.Name] {
+				t.Errorf("%s in more than one shard", f.Name)
+			}
+			seen[f.Name] = true
+			sum += f.Words
+		}
+		if r.Total != sum {
+			t.Errorf("count-%d.json: total %d, want %d, the sum of its files", i, r.Total, sum)
+		}
+		total += r.Total
+	}
+	if len(seen) != len(inputs) || total != 55 {
+		t.Errorf("shards cover %d files and %d words, want %d files and 55 words", len(seen), total, len(inputs))
+	}
+
+	first := j.output("count-0.json")
+	j.run("OUTPUT_SHARDS=3")
+	if got := j.output("count-0.json"); got != first {
+		t.Errorf("sharding is not deterministic:\n%s\nthen\n%s", first, got)
+	}
+	j.fail("exclude each other", "OUTPUT_SHARDS=3", "SPLIT_OUTPUT=true")
+}
+
+func TestStripChars(t *testing.T) {
+	n, freq := countText(t, "foo_bar foobar __ -x-", &options{stripChars: "_-"})
+	if n != 3 || freq["foobar"] != 2 || freq["x"] != 1 {
+		t.Errorf("got %d words, %v, want 3 words, foobar twice, x once", n, freq)
+	}
+
+	j := newTestJob(t, map[string]string{"a.txt": "snake_case snakecase _"})
+	j.run("STRIP_CHARS=_", "MERGE_FREQUENCIES=true")
+	if r := j.report(); r.Total != 2 {
+		t.Errorf("total = %d, want 2", r.Total)
+	}
+	if freq := j.output("frequencies.json"); !strings.Contains(freq, `"snakecase"`) || strings.Contains(freq, "snake_case") {
+		t.Errorf("frequencies.json = %s, want snake_case joined", freq)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	j := newTestJob(t, map[string]string{
+		"manifest.csv": "label,path\nnews,a.txt\nblog,b.txt\nnews,sub/c.txt\n",
+		"a.txt":        "one two",
+		"b.txt":        "three",
+		"sub/c.txt":    "four five six",
+		"d.txt":        "not listed",
+	})
+	j.run("MANIFEST=manifest.csv", "MANIFEST_PATH_COLUMN=1", "MANIFEST_LABEL_COLUMN=0", "MANIFEST_HEADER=true")
+	var byLabel map[string]int
+	j.outputJSON("by_label.json", &byLabel)
+	if want := map[string]int{"news": 5, "blog": 1}; !maps.Equal(byLabel, want) {
+		t.Errorf("by_label.json = %v, want %v", byLabel, want)
+	}
+	if r := j.report(); len(r.Files) != 3 || r.Total != 6 {
+		t.Errorf("report has %d files and %d words, want the 3 listed files and 6 words", len(r.Files), r.Total)
+	}
+	j.fail("line 1 has 1 columns", "MANIFEST=a.txt")
+}
+
+func TestFlagOutliers(t *testing.T) {
+	inputs := map[string]string{"huge.txt": strings.Repeat("word ", 200)}
+	for i := range 9 {
+		inputs[fmt.Sprintf("f%d.txt", i)] = strings.Repeat("word ", 10)
+	}
+	j := newTestJob(t, inputs)
+	j.run("FLAG_OUTLIERS=true", "OUTLIER_STDDEVS=2")
+	var o outliers
+	j.outputJSON("outliers.json", &o)
+	if o.Method != "stddev" || o.Mean != 29 || o.Stddev != 57 || len(o.Files) != 1 || o.Files[0].Name != "huge.txt" {
+		t.Errorf("outliers.json = %+v, want mean 29, stddev 57, and huge.txt only", o)
+	}
+
+	inputs = map[string]string{}
+	for i := range 10 {
+		inputs[fmt.Sprintf("f%d.txt", i)] = strings.Repeat("word ", i+1)
+	}
+	j = newTestJob(t, inputs)
+	j.run("FLAG_OUTLIERS=true", "OUTLIER_METHOD=percentile", "OUTLIER_PERCENTILES=10,90")
+	j.outputJSON("outliers.json", &o)
+	if math.Abs(o.Low-1.9) > 1e-9 || math.Abs(o.High-9.1) > 1e-9 || len(o.Files) != 2 || o.Files[0].Name != "f0.txt" || o.Files[1].Name != "f9.txt" {
+		t.Errorf("outliers.json = %+v, want bounds 1.9 and 9.1, and f0.txt and f9.txt", o)
+	}
+	j.fail("unknown method", "FLAG_OUTLIERS=true", "OUTLIER_METHOD=median")
+	j.fail("not a range", "FLAG_OUTLIERS=true", "OUTLIER_METHOD=percentile", "OUTLIER_PERCENTILES=90,10")
+}
+
+func TestAllMetrics(t *testing.T) {
+	text := "héllo wörld\r\n👍🏽 👨‍👩‍👧 🇩🇪🇫🇷\né!"
+	j := newTestJob(t, map[string]string{"a.txt": text})
+	j.run()
+	words := j.report().file(t, "a.txt").Words
+	j.run("ALL_METRICS=true")
+	f := j.report().file(t, "a.txt")
+	if f.Words != words || f.Bytes != int64(len(text)) {
+		t.Errorf("%d words and %d bytes, want %d and %d as without ALL_METRICS", f.Words, f.Bytes, words, len(text))
+	}
+	if want := utf8.RuneCountInString(text); f.Runes != want {
+		t.Errorf("%d runes, want %d", f.Runes, want)
+	}
+	if want := len(strings.Split(text, "\n")); f.Lines != want {
+		t.Errorf("%d lines, want %d", f.Lines, want)
+	}
+	// Line by line: 11 letters and spaces and the CRLF, then a thumb with skin tone, a family, two flags, the spaces, and the LF, and finally a combined accent and the exclamation mark.
+	if f.Graphemes != 12+7+2 {
+		t.Errorf("%d graphemes, want %d", f.Graphemes, 12+7+2)
+	}
+}
+
+func TestAllowEmpty(t *testing.T) {
+	j := newTestJob(t, map[string]string{".wordcountignore": "*.txt\n", "a.txt": "excluded"})
+	j.fail("No files found")
+	j.run("ALLOW_EMPTY=true", "OUTPUT_FORMAT=yaml,properties", "MATCH_TERMS=word", "DETECT_LANGUAGE=true")
+	r := j.report()
+	if r.Files == nil || len(r.Files) != 0 || r.Total != 0 {
+		t.Errorf("count.json = %+v, want no files and zero words", r)
+	}
+	for name, want := range map[string]string{
+		"count.json":       `"files": []`,
+		"term_counts.json": `[]`,
+		"languages.json":   `[]`,
+		"count.yaml":       "files: []",
+		"count.properties": "__total__=0",
+	} {
+		if got := j.output(name); !strings.Contains(got, want) {
+			t.Errorf("%s = %s, want it to contain %s", name, got, want)
+		}
+	}
+}
+
+func TestBurstWindow(t *testing.T) {
+	at := func(minute int) time.Time { return time.Date(2024, 3, 1, 10, minute, 0, 0, time.UTC) }
+	timeline := []timedWords{{at(20), 1}, {at(0), 2}, {at(11), 4}, {at(14), 3}, {at(16), 5}, {at(30), 6}}
+	b := findBurst(timeline, 5*time.Minute)
+	if want := (burst{Window: "5m0s", Start: "2024-03-01T10:14:00Z", End: "2024-03-01T10:16:00Z", Words: 8}); b != want {
+		t.Errorf("findBurst = %+v, want %+v, as 10:11 and 10:16 are a full window apart", b, want)
+	}
+	if b := findBurst(nil, time.Minute); b.Words != 0 || b.Start != "" {
+		t.Errorf("findBurst without lines = %+v", b)
+	}
+
+	j := newTestJob(t, map[string]string{
+		"a.log": "2024-03-01T10:00:00Z calm\n2024-03-01T10:31:00Z error error error\n",
+		"b.log": "2024-03-01T10:30:00Z error error\n2024-03-01T11:00:00Z calm\n",
+	})
+	j.run("TIMESTAMP_REGEX=^(\\S+)", "BURST_WINDOW=5m")
+	var got burst
+	j.outputJSON("burst.json", &got)
+	if got.Start != "2024-03-01T10:30:00Z" || got.End != "2024-03-01T10:31:00Z" || got.Words != 7 {
+		t.Errorf("burst.json = %+v, want the lines from 10:30 and 10:31 of both files", got)
+	}
+	j.fail("needs TIMESTAMP_REGEX", "BURST_WINDOW=5m")
+	j.fail("not a positive duration", "TIMESTAMP_REGEX=^(\\S+)", "BURST_WINDOW=-5m")
+}
+
+func TestMergeFrequencies(t *testing.T) {
+	inputs := map[string]string{"a.txt": "the cat and the hat", "b.txt": "the dog", "c.md": "a cat"}
+	sum := map[string]int{}
+	for name, content := range inputs {
+		j := newTestJob(t, map[string]string{name: content})
+		j.run("MERGE_FREQUENCIES=true")
+		var words []wordCount
+		j.outputJSON("frequencies.json", &words)
+		for _, w := range words {
+			sum[w.Word] += w.Count
+		}
+	}
+
+	j := newTestJob(t, inputs)
+	j.run("MERGE_FREQUENCIES=true")
+	var words []wordCount
+	j.outputJSON("frequencies.json", &words)
+	merged := map[string]int{}
+	for i, w := range words {
+		merged[w.Word] = w.Count
+		if i > 0 && w.Count > words[i-1].Count {
+			t.Errorf("%v before %v, want the most frequent first", words[i-1], w)
+		}
+	}
+	if !maps.Equal(merged, sum) {
+		t.Errorf("merged frequencies = %v, want the sum of the files, %v", merged, sum)
+	}
+	j.fail("does not work with WORDCLOUD=file", "MERGE_FREQUENCIES=true", "WORDCLOUD=file")
+}
+
+func TestDumpTokens(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "Hello, snake_case world 42 Hello", "b.txt": "one two three"})
+	j.run("DUMP_TOKENS=true", "STRIP_CHARS=_", "TOTAL_EXCLUDE_NUMBERS=true")
+	tokens := strings.Split(strings.TrimSuffix(j.output("tokens/a.txt.txt"), "\n"), "\n")
+	if want := []string{"Hello,", "snakecase", "world", "Hello"}; fmt.Sprint(tokens) != fmt.Sprint(want) {
+		t.Errorf("tokens = %q, want %q", tokens, want)
+	}
+	if words := j.report().file(t, "a.txt").Words; words != len(tokens) {
+		t.Errorf("%d words, but %d tokens", words, len(tokens))
+	}
+	if got := j.output("tokens/b.txt.txt"); got != "one\ntwo\nthree\n" {
+		t.Errorf("tokens of b.txt = %q", got)
+	}
+
+	_, stderr, _ := j.exec(nil, "DUMP_TOKENS=true", "MAX_DUMP_TOKENS=2")
+	if got := j.output("tokens/b.txt.txt"); got != "one\ntwo\n" {
+		t.Errorf("tokens with MAX_DUMP_TOKENS=2 = %q", got)
+	}
+	if !strings.Contains(stderr, "only the first 2 of 3 tokens") {
+		t.Errorf("stderr = %q, want a warning about the cut", stderr)
+	}
+}
+
+func TestByExtension(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "one two", "b.TXT": "three", "c.md": "four five six", "README": "seven", "d.tar.gz.txt": "eight"})
+	j.run("BY_EXTENSION=true")
+	var byExt map[string]int
+	j.outputJSON("by_extension.json", &byExt)
+	if want := map[string]int{".txt": 4, ".md": 3, "(none)": 1}; !maps.Equal(byExt, want) {
+		t.Errorf("by_extension.json = %v, want %v", byExt, want)
+	}
+	if r := j.report(); len(r.Files) != 5 || r.Total != 8 {
+		t.Errorf("count.json has %d files and %d words, want the per-file results, too", len(r.Files), r.Total)
+	}
+}
+
+func TestValidateOutput(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "one two", "big.txt": strings.Repeat("word ", 20)})
+	j.run("VALIDATE_OUTPUT=true", "MAX_FILE_BYTES=50", "WARNINGS_IN_OUTPUT=true")
+	data := []byte(j.output("count.json"))
+	if err := validateReport(data); err != nil {
+		t.Fatalf("validateReport(count.json) = %v", err)
+	}
+	if r := j.report(); r.SchemaVersion != reportSchemaVersion {
+		t.Errorf("schema_version = %d, want %d", r.SchemaVersion, reportSchemaVersion)
+	}
+
+	for want, corrupt := range map[string]func(doc map[string]any){
+		"total is missing":             func(doc map[string]any) { delete(doc, "total") },
+		"bytes is string, want number": func(doc map[string]any) { doc["bytes"] = "12" },
+		"schema_version is 99":         func(doc map[string]any) { doc["schema_version"] = 99 },
+		"files is null, want array":    func(doc map[string]any) { doc["files"] = nil },
+		"files[0] is number":           func(doc map[string]any) { doc["files"] = []any{1} },
+		"files[0].words is missing":    func(doc map[string]any) { delete(doc["files"].([]any)[0].(map[string]any), "words") },
+		"skipped[0].reason is missing": func(doc map[string]any) { delete(doc["skipped"].([]any)[0].(map[string]any), "reason") },
+		"warnings is object":           func(doc map[string]any) { doc["warnings"] = map[string]any{} },
+	} {
+		var doc map[string]any
+		if err := json.Unmarshal(data, &doc); err != nil {
+			t.Fatal(err)
+		}
+		corrupt(doc)
+		bad, err := json.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := validateReport(bad); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("validateReport = %v, want %q", err, want)
+		}
+	}
+	if err := validateReport([]byte("[1, 2]")); err == nil {
+		t.Error("validateReport accepted an array")
+	}
+}
+
+func TestFreqMemoryLimit(t *testing.T) {
+	all := map[string]int{}
+	freq := map[string]int{}
+	s := &freqSpill{limit: 2, dir: t.TempDir()}
+	for _, text := range []string{"a b c a", "d a e", "b b f g h", "a"} {
+		for _, w := range strings.Fields(text) {
+			freq[w]++
+			all[w]++
+		}
+		if err := s.check(freq); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(s.runs) != 3 || len(freq) != 1 {
+		t.Errorf("%d runs and %d words in memory, want 3 and 1", len(s.runs), len(freq))
+	}
+	top, err := s.top(freq, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := topWords(all, 3); fmt.Sprint(top) != fmt.Sprint(want) {
+		t.Errorf("top = %v, want %v", top, want)
+	}
+
+	inputs := map[string]string{}
+	for i := range 20 {
+		inputs[fmt.Sprintf("f%02d.txt", i)] = fmt.Sprintf("common w%d w%d rare%d", i%3, i%7, i)
+	}
+	j := newTestJob(t, inputs)
+	j.run("MERGE_FREQUENCIES=true")
+	want := j.output("frequencies.json")
+	spillDir := t.TempDir()
+	j.run("MERGE_FREQUENCIES=true", "FREQ_MEMORY_LIMIT=3", "FREQ_SPILL_DIR="+spillDir)
+	if got := j.output("frequencies.json"); got != want {
+		t.Errorf("spilled frequencies.json =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestPathsFromStdin(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "one two", "b.txt": "three", "c.txt": "not listed"})
+	j.stdin = "a.txt\n\n  " + j.path("inputs/b.txt") + "  \nmissing.txt\n"
+	j.run("PATHS_FROM_STDIN=true")
+	r := j.report()
+	var names []string
+	for _, f := range r.Files {
+		names = append(names, f.Name)
+	}
+	if fmt.Sprint(names) != "[a.txt b.txt]" || r.Total != 3 {
+		t.Errorf("counted %v with %d words, want a.txt and b.txt with 3 words", names, r.Total)
+	}
+	if len(r.Skipped) != 1 || r.Skipped[0] != (skippedFile{"missing.txt", "file not found"}) {
+		t.Errorf("skipped = %v, want missing.txt", r.Skipped)
+	}
+}
+
+func TestYAMLOutput(t *testing.T) {
+	j := newTestJob(t, map[string]string{`say "yes".txt`: "one two", "b.txt": "three", "big.txt": strings.Repeat("word ", 20)})
+	j.run("OUTPUT_FORMAT=yaml", "MAX_FILE_BYTES=50")
+	want := `schema_version: 1
+version: "dev"
+total: 3
+bytes: 12
+files:
+  - name: "b.txt"
+    words: 1
+    bytes: 5
+  - name: "say \"yes\".txt"
+    words: 2
+    bytes: 7
+skipped:
+  - name: "big.txt"
+    reason: "size 100 above MAX_FILE_BYTES 50"
+`
+	if got := j.output("count.yaml"); got != want {
+		t.Errorf("count.yaml =\n%s\nwant\n%s", got, want)
+	}
+
+	for key, want := range map[string]string{"words": "words", "top_word": "top_word", "yes": `"yes"`, "Null": `"Null"`, "a.txt": `"a.txt"`, "1st": `"1st"`, "": `""`} {
+		if got := yamlKey(key); got != want {
+			t.Errorf("yamlKey(%q) = %s, want %s", key, got, want)
+		}
+	}
+}
+
+func TestTopWord(t *testing.T) {
+	j := newTestJob(t, map[string]string{
+		"clear.txt": "the cat and the dog and the bird",
+		"tie.txt":   "pear apple pear apple plum",
+		"case.txt":  "Cat cat dog dog",
+		"empty.txt": "",
+	})
+	j.run("TOP_WORD=true")
+	r := j.report()
+	for name, want := range map[string]fileCount{
+		"clear.txt": {TopWord: "the", TopWordCount: 3},
+		"tie.txt":   {TopWord: "apple", TopWordCount: 2},
+		"case.txt":  {TopWord: "dog", TopWordCount: 2},
+		"empty.txt": {},
+	} {
+		if f := r.file(t, name); f.TopWord != want.TopWord || f.TopWordCount != want.TopWordCount {
+			t.Errorf("%s: top word %q (%d), want %q (%d)", name, f.TopWord, f.TopWordCount, want.TopWord, want.TopWordCount)
+		}
+	}
+
+	j.run("TOP_WORD=true", "PIPELINE=stopwords", "FREQ_CASE_INSENSITIVE=true")
+	r = j.report()
+	if f := r.file(t, "clear.txt"); f.TopWord != "bird" || f.TopWordCount != 1 {
+		t.Errorf("clear.txt without stop words: top word %q (%d), want bird (1)", f.TopWord, f.TopWordCount)
+	}
+	if f := r.file(t, "case.txt"); f.TopWord != "cat" || f.TopWordCount != 2 {
+		t.Errorf("case.txt folded: top word %q (%d), want cat (2)", f.TopWord, f.TopWordCount)
+	}
+}
+
+// The word lists are shared by the goroutines that count the chunks of a split file. Run with `-race` to check that they are only read.
+func TestSharedWordLists(t *testing.T) {
+	pipeline, err := parsePipeline("lowercase,stopwords", wordSet(defaultStopwords))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &options{pipeline: pipeline, stripChars: "_"}
+	text := strings.Repeat("The quick_brown fox and THE lazy dog. ", 200)
+	for i := range 8 {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			t.Parallel()
+			n, freq := countText(t, text, opts)
+			if n != 800 || freq["quickbrown"] != 200 || freq["the"] != 0 {
+				t.Errorf("%d words, %v, want 800 words without stop words", n, freq)
+			}
+		})
+	}
+
+	j := newTestJob(t, map[string]string{"a.txt": text})
+	j.run("PIPELINE=lowercase,stopwords", "MERGE_FREQUENCIES=true")
+	want := j.output("frequencies.json")
+	j.run("PIPELINE=lowercase,stopwords", "MERGE_FREQUENCIES=true", "SPLIT_LARGE_FILES=true", "SPLIT_MIN_BYTES=1", "SPLIT_WORKERS=8")
+	if got := j.output("frequencies.json"); got != want {
+		t.Errorf("frequencies.json of the split file =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestNoEmptyTokens(t *testing.T) {
+	modes := []struct {
+		name string
+		opts *options
+	}{
+		{"words", &options{}},
+		{"lines", &options{filter: regexp.MustCompile(``)}},
+		{"regex", &options{wordRegex: regexp.MustCompile(`[^,\s]*`)}},
+		{"pre-tokenized", &options{preTokenized: true}},
+		{"strip", &options{stripChars: ","}},
+	}
+	for _, tc := range []struct {
+		text string
+		want []int // per mode
+	}{
+		{"", []int{0, 0, 0, 0, 0}},
+		{"   \n\t \n", []int{0, 0, 0, 0, 0}},
+		{"  a  b  ", []int{2, 2, 2, 1, 2}},
+		{"\ta\n\n b\t\n", []int{2, 2, 2, 2, 2}},
+		{"a,,b ,, ", []int{2, 2, 2, 1, 1}},
+	} {
+		for i, mode := range modes {
+			n, freq := countText(t, tc.text, mode.opts)
+			if n != tc.want[i] || freq[""] != 0 {
+				t.Errorf("%s: %q has %d words (%v), want %d", mode.name, tc.text, n, freq, tc.want[i])
+			}
+		}
+	}
+}
+
+func TestTextColumns(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.csv": "id,comment,score\n1,great product,5\n2,\"bad, broken\nand late\",1\n3\n"})
+	j.run("TEXT_COLUMNS=1", "TEXT_HEADER=true", "MERGE_FREQUENCIES=true")
+	r := j.report()
+	if a := r.file(t, "a.csv"); a.Words != 6 {
+		t.Errorf("a.csv: %d words, want the 6 words of the comments", a.Words)
+	}
+	if out := j.output("frequencies.json"); strings.Contains(out, `"comment"`) || strings.Contains(out, `"5"`) {
+		t.Errorf("frequencies.json counts the header or other columns:\n%s", out)
+	}
+	j.fail("bare \" in non-quoted-field", "TEXT_COLUMNS=1", "TEXT_DELIMITER=tab")
+
+	j = newTestJob(t, map[string]string{"b.tsv": "7\tsome words here\t99\n"})
+	j.run("TEXT_COLUMNS=1,2", "TEXT_DELIMITER=tab")
+	if b := j.report().file(t, "b.tsv"); b.Words != 4 {
+		t.Errorf("b.tsv: %d words, want 4", b.Words)
+	}
+	j.fail("is not a column index", "TEXT_COLUMNS=1,x")
+	j.fail("is not a single character", "TEXT_COLUMNS=1", "TEXT_DELIMITER=;;")
+}
+
+func TestFoldDigits(t *testing.T) {
+	_, freq := countText(t, "req123 req456 v2.0 2024 id-7b9 plain", &options{foldDigits: true})
+	want := map[string]int{"req<NUM>": 2, "v<NUM>.<NUM>": 1, "<NUM>": 1, "id-<NUM>b<NUM>": 1, "plain": 1}
+	if !maps.Equal(freq, want) {
+		t.Errorf("frequencies = %v, want %v", freq, want)
+	}
+
+	j := newTestJob(t, map[string]string{"a.log": "GET /item/17 took 35ms\nGET /item/4 took 120ms\n"})
+	j.run("MERGE_FREQUENCIES=true", "FOLD_DIGITS=true")
+	if r := j.report(); r.Total != 8 {
+		t.Errorf("total = %d, want 8, as folding leaves the word count alone", r.Total)
+	}
+	var words []wordCount
+	j.outputJSON("frequencies.json", &words)
+	if want := "[{/item/<NUM> 2} {<NUM>ms 2} {GET 2} {took 2}]"; fmt.Sprint(words) != want {
+		t.Errorf("frequencies.json = %v, want %s", words, want)
+	}
+}
+
+func TestPreTokenized(t *testing.T) {
+	j := newTestJob(t, map[string]string{"tokens.txt": "New York\nthe\n\n  San Francisco \nthe\n   \n"})
+	j.run("PRE_TOKENIZED=true", "MERGE_FREQUENCIES=true")
+	if r := j.report(); r.Total != 4 {
+		t.Errorf("total = %d, want 4 tokens", r.Total)
+	}
+	var words []wordCount
+	j.outputJSON("frequencies.json", &words)
+	if want := "[{the 2} {New York 1} {San Francisco 1}]"; fmt.Sprint(words) != want {
+		t.Errorf("frequencies.json = %v, want %s", words, want)
+	}
+	j.fail("exclude each other", "PRE_TOKENIZED=true", "WORD_REGEX=\\w+")
+}
+
+func TestIncludeMtime(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "one", "b.txt": "two"})
+	mtime := time.Date(2023, 7, 14, 12, 30, 45, 0, time.FixedZone("CEST", 2*60*60))
+	if err := os.Chtimes(j.path("inputs/a.txt"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	j.run("INCLUDE_MTIME=true")
+	r := j.report()
+	if got := r.file(t, "a.txt").ModTime; got != "2023-07-14T10:30:45Z" {
+		t.Errorf("a.txt: mtime %q, want 2023-07-14T10:30:45Z", got)
+	}
+	if got, err := time.Parse(time.RFC3339, r.file(t, "b.txt").ModTime); err != nil || time.Since(got) > time.Hour {
+		t.Errorf("b.txt: mtime %v, %v, want about now", got, err)
+	}
+	j.run()
+	if got := j.report().file(t, "a.txt").ModTime; got != "" {
+		t.Errorf("mtime %q without INCLUDE_MTIME", got)
+	}
+}
+
+// `reversePreprocessor` is a custom preprocessor for the tests. It reverses each word and drops the words in `drop`.
+type reversePreprocessor struct {
+	drop map[string]bool
+}
+
+func (r reversePreprocessor) Process(word string) string {
+	if r.drop[word] {
+		return ""
+	}
+	runes := []rune(word)
+	slices.Reverse(runes)
+	return string(runes)
+}
+
+func init() {
+	RegisterPreprocessor("test-reverse", reversePreprocessor{drop: map[string]bool{"skip": true}})
+}
+
+func TestRegisterPreprocessor(t *testing.T) {
+	pipeline, err := parsePipeline("lowercase,test-reverse", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, freq := countText(t, "Hello SKIP héllo", &options{pipeline: pipeline})
+	if n != 2 || freq["olleh"] != 1 || freq["olléh"] != 1 {
+		t.Errorf("got %d words, %v, want olleh and olléh", n, freq)
+	}
+
+	j := newTestJob(t, map[string]string{"a.txt": "abc skip abc"})
+	j.run("PIPELINE=test-reverse", "MERGE_FREQUENCIES=true")
+	var words []wordCount
+	j.outputJSON("frequencies.json", &words)
+	if want := "[{cba 2}]"; fmt.Sprint(words) != want {
+		t.Errorf("frequencies.json = %v, want %s", words, want)
+	}
+
+	for _, name := range []string{"lowercase", "stopwords", "test-reverse"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("RegisterPreprocessor(%q) did not panic", name)
+				}
+			}()
+			RegisterPreprocessor(name, PreprocessorFunc(strings.ToUpper))
+		}()
+	}
+}
+
+func TestWithinDelimiters(t *testing.T) {
+	for _, tc := range []struct {
+		text, delims string
+		want         int
+	}{
+		{`He said "hello there" and "bye".`, `""`, 3},
+		{"a [b c] d [e\nf] g", "[]", 4},
+		{"[outer [inner] outer] out", "[]", 3},
+		{"stray] words [open to the end", "[]", 4},
+		{"no delimiters at all", `""`, 0},
+	} {
+		runes := []rune(tc.delims)
+		n, _ := countText(t, tc.text, &options{within: &delimiters{open: runes[0], close: runes[1]}})
+		if n != tc.want {
+			t.Errorf("%q within %s: %d words, want %d", tc.text, tc.delims, n, tc.want)
+		}
+	}
+
+	j := newTestJob(t, map[string]string{"a.txt": "Narrator: «Hello, world», she said. «Goodbye»"})
+	j.run("WITHIN_DELIMITERS=«»")
+	if r := j.report(); r.Total != 3 {
+		t.Errorf("total = %d, want 3 quoted words", r.Total)
+	}
+	j.fail("is not a pair of characters", "WITHIN_DELIMITERS=[")
+}
+
+func TestOutputLayout(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "one two", "b.txt": "three"})
+	// `files` lists the output files and clears the output directory for the next run.
+	files := func() string {
+		var names []string
+		err := filepath.WalkDir(j.path("outputs"), func(path string, d os.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				rel, _ := filepath.Rel(j.path("outputs"), path)
+				names = append(names, filepath.ToSlash(rel))
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.RemoveAll(j.path("outputs")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Mkdir(j.path("outputs"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(names, " ")
+	}
+
+	j.run("MERGE_FREQUENCIES=true")
+	if got, want := files(), "config_effective.json count.json count.txt frequencies.json summary.txt"; got != want {
+		t.Errorf("flat layout: %s, want %s", got, want)
+	}
+	j.run("MERGE_FREQUENCIES=true", "OUTPUT_LAYOUT=details")
+	if got, want := j.output("SUMMARY"), j.output("details/summary.txt"); got != want || !strings.Contains(got, "3") {
+		t.Errorf("SUMMARY = %q, want the summary line %q", got, want)
+	}
+	if got, want := files(), "SUMMARY details/config_effective.json details/count.json details/count.txt details/frequencies.json details/summary.txt"; got != want {
+		t.Errorf("details layout: %s, want %s", got, want)
+	}
+	j.run("OUTPUT_LAYOUT=details", "BUNDLE_OUTPUT=true")
+	if b := j.bundle(); b["SUMMARY"] == "" || b["details/count.json"] == "" {
+		t.Errorf("bundle has %v, want the details layout inside", slices.Sorted(maps.Keys(b)))
+	}
+	if got, want := files(), "results.tar.gz"; got != want {
+		t.Errorf("details layout with a bundle: %s, want %s", got, want)
+	}
+	j.fail("unknown layout", "OUTPUT_LAYOUT=nested")
+}
+
+func TestTransliterateNeedsTag(t *testing.T) {
+	if transliterate != nil {
+		t.Skip("built with -tags xtext")
+	}
+	j := newTestJob(t, map[string]string{"a.txt": "café"})
+	j.fail("TRANSLITERATE needs a build with -tags xtext", "TRANSLITERATE=true")
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "one two"})
+	_, stderr, failed := j.exec([]string{"--top-n", "7"}, "TOP_N=5", "MAX_FILES=3", "HASH_FILENAMES=true", "HASH_SALT=s3cret")
+	if failed {
+		t.Fatalf("job failed: %s", stderr)
+	}
+	var config map[string]any
+	j.outputJSON("config_effective.json", &config)
+	for name, want := range map[string]any{
+		"TOP_N":          7.0,
+		"MAX_FILES":      3.0,
+		"HASH_FILENAMES": true,
+		"HASH_SALT":      "REDACTED",
+		"MIN_FREQUENCY":  1.0,
+	} {
+		if config[name] != want {
+			t.Errorf("%s = %v, want %v", name, config[name], want)
+		}
+	}
+	if _, ok := config["TEXT_DELIMITER"]; ok {
+		t.Error("TEXT_DELIMITER recorded, though TEXT_COLUMNS is not set")
+	}
+	if strings.Contains(j.output("config_effective.json"), "s3cret") {
+		t.Error("config_effective.json reveals the salt")
+	}
+}
+
+func TestDiffMode(t *testing.T) {
+	for _, tc := range []struct {
+		old, new string
+		want     string
+	}{
+		{"a b c", "a b c", "000"},
+		{"a b", "a b c d", "0011"},
+		{"a b c", "a x c", "010"},
+		{"a b c d", "b d e", "001"},
+		{"", "a", "1"},
+		{"a b c", "b c a", "001"},
+	} {
+		var got strings.Builder
+		for _, added := range diffLines(strings.Fields(tc.old), strings.Fields(tc.new)) {
+			if added {
+				got.WriteByte('1')
+			} else {
+				got.WriteByte('0')
+			}
+		}
+		if got.String() != tc.want {
+			t.Errorf("diffLines(%q, %q) = %s, want %s", tc.old, tc.new, got.String(), tc.want)
+		}
+	}
+
+	j := newTestJob(t, map[string]string{
+		"old/app.log":  "started server\nrequest one\n",
+		"new/app.log":  "started server\nrequest one\nrequest two ok\nshutting down\n",
+		"old/edit.txt": "keep this\nchange me\nkeep that\n",
+		"new/edit.txt": "keep this\nchanged line here\nkeep that\n",
+		"new/new.txt":  "all new words",
+		"old/gone.txt": "not counted",
+	})
+	j.run("DIFF_MODE=true")
+	r := j.report()
+	for name, want := range map[string]int{"app.log": 5, "edit.txt": 3, "new.txt": 3} {
+		if got := r.file(t, name).Words; got != want {
+			t.Errorf("%s: %d words, want %d", name, got, want)
+		}
+	}
+	if len(r.Files) != 3 {
+		t.Errorf("%d files, want the 3 files in new", len(r.Files))
+	}
+}
+
+func TestWarningsInOutput(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "one two three", "b.txt": "four", "a-big.txt": strings.Repeat("word ", 20), "c.txt": "five"})
+	_, stderr, failed := j.exec(nil, "WARNINGS_IN_OUTPUT=true", "MAX_FILE_BYTES=50", "DUMP_TOKENS=true", "MAX_DUMP_TOKENS=2", "MAX_FILES=2")
+	if failed {
+		t.Fatalf("job failed: %s", stderr)
+	}
+	want := []warning{
+		{File: "a-big.txt", Message: "skipped: size 100 above MAX_FILE_BYTES 50"},
+		{File: "a.txt", Message: "DUMP_TOKENS: only the first 2 of 3 tokens are written"},
+		{Message: "MAX_FILES limit of 2 reached, not processing the remaining files"},
+	}
+	if got := j.report().Warnings; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("warnings = %v, want %v", got, want)
+	}
+	for _, w := range want {
+		if !strings.Contains(stderr, w.Message) {
+			t.Errorf("stderr = %q, want %q there, too", stderr, w.Message)
+		}
+	}
+
+	j.run("MAX_FILE_BYTES=50")
+	if out := j.output("count.json"); strings.Contains(out, `"warnings"`) {
+		t.Errorf("count.json lists warnings without WARNINGS_IN_OUTPUT:\n%s", out)
+	}
+}
+
+func TestFreqCaseInsensitive(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "The the THE cat Cat"})
+	j.run("MERGE_FREQUENCIES=true", "MATCH_TERMS=the,The")
+	var words []wordCount
+	j.outputJSON("frequencies.json", &words)
+	if want := "[{Cat 1} {THE 1} {The 1} {cat 1} {the 1}]"; fmt.Sprint(words) != want {
+		t.Errorf("case-sensitive frequencies = %v, want %s", words, want)
+	}
+	total := j.report().Total
+
+	j.run("MERGE_FREQUENCIES=true", "MATCH_TERMS=the,The", "FREQ_CASE_INSENSITIVE=true")
+	j.outputJSON("frequencies.json", &words)
+	if want := "[{the 3} {cat 2}]"; fmt.Sprint(words) != want {
+		t.Errorf("folded frequencies = %v, want %s", words, want)
+	}
+	if r := j.report(); r.Total != total || total != 5 {
+		t.Errorf("total = %d, then %d, want 5 either way", total, r.Total)
+	}
+	var terms []fileTerms
+	j.outputJSON("term_counts.json", &terms)
+	if want := "[{a.txt map[The:1 the:1]}]"; fmt.Sprint(terms) != want {
+		t.Errorf("term_counts.json = %v, want %s, with case intact", terms, want)
+	}
+}
+
+func TestTotalCaseSensitive(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "The the THE cat Cat"})
+	for _, c := range []struct {
+		freq, total       string
+		words, vocabulary int
+	}{
+		{"false", "", 5, 5},
+		{"true", "", 2, 5},
+		{"false", "false", 5, 2},
+		{"true", "false", 2, 2},
+		{"true", "true", 2, 5},
+	} {
+		j.run("MERGE_FREQUENCIES=true", "VOCAB_GROWTH=true", "FREQ_CASE_INSENSITIVE="+c.freq, "TOTAL_CASE_SENSITIVE="+c.total)
+		var words []wordCount
+		j.outputJSON("frequencies.json", &words)
+		var curve []growthPoint
+		j.outputJSON("vocab_growth.json", &curve)
+		if len(words) != c.words || len(curve) != 1 || curve[0].Unique != c.vocabulary || j.report().Total != 5 {
+			t.Errorf("FREQ_CASE_INSENSITIVE=%s TOTAL_CASE_SENSITIVE=%q: frequencies %v, curve %v, want %d words and %d unique",
+				c.freq, c.total, words, curve, c.words, c.vocabulary)
+		}
+	}
+}
+
+func TestURLList(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a.txt":
+			fmt.Fprint(w, "hello web world")
+		case "/slow.txt":
+			<-r.Context().Done()
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	j := newTestJob(t, map[string]string{"urls.txt": srv.URL + "/a.txt\n\n" + srv.URL + "/missing.txt\n" + srv.URL + "/slow.txt\n"})
+	j.run("URL_LIST=urls.txt", "URL_TIMEOUT=1")
+	r := j.report()
+	if r.Total != 3 || len(r.Files) != 1 || r.Files[0].Name != srv.URL+"/a.txt" {
+		t.Errorf("counted %v with %d words, want a.txt with 3 words", r.Files, r.Total)
+	}
+	if len(r.Skipped) != 2 || r.Skipped[0].Reason != "HTTP 404" || r.Skipped[1].Reason != "download failed: timeout" {
+		t.Errorf("skipped = %v, want missing.txt with 404 and slow.txt with a timeout", r.Skipped)
+	}
+	j.fail("readURLList", "URL_LIST=nothing.txt")
+}
+
+func TestURLListHashFilenames(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a.txt":
+			fmt.Fprint(w, "hello web world")
+		case "/slow.txt":
+			<-r.Context().Done()
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	urls := []string{srv.URL + "/a.txt", srv.URL + "/missing.txt", srv.URL + "/slow.txt", closed.URL + "/gone.txt"}
+	j := newTestJob(t, map[string]string{"urls.txt": strings.Join(urls, "\n")})
+	stdout, stderr, failed := j.exec(nil, "URL_LIST=urls.txt", "URL_TIMEOUT=1", "HASH_FILENAMES=true", "WARNINGS_IN_OUTPUT=true")
+	if failed {
+		t.Fatalf("job failed: %s", stderr)
+	}
+	r := j.report()
+	var reasons []string
+	for _, s := range r.Skipped {
+		reasons = append(reasons, s.Reason)
+	}
+	if want := []string{"HTTP 404", "download failed: timeout", "download failed: connection refused"}; r.Total != 3 || !slices.Equal(reasons, want) {
+		t.Errorf("total %d, skipped for %q, want 3 words and %q", r.Total, reasons, want)
+	}
+	outputs := map[string]string{"stdout": stdout, "stderr": stderr}
+	entries, err := os.ReadDir(j.path("outputs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		outputs[e.Name()] = j.output(e.Name())
+	}
+	for name, out := range outputs {
+		for _, u := range []string{srv.Listener.Addr().String(), closed.Listener.Addr().String(), "/a.txt", "/missing.txt", "/slow.txt", "/gone.txt"} {
+			if strings.Contains(out, u) {
+				t.Errorf("%s contains %q:\n%s", name, u, out)
+			}
+		}
+	}
+}
+
+func TestMinFrequency(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "the cat and the dog and the bird", "b.txt": "the end"})
+	j.run("MERGE_FREQUENCIES=true", "MIN_FREQUENCY=2", "VOCAB_GROWTH=true")
+	var words []wordCount
+	j.outputJSON("frequencies.json", &words)
+	if want := "[{the 4} {and 2}]"; fmt.Sprint(words) != want {
+		t.Errorf("frequencies.json = %v, want %s", words, want)
+	}
+	if r := j.report(); r.Total != 10 {
+		t.Errorf("total = %d, want 10, including the rare words", r.Total)
+	}
+	var curve []growthPoint
+	j.outputJSON("vocab_growth.json", &curve)
+	if last := curve[len(curve)-1]; last.Unique != 6 {
+		t.Errorf("%d unique words, want 6, including the rare words", last.Unique)
+	}
+
+	j.run("MERGE_FREQUENCIES=true", "MIN_FREQUENCY=5")
+	if out := j.output("frequencies.json"); out != "[]\n" {
+		t.Errorf("frequencies.json = %q, want an empty table", out)
+	}
+}
+
+func TestProcessOrder(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "three words here", "b.txt": "one", "c.txt": "two words", "d.txt": "one"})
+	now := time.Now().Truncate(time.Second)
+	for name, age := range map[string]time.Duration{"a.txt": time.Hour, "b.txt": 3 * time.Hour, "c.txt": 2 * time.Hour, "d.txt": 3 * time.Hour} {
+		mtime := now.Add(-age)
+		if err := os.Chtimes(j.path("inputs/"+name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Ties are ordered by name, even in descending order.
+	for _, tc := range []struct {
+		env  []string
+		want string
+	}{
+		{nil, "[a.txt b.txt c.txt d.txt]"},
+		{[]string{"PROCESS_ORDER=name", "PROCESS_ORDER_DESC=true"}, "[d.txt c.txt b.txt a.txt]"},
+		{[]string{"PROCESS_ORDER=size"}, "[b.txt d.txt c.txt a.txt]"},
+		{[]string{"PROCESS_ORDER=size", "PROCESS_ORDER_DESC=true"}, "[a.txt c.txt b.txt d.txt]"},
+		{[]string{"PROCESS_ORDER=mtime"}, "[b.txt d.txt c.txt a.txt]"},
+		{[]string{"PROCESS_ORDER=mtime", "PROCESS_ORDER_DESC=true"}, "[a.txt c.txt b.txt d.txt]"},
+	} {
+		j.run(append(tc.env, "STREAM_NDJSON=true")...)
+		var names []string
+		for _, f := range j.report().Files {
+			names = append(names, f.Name)
+		}
+		if got := fmt.Sprint(names); got != tc.want {
+			t.Errorf("%v: order %s, want %s", tc.env, got, tc.want)
+		}
+		zr, err := gzip.NewReader(strings.NewReader(j.output("count.ndjson.gz")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var streamed []string
+		for dec := json.NewDecoder(zr); dec.More(); {
+			var fc fileCount
+			if err := dec.Decode(&fc); err != nil {
+				t.Fatal(err)
+			}
+			streamed = append(streamed, fc.Name)
+		}
+		if got := fmt.Sprint(streamed); got != tc.want {
+			t.Errorf("%v: streamed in order %s, want %s", tc.env, got, tc.want)
+		}
+	}
+	j.fail("unknown key", "PROCESS_ORDER=random")
+}
+
+func TestCountSocial(t *testing.T) {
+	j := newTestJob(t, map[string]string{
+		"tweets.txt": "Loving #golang and #Go! Thanks @gopher (#golang) — see #東京 @café_bar\nmail me@example.com, #1 or #42nd, @@ and #",
+		"plain.txt":  "nothing social here",
+	})
+	j.run("COUNT_SOCIAL=true", "SOCIAL_LIST=true")
+	var got []fileSocial
+	j.outputJSON("social.json", &got)
+	want := []fileSocial{
+		{Name: "plain.txt", HashtagList: map[string]int{}, MentionList: map[string]int{}},
+		{
+			Name: "tweets.txt", Hashtags: 5, Mentions: 2,
+			HashtagList: map[string]int{"golang": 2, "Go": 1, "東京": 1, "42nd": 1},
+			MentionList: map[string]int{"gopher": 1, "café_bar": 1},
+		},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("social.json = %+v, want %+v", got, want)
+	}
+
+	j.run("COUNT_SOCIAL=true")
+	var counts []fileSocial
+	j.outputJSON("social.json", &counts)
+	if counts[1].Hashtags != 5 || counts[1].HashtagList != nil {
+		t.Errorf("without SOCIAL_LIST: %+v, want counts only", counts[1])
+	}
+}
+
+func TestSplitOutput(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "one", "sub/b.txt": "two words", "sub/deep/c.md": "three more words"})
+	j.stdin = "a.txt\nsub/b.txt\nsub/deep/c.md\n../outside.txt\n"
+	j.run("PATHS_FROM_STDIN=true", "SPLIT_OUTPUT=true")
+	if j.hasOutput("count.json") {
+		t.Error("count.json written alongside the per-file results")
+	}
+	for name, want := range map[string]int{"a.txt": 1, "sub/b.txt": 2, "sub/deep/c.md": 3} {
+		var f fileCount
+		j.outputJSON("counts/"+name+".json", &f)
+		if f.Name != name || f.Words != want {
+			t.Errorf("counts/%s.json = %+v, want %d words", name, f, want)
+		}
+	}
+	if j.hasOutput("outside.txt.json") || j.hasOutput("counts/../outside.txt.json") {
+		t.Error("result written outside of the counts directory")
+	}
+}
+
+func TestGroupTopWords(t *testing.T) {
+	j := newTestJob(t, map[string]string{
+		"a.log": "error: disk full disk\ninfo: service started\nerror: disk slow\n",
+		"b.log": "info: service stopped service\nplain line\n",
+	})
+	j.run("GROUP_FIELD_REGEX=^(\\w+):", "GROUP_TOP_WORDS=true", "TOP_N=2")
+	var top map[string][]wordCount
+	j.outputJSON("by_key_top_words.json", &top)
+	want := map[string][]wordCount{
+		"error": {{"disk", 3}, {"error:", 2}},
+		"info":  {{"service", 3}, {"info:", 2}},
+		"other": {{"line", 1}, {"plain", 1}},
+	}
+	if fmt.Sprint(top) != fmt.Sprint(want) {
+		t.Errorf("by_key_top_words.json = %v, want %v", top, want)
+	}
+
+	if err := os.Remove(j.path("outputs/by_key_top_words.json")); err != nil {
+		t.Fatal(err)
+	}
+	j.run("GROUP_FIELD_REGEX=^(\\w+):")
+	if j.hasOutput("by_key_top_words.json") {
+		t.Error("by_key_top_words.json written without GROUP_TOP_WORDS")
+	}
+}
+
+func TestSentencePunct(t *testing.T) {
+	j := newTestJob(t, map[string]string{
+		"zh.txt": "你好。今天天气很好！我们走吧",
+		"hy.txt": "Բարև։ Ինչպե՞ս ես։",
+		"ja.txt": "「行こう。」と言った。",
+		"en.txt": "One; two; three",
+	})
+	j.run("COUNT_SENTENCES=true")
+	r := j.report()
+	for name, want := range map[string]int{"zh.txt": 3, "hy.txt": 2, "ja.txt": 2, "en.txt": 1} {
+		if got := r.file(t, name).Sentences; got != want {
+			t.Errorf("%s: %d sentences, want %d", name, got, want)
+		}
+	}
+	j.run("COUNT_SENTENCES=true", "SENTENCE_PUNCT=;")
+	r = j.report()
+	for name, want := range map[string]int{"zh.txt": 1, "en.txt": 3} {
+		if got := r.file(t, name).Sentences; got != want {
+			t.Errorf("%s with SENTENCE_PUNCT=;: %d sentences, want %d", name, got, want)
+		}
+	}
+}
+
+func TestCountLinesMatching(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.log": "error error error\nok\nerror timeout\r\ntimeout timeout"})
+	j.run("MATCH_TERMS=error,timeout")
+	var got []fileTerms
+	j.outputJSON("term_counts.json", &got)
+	if want := "[{a.log map[error:4 timeout:3]}]"; fmt.Sprint(got) != want {
+		t.Errorf("occurrences = %v, want %s", got, want)
+	}
+	j.run("MATCH_TERMS=error,timeout", "COUNT_LINES_MATCHING=true")
+	var lines []fileTerms
+	j.outputJSON("term_counts.json", &lines)
+	if want := "[{a.log map[error:2 timeout:2]}]"; fmt.Sprint(lines) != want {
+		t.Errorf("matching lines = %v, want %s", lines, want)
+	}
+	if r := j.report(); r.Total != 8 {
+		t.Errorf("total = %d, want 8, as the word count stays the same", r.Total)
+	}
+}
+
+func TestStdoutJSON(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "one two", "b.txt": "three", "big.txt": strings.Repeat("word ", 20)})
+	out := j.run("STDOUT_FORMAT=json", "MAX_FILE_BYTES=50", "STDOUT_PREFIX=node-1")
+	if strings.Count(out, "\n") != 1 || !strings.HasSuffix(out, "\n") {
+		t.Fatalf("stdout = %q, want a single line", out)
+	}
+	var got stdoutSummary
+	dec := json.NewDecoder(strings.NewReader(out))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&got); err != nil {
+		t.Fatalf("stdout = %q: %v", out, err)
+	}
+	if want := (stdoutSummary{Prefix: "node-1", Total: 3, Files: 2, Bytes: 12, Skipped: 1}); got != want {
+		t.Errorf("stdout = %+v, want %+v", got, want)
+	}
+	if out := j.run("STDOUT_FORMAT=text", "MAX_FILE_BYTES=50"); out != "Total word count:  3\n" {
+		t.Errorf("text stdout = %q", out)
+	}
+	j.fail("does not work with STDOUT_NUMERIC_ONLY", "STDOUT_FORMAT=json", "STDOUT_NUMERIC_ONLY=true")
+	j.fail("unknown format", "STDOUT_FORMAT=xml")
+}
+
+func TestEmptyFile(t *testing.T) {
+	j := newTestJob(t, map[string]string{"empty.txt": "", "blank.txt": "  \n", "a.txt": "one"})
+	for _, tc := range []struct {
+		mode  string
+		files string
+		empty bool
+	}{
+		{"", "a.txt blank.txt empty.txt", false},
+		{"include", "a.txt blank.txt empty.txt", false},
+		{"flag", "a.txt blank.txt empty.txt", true},
+		{"skip", "a.txt blank.txt", false},
+	} {
+		j.run("EMPTY_FILE=" + tc.mode)
+		r := j.report()
+		var names []string
+		for _, f := range r.Files {
+			names = append(names, f.Name)
+			if f.Empty != (tc.empty && f.Name == "empty.txt") {
+				t.Errorf("EMPTY_FILE=%s: %s is flagged as empty: %v", tc.mode, f.Name, f.Empty)
+			}
+		}
+		if got := strings.Join(names, " "); got != tc.files {
+			t.Errorf("EMPTY_FILE=%s: files %s, want %s", tc.mode, got, tc.files)
+		}
+		skipped := len(r.Skipped) == 1 && r.Skipped[0].Name == "empty.txt"
+		if skipped != (tc.mode == "skip") {
+			t.Errorf("EMPTY_FILE=%s: skipped %v", tc.mode, r.Skipped)
+		}
+	}
+	j.fail("unknown mode", "EMPTY_FILE=hide")
+}
+
+func TestTokenShapes(t *testing.T) {
+	for word, want := range map[string]string{
+		"word": "lowercase", "Word": "capitalized", "I": "capitalized", "Yes,": "capitalized", "Ärger": "capitalized",
+		"NASA": "all_caps", "(UN)": "all_caps", "42": "number", "42.": "number", "-3.5": "number",
+		"--": "punctuation", "…": "punctuation", "+": "punctuation", "单词": "uncased",
+		"iPhone": "mixed", "B2B": "mixed", "Ελλάδα2": "mixed", "wORD": "mixed",
+	} {
+		if got := tokenShape(word); got != want {
+			t.Errorf("tokenShape(%q) = %s, want %s", word, got, want)
+		}
+	}
+
+	j := newTestJob(t, map[string]string{"a.txt": "The NASA launch in 2024 was a success -- said Dr. McFly"})
+	j.run("TOKEN_SHAPES=true")
+	want := map[string]int{"capitalized": 2, "all_caps": 1, "lowercase": 6, "number": 1, "punctuation": 1, "mixed": 1}
+	if got := j.report().file(t, "a.txt").Shapes; !maps.Equal(got, want) {
+		t.Errorf("shapes = %v, want %v", got, want)
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	defer clear(argOptions)
+	for _, tc := range []struct {
+		args []string
+		want map[string]string
+	}{
+		{[]string{"--top-n", "10", "--ascii-chart", "--filter-lines=ERROR", "--include-zero", "--sort-by", "words"},
+			map[string]string{"TOP_N": "10", "ASCII_CHART": "true", "FILTER_LINES": "ERROR", "INCLUDE_ZERO": "true", "SORT_BY": "words"}},
+		{[]string{"--strip-chars", "-_"}, map[string]string{"STRIP_CHARS": "-_"}},
+		{[]string{"--stdout-prefix="}, map[string]string{"STDOUT_PREFIX": ""}},
+		{[]string{"--version"}, map[string]string{"VERSION_INFO": "true"}},
+	} {
+		clear(argOptions)
+		if err := parseArgs(tc.args); err != nil {
+			t.Errorf("parseArgs(%q) = %v", tc.args, err)
+		} else if !maps.Equal(argOptions, tc.want) {
+			t.Errorf("parseArgs(%q) set %v, want %v", tc.args, argOptions, tc.want)
+		}
+	}
+	for args, want := range map[string]string{"--bogus": "unknown option", "stray": "unexpected argument", "--help": "help requested", "-h": "help requested"} {
+		if err := parseArgs(strings.Fields(args)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("parseArgs(%q) = %v, want %q", args, err, want)
+		}
+	}
+
+	j := newTestJob(t, map[string]string{"a.txt": "b a b c b a"})
+	stdout, _, failed := j.exec([]string{"--help"})
+	if failed || !strings.Contains(stdout, "--top-n (TOP_N)") || !strings.Contains(stdout, "--word-regex (WORD_REGEX)") {
+		t.Errorf("--help printed %q", stdout)
+	}
+	stdout, stderr, failed := j.exec([]string{"--stdout-numeric-only"}, "STDOUT_NUMERIC_ONLY=false", "STDOUT_PREFIX=env")
+	if failed || stdout != "env 6\n" {
+		t.Errorf("stdout = %q (%s), want the argument to override the environment", stdout, stderr)
+	}
+	if _, stderr, failed := j.exec([]string{"--no-such-option"}); !failed || !strings.Contains(stderr, "unknown option") {
+		t.Errorf("unknown option: stderr = %q", stderr)
+	}
+}
+
+func TestVersionInfo(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "one two"})
+	for _, tc := range []struct {
+		args []string
+		env  []string
+	}{{[]string{"--version"}, nil}, {nil, []string{"VERSION_INFO=true"}}} {
+		stdout, stderr, failed := j.exec(tc.args, tc.env...)
+		if failed || !strings.HasPrefix(stdout, "wordcount dev (") || !strings.Contains(stdout, "Invalid UTF-8: replace") {
+			t.Errorf("%q %q printed %q (%s)", tc.args, tc.env, stdout, stderr)
+		}
+		if j.hasOutput("count.json") {
+			t.Errorf("%q %q wrote count.json, want an exit after printing the version", tc.args, tc.env)
+		}
+	}
+	j.run()
+	if r := j.report(); r.Version != version {
+		t.Errorf("report version = %q, want %q", r.Version, version)
+	}
+}
+
+func TestFreqSortNeedsTag(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "b a"})
+	j.fail("unknown mode", "FREQ_SORT=random")
+	if newCollator != nil {
+		t.Skip("built with -tags xtext")
+	}
+	j.fail("needs a build with -tags xtext", "FREQ_SORT=unicode")
+}
+
+func TestDecode(t *testing.T) {
+	j := newTestJob(t, map[string]string{
+		"std.txt": "dGhlIHF1aWNr\nIGJyb3duIGZveA==\n",
+		"url.txt": "w7xiZXI_IGphLCBzw60",
+		"raw.txt": "not base64 at all!",
+	})
+	j.run("DECODE=base64", "INCLUDE_ZERO=true")
+	r := j.report()
+	for name, want := range map[string]int{"std.txt": 4, "url.txt": 3, "raw.txt": 4} {
+		if f := r.file(t, name); f.Words != want {
+			t.Errorf("%s: %d words, want %d", name, f.Words, want)
+		}
+	}
+	j.run("DECODE=base64", "DECODE_ERRORS=skip", "INCLUDE_ZERO=true")
+	r = j.report()
+	if f := r.file(t, "raw.txt"); !f.Skipped || len(r.Skipped) != 1 || !strings.Contains(r.Skipped[0].Reason, "base64") {
+		t.Errorf("raw.txt: skipped %v, reasons %v, want it skipped as not base64", f.Skipped, r.Skipped)
+	}
+	if r.Total != 7 {
+		t.Errorf("total = %d, want 7", r.Total)
+	}
+
+	j = newTestJob(t, map[string]string{"a.hex": "6f6e65 2074\n776f", "b.hex": "6f6e6"})
+	j.run("DECODE=hex")
+	r = j.report()
+	if a, b := r.file(t, "a.hex"), r.file(t, "b.hex"); a.Words != 2 || b.Words != 1 {
+		t.Errorf("hex: %d and %d words, want 2 and 1", a.Words, b.Words)
+	}
+	j.fail("unknown encoding", "DECODE=rot13")
+	j.fail("unknown policy", "DECODE=hex", "DECODE_ERRORS=ignore")
+}
+
+func TestStdoutTemplate(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "one two", "b.txt": "three", "big.txt": strings.Repeat("word ", 20)})
+	for tmpl, want := range map[string]string{
+		"": "Total word count:  3\n",
+		"words={{.Total}} files={{.Files}} bytes={{.Bytes}} skipped={{.Skipped}}": "node-1 words=3 files=2 bytes=12 skipped=1\n",
+		`{{printf "%05d" .Total}}`: "node-1 00003\n",
+	} {
+		env := []string{"MAX_FILE_BYTES=50", "STDOUT_TEMPLATE=" + tmpl}
+		if tmpl != "" {
+			env = append(env, "STDOUT_PREFIX=node-1")
+		}
+		if out := j.run(env...); out != want {
+			t.Errorf("STDOUT_TEMPLATE=%q: stdout = %q, want %q", tmpl, out, want)
+		}
+	}
+	j.fail("STDOUT_TEMPLATE", "STDOUT_TEMPLATE={{.Total")
+	j.fail("STDOUT_TEMPLATE", "STDOUT_TEMPLATE={{.Words}}")
+	j.fail("does not work with STDOUT_TEMPLATE", "STDOUT_TEMPLATE={{.Total}}", "STDOUT_NUMERIC_ONLY=true")
+	j.fail("does not work with STDOUT_NUMERIC_ONLY or STDOUT_TEMPLATE", "STDOUT_TEMPLATE={{.Total}}", "STDOUT_FORMAT=json")
+}
+
+func TestBlankLines(t *testing.T) {
+	j := newTestJob(t, map[string]string{
+		"a.txt":    "one\n\n \t\ntwo\n",
+		"crlf.txt": "one\r\n\r\ntwo\r\n",
+		"none.txt": "one two",
+	})
+	for _, tc := range []struct {
+		env   []string
+		name  string
+		lines int
+		blank int
+		ratio float64
+	}{
+		{[]string{"BLANK_LINES=empty"}, "a.txt", 4, 1, 0.25},
+		{[]string{"BLANK_LINES=whitespace"}, "a.txt", 4, 2, 0.5},
+		{[]string{"BLANK_LINES=empty"}, "crlf.txt", 3, 0, 0},
+		{[]string{"BLANK_LINES=empty", "NORMALIZE_NEWLINES=true"}, "crlf.txt", 3, 1, 0.3333},
+		{[]string{"BLANK_LINES=whitespace"}, "none.txt", 1, 0, 0},
+	} {
+		j.run(tc.env...)
+		f := j.report().file(t, tc.name)
+		if f.Lines != tc.lines || f.BlankLines != tc.blank || f.BlankRatio != tc.ratio {
+			t.Errorf("%q %s: %d lines, %d blank (%v), want %d, %d (%v)", tc.env, tc.name, f.Lines, f.BlankLines, f.BlankRatio, tc.lines, tc.blank, tc.ratio)
+		}
+	}
+	j.run()
+	if f := j.report().file(t, "a.txt"); f.Lines != 0 || f.BlankLines != 0 {
+		t.Errorf("without BLANK_LINES: %d lines, %d blank, want none", f.Lines, f.BlankLines)
+	}
+	j.fail("unknown mode", "BLANK_LINES=all")
+}
+
+func TestReduceStdin(t *testing.T) {
+	mapper1 := newTestJob(t, map[string]string{"a.txt": "one two", "big.txt": strings.Repeat("word ", 20)})
+	mapper2 := newTestJob(t, map[string]string{"b.txt": "three four five"})
+	ndjson := mapper1.run("STDOUT_FORMAT=ndjson", "MAX_FILE_BYTES=50", "INCLUDE_ZERO=true") +
+		mapper2.run("STDOUT_FORMAT=ndjson")
+	if strings.Count(ndjson, "\n") != 3 {
+		t.Fatalf("ndjson = %q, want a line per file", ndjson)
+	}
+
+	reducer := newTestJob(t, nil)
+	reducer.stdin = ndjson
+	out := reducer.run("REDUCE_STDIN=true", "STDOUT_PREFIX=all")
+	var got stdoutSummary
+	if err := json.Unmarshal([]byte(out), &got); err != nil || strings.Count(out, "\n") != 1 {
+		t.Fatalf("stdout = %q (%v), want a single line of JSON", out, err)
+	}
+	if want := (stdoutSummary{Prefix: "all", Total: 5, Files: 2, Bytes: 22, Skipped: 1}); got != want {
+		t.Errorf("stdout = %+v, want %+v", got, want)
+	}
+
+	reducer.stdin = ""
+	if out := reducer.run("REDUCE_STDIN=true"); out != `{"total":0,"files":0,"bytes":0,"skipped":0}`+"\n" {
+		t.Errorf("empty stdin: stdout = %q", out)
+	}
+	reducer.stdin = `{"name":"a.txt","words":2}` + "\nnot json\n"
+	reducer.fail("record 2", "REDUCE_STDIN=true")
+}
+
+func TestWordsPerKB(t *testing.T) {
+	j := newTestJob(t, map[string]string{"kb.txt": strings.Repeat("abc ", 256), "short.txt": "a b c", "empty.txt": ""})
+	j.run("WORDS_PER_KB=true", "ALLOW_EMPTY=true", "INCLUDE_ZERO=true")
+	r := j.report()
+	for name, want := range map[string]float64{"kb.txt": 256, "short.txt": 614.4, "empty.txt": 0} {
+		if f := r.file(t, name); f.WordsPerKB != want {
+			t.Errorf("%s: %v words per KB, want %v", name, f.WordsPerKB, want)
+		}
+	}
+	if !strings.Contains(j.output("count.json"), `"words_per_kb": 614.4`) || strings.Count(j.output("count.json"), "words_per_kb") != 2 {
+		t.Errorf("count.json = %s, want words_per_kb for the non-empty files only", j.output("count.json"))
+	}
+	j.run()
+	if f := j.report().file(t, "kb.txt"); f.WordsPerKB != 0 {
+		t.Errorf("without WORDS_PER_KB: %v words per KB", f.WordsPerKB)
+	}
+}
+
+func TestTrimAffixes(t *testing.T) {
+	opts := &options{trimPrefixes: []string{"__", "$"}, trimSuffixes: []string{"__", ":"}}
+	n, freq := countText(t, "label: label label:: __init__ init $$var var __ : ok", opts)
+	want := map[string]int{"label": 3, "init": 2, "var": 2, "ok": 1}
+	if n != 8 || !maps.Equal(freq, want) {
+		t.Errorf("count = %d, frequencies = %v, want 8, %v", n, freq, want)
+	}
+
+	j := newTestJob(t, map[string]string{"a.txt": "name: Ada\nname Bob\n__name__"})
+	j.run("TRIM_PREFIX=__", "TRIM_SUFFIX=__,:", "MERGE_FREQUENCIES=true")
+	var words []wordCount
+	j.outputJSON("frequencies.json", &words)
+	if len(words) == 0 || words[0] != (wordCount{"name", 3}) {
+		t.Errorf("frequencies.json = %v, want name first with 3", words)
+	}
+}
+
+// `parseProperties` reads "key=value" lines the way Java's `Properties.load` does, for the subset of the format that `writeProperties` uses.
+func parseProperties(t *testing.T, text string) map[string]string {
+	t.Helper()
+	props := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		var key []uint16
+		i := 0
+		for ; i < len(line) && line[i] != '='; i++ {
+			c := line[i]
+			if c != '\\' {
+				key = append(key, uint16(c))
+				continue
+			}
+			i++
+			switch line[i] {
+			case 'u':
+				u, err := strconv.ParseUint(line[i+1:i+5], 16, 16)
+				if err != nil {
+					t.Fatalf("line %q: %v", line, err)
+				}
+				key = append(key, uint16(u))
+				i += 4
+			case 't':
+				key = append(key, '\t')
+			case 'n':
+				key = append(key, '\n')
+			default:
+				key = append(key, uint16(line[i]))
+			}
+		}
+		if i == len(line) {
+			t.Fatalf("line %q has no unescaped '='", line)
+		}
+		props[string(utf16.Decode(key))] = line[i+1:]
+	}
+	return props
+}
+
+func TestPropertiesOutput(t *testing.T) {
+	j := newTestJob(t, map[string]string{
+		"my file.txt":         "one two",
+		"a=b:c.txt":           "one",
+		"#not!a\\comment.txt": "one two three",
+		"größe.txt":           "eins",
+		"emoji😀.txt":          "one two",
+	})
+	j.run("OUTPUT_FORMAT=properties")
+	text := j.output("count.properties")
+	if strings.ContainsFunc(text, func(r rune) bool { return r > 0x7e }) {
+		t.Errorf("count.properties = %q, want ASCII only", text)
+	}
+	want := map[string]string{"__total__": "9", "my file.txt": "2", "a=b:c.txt": "1", "#not!a\\comment.txt": "3", "größe.txt": "1", "emoji😀.txt": "2"}
+	if got := parseProperties(t, text); !maps.Equal(got, want) {
+		t.Errorf("count.properties = %q, parsed %v, want %v", text, got, want)
+	}
+}
+
+func TestCountAlphabet(t *testing.T) {
+	j := newTestJob(t, map[string]string{
+		"en.txt":  "abba cab\n",
+		"de.txt":  "Bäcker bäck",
+		"ru.txt":  "да да\tа",
+		"el.txt":  "αβ αβ",
+		"bad.txt": "a\xffb",
+	})
+	j.run("COUNT_ALPHABET=true", "ALPHABET_LIST=4")
+	r := j.report()
+	for name, want := range map[string]fileCount{
+		"en.txt":  {AlphabetSize: 3, Alphabet: "abc"},
+		"de.txt":  {AlphabetSize: 7, Alphabet: "Bbce"},
+		"ru.txt":  {AlphabetSize: 2, Alphabet: "ад"},
+		"el.txt":  {AlphabetSize: 2, Alphabet: "αβ"},
+		"bad.txt": {AlphabetSize: 3, Alphabet: "ab�"},
+	} {
+		if f := r.file(t, name); f.AlphabetSize != want.AlphabetSize || f.Alphabet != want.Alphabet {
+			t.Errorf("%s: alphabet %d %q, want %d %q", name, f.AlphabetSize, f.Alphabet, want.AlphabetSize, want.Alphabet)
+		}
+	}
+	// a, b, c, B, e, k, r, ä, д, а, α, β, and U+FFFD
+	if r.AlphabetSize != 13 || r.Alphabet != "Babc" {
+		t.Errorf("corpus alphabet %d %q, want 13 \"Babc\"", r.AlphabetSize, r.Alphabet)
+	}
+
+	j.run("COUNT_ALPHABET=true")
+	if r := j.report(); r.AlphabetSize != 13 || r.Alphabet != "" || r.file(t, "el.txt").Alphabet != "" {
+		t.Errorf("without ALPHABET_LIST: alphabet %d %q, want 13 and no list", r.AlphabetSize, r.Alphabet)
+	}
+	j.run()
+	if r := j.report(); r.AlphabetSize != 0 || r.file(t, "en.txt").AlphabetSize != 0 {
+		t.Errorf("without COUNT_ALPHABET: alphabet size %d", r.AlphabetSize)
+	}
+}
+
+func TestLongestLine(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "short\nλλλλλλ long line\nabcdefghijklmnop\nend"})
+	for _, tc := range []struct {
+		env     []string
+		preview string
+	}{
+		{nil, "λλλλλλ long line"},
+		{[]string{"LONGEST_LINE_PREVIEW=3"}, "λλλ"},
+		{[]string{"LONGEST_LINE_PREVIEW=0"}, ""},
+	} {
+		j.run(append(tc.env, "LONGEST_LINE=true")...)
+		f := j.report().file(t, "a.txt")
+		if f.LongestLine != 16 || f.LongestLineNumber != 2 || f.LongestLinePreview != tc.preview {
+			t.Errorf("%q: longest line = %d runes in line %d (%q), want 16 in line 2 (%q)", tc.env, f.LongestLine, f.LongestLineNumber, f.LongestLinePreview, tc.preview)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Memory-mapped reads need the `mmap` system call, which only Unix-like systems provide. Elsewhere, `mmapFile` stays nil and `READ_STRATEGY=mmap` falls back to buffered reads.
+func init() {
+	mmapFile = func(f *os.File, size int64) ([]byte, func() error, error) {
+		data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+		if err != nil {
+			return nil, nil, err
+		}
+		return data, func() error { return syscall.Munmap(data) }, nil
+	}
+}
@@ -0,0 +1,53 @@
+//go:build parquet
+
+package main
+
+import (
+	"github.com/parquet-go/parquet-go"
+)
+
+// Parquet output is optional, because the Parquet package is large and does not compile with TinyGo. Build with `-tags parquet` to enable `OUTPUT_FORMAT=parquet`.
+func init() {
+	countWriters["parquet"] = writeParquet
+}
+
+// A `parquetRow` is one row of "count.parquet". The optional metrics are zero where they were not collected.
+type parquetRow struct {
+	File      string `parquet:"file"`
+	Words     int64  `parquet:"words"`
+	Numbers   int64  `parquet:"numbers"`
+	Bytes     int64  `parquet:"bytes"`
+	Records   int64  `parquet:"records"`
+	Sentences int64  `parquet:"sentences"`
+	Skipped   bool   `parquet:"skipped"`
+}
+
+// `writeParquet` writes the per-file counts to "count.parquet", one row per file.
+func writeParquet(outputs *outputFiles, r *report) error {
+	out, err := outputs.create("count.parquet")
+	if err != nil {
+		return err
+	}
+	rows := make([]parquetRow, len(r.Files))
+	for i, f := range r.Files {
+		rows[i] = parquetRow{
+			File:      f.Name,
+			Words:     int64(f.Words),
+			Numbers:   int64(f.Numbers),
+			Bytes:     f.Bytes,
+			Records:   int64(f.Records),
+			Sentences: int64(f.Sentences),
+			Skipped:   f.Skipped,
+		}
+	}
+	w := parquet.NewGenericWriter[parquetRow](out)
+	if _, err := w.Write(rows); err != nil {
+		out.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,40 @@
+//go:build parquet
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+func TestParquetOutput(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "One. Two three.", "b.txt": "4 5", "big.txt": strings.Repeat("word ", 20)})
+	j.run("OUTPUT_FORMAT=parquet", "COUNT_SENTENCES=true", "TOTAL_EXCLUDE_NUMBERS=true", "MAX_FILE_BYTES=50", "INCLUDE_ZERO=true")
+	rows, err := parquet.ReadFile[parquetRow](j.path("outputs/count.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []parquetRow{
+		{File: "a.txt", Words: 3, Bytes: 15, Sentences: 2},
+		{File: "b.txt", Numbers: 2, Bytes: 3, Sentences: 1},
+		{File: "big.txt", Skipped: true},
+	}
+	if fmt.Sprint(rows) != fmt.Sprint(want) {
+		t.Errorf("rows = %v, want %v", rows, want)
+	}
+}
+
+func TestParquetOutputEmpty(t *testing.T) {
+	j := newTestJob(t, map[string]string{".wordcountignore": "*.txt\n", "a.txt": "excluded"})
+	j.run("OUTPUT_FORMAT=parquet", "ALLOW_EMPTY=true")
+	rows, err := parquet.ReadFile[parquetRow](j.path("outputs/count.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 0 {
+		t.Errorf("rows = %v, want none", rows)
+	}
+}
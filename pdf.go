@@ -0,0 +1,29 @@
+//go:build pdf
+
+package main
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/ledongthuc/pdf"
+)
+
+// PDF support is optional, because the PDF package is large and does not compile with TinyGo. Build with `-tags pdf` to add the "pdf" file handler, which extracts the text layer of PDF files. `FILE_HANDLERS=defaults` then includes `.pdf` files.
+func init() {
+	fileHandlers["pdf"] = pdfText
+	defaultHandlers[".pdf"] = "pdf"
+}
+
+// `pdfText` returns the plain text of all pages. A PDF that consists of scanned images only has no text layer, and so this returns no text at all.
+func pdfText(data []byte) ([]byte, error) {
+	r, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	text, err := r.GetPlainText()
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(text)
+}
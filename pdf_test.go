@@ -0,0 +1,55 @@
+//go:build pdf
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// `minimalPDF` builds a PDF of one page that shows `text` in a standard font.
+func minimalPDF(text string) string {
+	var b bytes.Buffer
+	var offsets []int
+	obj := func(body string) {
+		offsets = append(offsets, b.Len())
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+	b.WriteString("%PDF-1.4\n")
+	obj("<< /Type /Catalog /Pages 2 0 R >>")
+	obj("<< /Type /Pages /Kids [3 0 R] /Count 1 >>")
+	obj("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Contents 4 0 R /Resources << /Font << /F1 5 0 R >> >> >>")
+	content := fmt.Sprintf("BT /F1 12 Tf 72 720 Td (%s) Tj ET", text)
+	obj(fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content))
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, o := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", o)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return b.String()
+}
+
+func TestPDFHandler(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.pdf": minimalPDF("Hello from a PDF"), "b.txt": "plain text"})
+	j.run("FILE_HANDLERS=defaults")
+	r := j.report()
+	if got := r.file(t, "a.pdf").Words; got != 4 {
+		t.Errorf("a.pdf: %d words, want 4", got)
+	}
+	if got := r.file(t, "b.txt").Words; got != 2 {
+		t.Errorf("b.txt: %d words, want 2", got)
+	}
+
+	j.writeInput("a.pdf", minimalPDF(""))
+	j.run("FILE_HANDLERS=defaults", "WARNINGS_IN_OUTPUT=true")
+	r = j.report()
+	if r.file(t, "a.pdf").Words != 0 || len(r.Warnings) != 1 || r.Warnings[0].Message != "no text found" {
+		t.Errorf("PDF without text: %+v, warnings %v", r.file(t, "a.pdf"), r.Warnings)
+	}
+
+	j.writeInput("a.pdf", "not a PDF")
+	j.fail("preprocess", "FILE_HANDLERS=defaults")
+}
@@ -0,0 +1,86 @@
+//go:build sqlite
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLite output is optional, because the SQLite driver is large and does not compile with TinyGo. Build with `-tags sqlite` to enable `OUTPUT_FORMAT=sqlite`.
+func init() {
+	countWriters["sqlite"] = writeSQLite
+}
+
+// `writeSQLite` writes the per-file counts to the table `files` in "count.db". SQLite needs a real file to work on, so the database is built in a temporary directory and then copied to the outputs.
+func writeSQLite(outputs *outputFiles, r *report) error {
+	dir, err := os.MkdirTemp("", "count-db-")
+	if err != nil {
+		return fmt.Errorf("writeSQLite: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "count.db")
+	if err := fillSQLite(path, r); err != nil {
+		return fmt.Errorf("writeSQLite: %w", err)
+	}
+
+	db, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("writeSQLite: %w", err)
+	}
+	defer db.Close()
+	out, err := outputs.create("count.db")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, db); err != nil {
+		out.Close()
+		return fmt.Errorf("writeSQLite: %w", err)
+	}
+	return out.Close()
+}
+
+func fillSQLite(path string, r *report) error {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if _, err := db.Exec(`CREATE TABLE files (
+		name TEXT NOT NULL,
+		words INTEGER NOT NULL,
+		numbers INTEGER NOT NULL,
+		bytes INTEGER NOT NULL,
+		records INTEGER NOT NULL,
+		sentences INTEGER NOT NULL,
+		skipped INTEGER NOT NULL
+	)`); err != nil {
+		return err
+	}
+
+	// A single transaction is much faster than one per row.
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`INSERT INTO files VALUES (?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, f := range r.Files {
+		if _, err := stmt.Exec(f.Name, f.Words, f.Numbers, f.Bytes, f.Records, f.Sentences, f.Skipped); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return db.Close()
+}
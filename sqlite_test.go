@@ -0,0 +1,51 @@
+//go:build sqlite
+
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+func TestSQLiteOutput(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "one two three", "b.txt": "4 five", "big.txt": strings.Repeat("word ", 20)})
+	j.run("OUTPUT_FORMAT=sqlite", "TOTAL_EXCLUDE_NUMBERS=true", "MAX_FILE_BYTES=50", "INCLUDE_ZERO=true")
+	db, err := sql.Open("sqlite", j.path("outputs/count.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var rows, words, numbers, skipped int
+	err = db.QueryRow(`SELECT COUNT(*), SUM(words), SUM(numbers), SUM(skipped) FROM files`).Scan(&rows, &words, &numbers, &skipped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows != 3 || words != 4 || numbers != 1 || skipped != 1 {
+		t.Errorf("%d rows, %d words, %d numbers, %d skipped, want 3, 4, 1, and 1", rows, words, numbers, skipped)
+	}
+	var name string
+	if err := db.QueryRow(`SELECT name FROM files WHERE skipped`).Scan(&name); err != nil || name != "big.txt" {
+		t.Errorf("skipped file = %q, %v, want big.txt", name, err)
+	}
+}
+
+func TestSQLiteOutputEmpty(t *testing.T) {
+	j := newTestJob(t, map[string]string{".wordcountignore": "*.txt\n", "a.txt": "excluded"})
+	j.run("OUTPUT_FORMAT=sqlite", "ALLOW_EMPTY=true")
+	db, err := sql.Open("sqlite", j.path("outputs/count.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var rows int
+	var words sql.NullInt64
+	if err := db.QueryRow(`SELECT COUNT(*), SUM(words) FROM files`).Scan(&rows, &words); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 0 || words.Valid {
+		t.Errorf("%d rows, %v words, want an empty table", rows, words)
+	}
+}
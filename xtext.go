@@ -0,0 +1,47 @@
+//go:build xtext
+
+package main
+
+import (
+	"io"
+	"unicode"
+
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Collation and transliteration are optional, because they need the `golang.org/x/text` packages and the job shall compile without third-party packages. Build with `-tags xtext` to enable `FREQ_SORT=unicode`, `FREQ_SORT=locale`, and `TRANSLITERATE`.
+func init() {
+	newCollator = func(locale string) (func(a, b string) bool, error) {
+		tag := language.Und
+		if locale != "" {
+			var err error
+			if tag, err = language.Parse(locale); err != nil {
+				return nil, err
+			}
+		}
+		c := collate.New(tag)
+		return func(a, b string) bool {
+			if r := c.CompareString(a, b); r != 0 {
+				return r < 0
+			}
+			return a < b
+		}, nil
+	}
+	transliterate = func(r io.Reader) io.Reader {
+		return transform.NewReader(r, transliteration())
+	}
+}
+
+// `transliteration` returns a transformer that removes accents: It decomposes letters into the base letter and combining marks, drops the marks, and composes the rest again. Transformers keep state, so each stream needs its own.
+func transliteration() transform.Transformer {
+	return transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), runes.Map(func(r rune) rune {
+		if a, ok := asciiLetters[r]; ok {
+			return a
+		}
+		return r
+	}), norm.NFC)
+}
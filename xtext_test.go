@@ -0,0 +1,49 @@
+//go:build xtext
+
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"testing"
+)
+
+func TestTransliterate(t *testing.T) {
+	_, freq := countText(t, "café cafe Ñandú nandu Øre ore straße naïve", &options{transliterate: true})
+	want := map[string]int{"cafe": 2, "Nandu": 1, "nandu": 1, "Ore": 1, "ore": 1, "straße": 1, "naive": 1}
+	if !maps.Equal(freq, want) {
+		t.Errorf("frequencies = %v, want %v", freq, want)
+	}
+
+	j := newTestJob(t, map[string]string{"a.txt": "Crème brûlée, creme brulee.", "b.txt": "crème"})
+	j.run("TRANSLITERATE=true", "MERGE_FREQUENCIES=true", "PIPELINE=lowercase,strip-punct")
+	var words []wordCount
+	j.outputJSON("frequencies.json", &words)
+	if want := "[{creme 3} {brulee 2}]"; fmt.Sprint(words) != want {
+		t.Errorf("frequencies.json = %v, want %s", words, want)
+	}
+}
+
+func TestFreqSort(t *testing.T) {
+	j := newTestJob(t, map[string]string{"a.txt": "Zebra apple été zoo öl"})
+	for _, tc := range []struct{ env, want []string }{
+		{nil, []string{"Zebra", "apple", "zoo", "été", "öl"}},
+		{[]string{"FREQ_SORT=byte"}, []string{"Zebra", "apple", "zoo", "été", "öl"}},
+		{[]string{"FREQ_SORT=unicode"}, []string{"apple", "été", "öl", "Zebra", "zoo"}},
+		{[]string{"FREQ_SORT=locale", "LOCALE=sv"}, []string{"apple", "été", "Zebra", "zoo", "öl"}},
+	} {
+		j.run(append(tc.env, "MERGE_FREQUENCIES=true")...)
+		var words []wordCount
+		j.outputJSON("frequencies.json", &words)
+		got := make([]string, len(words))
+		for i, w := range words {
+			got[i] = w.Word
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("%q: order %q, want %q", tc.env, got, tc.want)
+		}
+	}
+	j.fail("needs a LOCALE", "FREQ_SORT=locale")
+	j.fail("LOCALE", "FREQ_SORT=locale", "LOCALE=not a locale!")
+}